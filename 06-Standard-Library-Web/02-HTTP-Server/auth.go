@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPasswordIterations is the PBKDF2-HMAC-SHA256 work factor
+// recommended by OWASP (2023).
+const defaultPasswordIterations = 600_000
+
+// hashPassword derives a salted PBKDF2-HMAC-SHA256 hash, encoded as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" so the cost can be raised later
+// without invalidating stored hashes.
+func hashPassword(password string, iterations int) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches an encoded hash.
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	var counter [4]byte
+	for block := 1; block <= blocks; block++ {
+		// U1 = PRF(password, salt || INT(block))
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		key = prf.Sum(key)
+
+		// T = U1 ^ U2 ^ ... ^ Uc
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:keyLen]
+}
+
+// account is a stored login: a password hash and the roles it grants.
+type account struct {
+	PasswordHash string
+	Roles        []string
+}
+
+// credentialStore maps usernames to accounts.
+type credentialStore struct {
+	mu       sync.RWMutex
+	accounts map[string]account
+
+	// dummyHash is checked for unknown users so a failed login takes
+	// the same time whether or not the username exists.
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+func newCredentialStore() *credentialStore {
+	return &credentialStore{accounts: map[string]account{}}
+}
+
+// Add stores an already-hashed password for username.
+func (c *credentialStore) Add(username, passwordHash string, roles ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accounts[username] = account{PasswordHash: passwordHash, Roles: roles}
+}
+
+// Authenticate returns the principal for valid credentials.
+func (c *credentialStore) Authenticate(username, password string) (Principal, bool) {
+	c.mu.RLock()
+	acct, ok := c.accounts[username]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.dummyOnce.Do(func() {
+			c.dummyHash, _ = hashPassword("dummy", defaultPasswordIterations)
+		})
+		checkPassword(c.dummyHash, password)
+		return Principal{}, false
+	}
+	if !checkPassword(acct.PasswordHash, password) {
+		return Principal{}, false
+	}
+	return Principal{Subject: username, Roles: acct.Roles}, true
+}
+
+// loginRequest is the body of POST /login.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginResponse follows the OAuth 2.0 token response shape (RFC 6749 §5.1).
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Handle POST /login
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var errs ValidationErrors
+	if req.Username == "" {
+		errs = append(errs, ValidationError{"username", "is required"})
+	}
+	if req.Password == "" {
+		errs = append(errs, ValidationError{"password", "is required"})
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, http.StatusBadRequest, "missing credentials", errs)
+		return
+	}
+
+	principal, ok := s.credentials.Authenticate(req.Username, req.Password)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	token, exp, err := s.auth.Issue(principal)
+	if err != nil {
+		log.Printf("issue token: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, loginResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(exp.Sub(s.auth.now()).Seconds()),
+	})
+}
+
+// principalKey is the context key for the authenticated Principal.
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying p.
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal set by authMiddleware, if any.
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Middleware: Authentication
+// Requires "Authorization: Bearer <token>" with a token from /login and
+// stores the verified Principal in the request context.
+func (s *server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		principal, err := s.auth.Verify(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="users", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+// requireRole only lets principals with at least one of roles through.
+// It must run inside authMiddleware.
+func requireRole(roles ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := principalFrom(r.Context())
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			for _, role := range roles {
+				if principal.HasRole(role) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			writeError(w, http.StatusForbidden,
+				fmt.Sprintf("requires role %s", strings.Join(roles, " or ")))
+		})
+	}
+}
+
+// authFromEnv builds the token authority from JWT_SECRET. Without it a
+// random secret is generated, so tokens don't survive a restart.
+func authFromEnv() (*tokenAuth, error) {
+	secret := []byte(os.Getenv("JWT_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		log.Println("JWT_SECRET not set; using a random secret")
+	} else if len(secret) < 32 {
+		return nil, errors.New("JWT_SECRET must be at least 32 bytes")
+	}
+	return newTokenAuth(secret, "go-learning-lab", "users-api", time.Hour), nil
+}
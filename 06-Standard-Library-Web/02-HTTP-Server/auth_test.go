@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2Vectors(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 (RFC 7914 §11 and common references)
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, 32))
+		if got != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+
+	// RFC 7914 §11 vector with a 64-byte key (two blocks)
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Errorf("Two-block key mismatch: %s", got)
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("s3cret", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$1000$") {
+		t.Errorf("Unexpected hash format: %s", hash)
+	}
+	if !checkPassword(hash, "s3cret") {
+		t.Error("Expected correct password to match")
+	}
+	if checkPassword(hash, "S3cret") {
+		t.Error("Expected wrong password to fail")
+	}
+
+	other, _ := hashPassword("s3cret", 1000)
+	if other == hash {
+		t.Error("Expected different salts for the same password")
+	}
+
+	for _, bad := range []string{"", "plain", "md5$1$a$b", "pbkdf2-sha256$x$a$b", "pbkdf2-sha256$1$!!$b"} {
+		if checkPassword(bad, "s3cret") {
+			t.Errorf("Expected malformed hash %q to fail", bad)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s, _ := newTestServer()
+
+	w := serve(s, "POST", "/login", `{"username":"alice","password":"alice-password"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected Cache-Control: no-store on token response")
+	}
+
+	var resp loginResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.TokenType != "Bearer" || resp.ExpiresIn <= 0 {
+		t.Errorf("Unexpected login response: %+v", resp)
+	}
+
+	p, err := s.auth.Verify(resp.AccessToken)
+	if err != nil {
+		t.Fatalf("Issued token does not verify: %v", err)
+	}
+	if p.Subject != "alice" || !p.HasRole("user") {
+		t.Errorf("Unexpected principal: %+v", p)
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	s, _ := newTestServer()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"wrong password", `{"username":"alice","password":"nope"}`, http.StatusUnauthorized},
+		{"unknown user", `{"username":"mallory","password":"alice-password"}`, http.StatusUnauthorized},
+		{"missing fields", `{}`, http.StatusBadRequest},
+		{"unknown field", `{"username":"alice","password":"alice-password","role":"admin"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, "POST", "/login", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			decodeProblem(t, w)
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	s, _ := newTestServer()
+	expired := newTestAuth()
+	expired.ttl = -1
+
+	token, _, _ := expired.Issue(Principal{Subject: "alice"})
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"basic auth", "Basic YWxpY2U6cGFzc3dvcmQ=", http.StatusUnauthorized},
+		{"garbage token", "Bearer not.a.token", http.StatusUnauthorized},
+		{"expired token", "Bearer " + token, http.StatusUnauthorized},
+		{"valid token", bearer(t, s, "user"), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(s, tt.header, "GET", "/protected", "")
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.status == http.StatusUnauthorized {
+				if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+					t.Error("Expected WWW-Authenticate: Bearer challenge")
+				}
+				return
+			}
+
+			var body map[string]any
+			json.NewDecoder(w.Body).Decode(&body)
+			if body["user"] != "tester" {
+				t.Errorf("Expected principal in context, got %v", body)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	s, store := newTestServer()
+
+	w := serve(s, "DELETE", "/users/1", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+
+	w = serveAs(s, bearer(t, s, "user"), "DELETE", "/users/1", "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for user role, got %d", w.Code)
+	}
+	decodeProblem(t, w)
+	mustGet(t, store, 1)
+
+	w = serveWith(s, ifMatch(t, store, 1, bearer(t, s, "user", "admin")), "DELETE", "/users/1", "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 for admin role, got %d", w.Code)
+	}
+}
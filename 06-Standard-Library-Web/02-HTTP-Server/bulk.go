@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// importBatchSize is how many users go into one transaction.
+	importBatchSize = 100
+	// maxImportBytes caps an import body; maxImportLine caps one line.
+	maxImportBytes = 32 << 20 // 32 MiB
+	maxImportLine  = 64 << 10
+	// maxImportErrors bounds the errors listed in a report; failed still
+	// counts them all.
+	maxImportErrors = 100
+	// exportPageSize is how many users an export reads per query.
+	exportPageSize = 500
+	// bulkIOTimeout bounds each batch of a bulk request. Imports and
+	// exports outlive the server's Read/WriteTimeout, so the deadlines are
+	// pushed back as they make progress.
+	bulkIOTimeout = 30 * time.Second
+)
+
+// importParams documents the import query for the OpenAPI document.
+type importParams struct {
+	Atomic bool `query:"atomic" doc:"Create every user or none; default false"`
+}
+
+// importReport is the result of a non-atomic import. Errors use the same
+// "line N: field" names as the CSV import.
+type importReport struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Errors  ValidationErrors `json:"errors,omitempty"`
+}
+
+// userImport is the state of one POST /users:import.
+type userImport struct {
+	store  UserStore
+	atomic bool
+	batch  []stagedUser // valid lines waiting for flush
+	report importReport
+}
+
+// stagedUser is a valid line, read but not yet created.
+type stagedUser struct {
+	line int
+	user User
+}
+
+// fail records an error for line.
+func (im *userImport) fail(line int, field, message string) {
+	name := fmt.Sprintf("line %d", line)
+	if field != "" {
+		name += ": " + field
+	}
+	if len(im.report.Errors) < maxImportErrors {
+		im.report.Errors = append(im.report.Errors, ValidationError{name, message})
+	}
+}
+
+// flush creates the staged users in one transaction. The batch is fully
+// read before Begin, so the transaction (and SQLite's write lock) is never
+// held while waiting on the client. A taken email is a line error; in
+// atomic mode it rolls everything back. Only store errors are returned.
+func (im *userImport) flush(ctx context.Context) error {
+	batch := im.batch
+	im.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := im.store.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	created := 0
+	for _, staged := range batch {
+		_, err := tx.Create(ctx, staged.user)
+		if errors.Is(err, ErrEmailTaken) {
+			im.report.Failed++
+			im.fail(staged.line, "email", err.Error())
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		created++
+	}
+	if im.atomic && im.report.Failed > 0 {
+		return tx.Rollback()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	im.report.Created += created
+	return nil
+}
+
+// Handle POST /users:import
+// Reads one JSON user per line. Each line is validated on its own and
+// users are created importBatchSize at a time, each batch in a
+// transaction, so a bad line is reported without stopping the rest. With
+// ?atomic=true the whole body is read first (it is capped at
+// maxImportBytes) and created in one transaction; any bad line rolls it
+// back with a 422 listing every error. Blank lines are skipped.
+func (s *server) handleImportUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requestMediaType(w, r, mediaNDJSON); !ok {
+		return
+	}
+	im := &userImport{store: s.store}
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		atomic, err := strconv.ParseBool(v)
+		if err != nil {
+			writeValidationErrors(w, http.StatusBadRequest, "invalid query parameters", ValidationErrors{
+				{"atomic", "must be true or false"},
+			})
+			return
+		}
+		im.atomic = atomic
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(bulkIOTimeout))
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	scanner.Buffer(make([]byte, 0, 4096), maxImportLine)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		user, err := decodeImportLine(text)
+		if err != nil {
+			im.report.Failed++
+			im.fail(line, "", err.Error())
+			continue
+		}
+		if err := validateUser(user); err != nil {
+			im.report.Failed++
+			var errs ValidationErrors
+			errors.As(err, &errs)
+			for _, e := range errs {
+				im.fail(line, e.Field, e.Message)
+			}
+			continue
+		}
+		im.batch = append(im.batch, stagedUser{line, user})
+
+		if !im.atomic && len(im.batch) == importBatchSize {
+			if err := im.flush(r.Context()); err != nil {
+				s.writeImportError(w, im, err)
+				return
+			}
+			rc.SetReadDeadline(time.Now().Add(bulkIOTimeout))
+		}
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch err := scanner.Err(); {
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"request body must not exceed %d bytes; %d user(s) were created", maxBytesErr.Limit, im.report.Created))
+		return
+	case errors.Is(err, bufio.ErrTooLong):
+		writeError(w, http.StatusBadRequest, fmt.Sprintf(
+			"line %d is longer than %d bytes; %d user(s) were created", line+1, maxImportLine, im.report.Created))
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf(
+			"could not read request body; %d user(s) were created", im.report.Created))
+		return
+	}
+
+	// An atomic import with bad lines never opens a transaction
+	if !im.atomic || im.report.Failed == 0 {
+		if err := im.flush(r.Context()); err != nil {
+			s.writeImportError(w, im, err)
+			return
+		}
+	}
+	if im.atomic && im.report.Failed > 0 {
+		writeValidationErrors(w, http.StatusUnprocessableEntity,
+			fmt.Sprintf("%d line(s) are invalid; nothing was created", im.report.Failed), im.report.Errors)
+		return
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(bulkIOTimeout))
+	writeJSON(w, http.StatusOK, im.report)
+}
+
+// writeImportError reports a failed commit. Only a concurrent create can
+// take an email between a batch's checks and its commit; the batch is
+// lost then, and the 409 says how many users made it in before it.
+func (s *server) writeImportError(w http.ResponseWriter, im *userImport, err error) {
+	if errors.Is(err, ErrEmailTaken) {
+		writeError(w, http.StatusConflict,
+			fmt.Sprintf("%v; the batch was rolled back after %d user(s) were created", err, im.report.Created))
+		return
+	}
+	writeStoreError(w, err)
+}
+
+// decodeImportLine strictly decodes one line, like decodeJSON does a body.
+func decodeImportLine(line []byte) (User, error) {
+	var user User
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&user); err != nil {
+		return User{}, fmt.Errorf("malformed JSON: %w", err)
+	}
+	if dec.More() {
+		return User{}, errors.New("malformed JSON: a line must contain a single JSON object")
+	}
+	return user, nil
+}
+
+// Handle GET /users:export
+// Streams every user as NDJSON in ID order. Users are read
+// exportPageSize at a time with ListAfter and flushed after each page, so
+// memory stays flat however large the table is. A store error after the
+// first page aborts the connection, which the client sees as a truncated
+// download rather than a valid-looking short one.
+func (s *server) handleExportUsers(w http.ResponseWriter, r *http.Request) {
+	page, err := s.store.ListAfter(r.Context(), 0, exportPageSize)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", mediaNDJSON)
+	w.Header().Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+	enc := json.NewEncoder(w)
+	for {
+		rc.SetWriteDeadline(time.Now().Add(bulkIOTimeout))
+		for _, u := range page {
+			if err := enc.Encode(u); err != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil || len(page) < exportPageSize {
+			return
+		}
+
+		page, err = s.store.ListAfter(r.Context(), page[len(page)-1].ID, exportPageSize)
+		if err != nil {
+			if r.Context().Err() == nil {
+				s.logger.Error("export failed", "request_id", requestIDFrom(r.Context()), "error", err)
+			}
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
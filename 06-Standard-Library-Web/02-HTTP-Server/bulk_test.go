@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// importUsers sends POST /users:import as an admin.
+func importUsers(t *testing.T, s *server, query, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveWith(s, http.Header{
+		"Authorization": {bearer(t, s, "admin")},
+		"Content-Type":  {mediaNDJSON},
+	}, "POST", "/users:import"+query, body)
+}
+
+func decodeReport(t *testing.T, w *httptest.ResponseRecorder) importReport {
+	t.Helper()
+	var report importReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestImportUsersReportsLineErrors(t *testing.T) {
+	s, store := newTestServer()
+	body := strings.Join([]string{
+		`{"name":"Carol","email":"carol@example.com"}`,
+		`{"name":"","email":"not-an-email"}`,
+		``,
+		`{"name":"Dave",`,
+		`{"name":"Alice again","email":"alice@example.com"}`,
+		`{"name":"Eve","email":"eve@example.com"}`,
+	}, "\n")
+
+	w := importUsers(t, s, "", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	report := decodeReport(t, w)
+	if report.Created != 2 || report.Failed != 3 {
+		t.Errorf("Expected 2 created and 3 failed, got %+v", report)
+	}
+	var fields []string
+	for _, e := range report.Errors {
+		fields = append(fields, e.Field)
+	}
+	want := "[line 2: name line 2: email line 4 line 5: email]"
+	if fmt.Sprint(fields) != want {
+		t.Errorf("Expected errors for %s, got %v", want, fields)
+	}
+	if n := countUsers(t, store); n != 4 {
+		t.Errorf("Expected 4 users, got %d", n)
+	}
+}
+
+func TestImportUsersAtomic(t *testing.T) {
+	s, store := newTestServer()
+	body := `{"name":"Carol","email":"carol@example.com"}
+{"name":"Dave","email":"dave@example.com","role":"admin"}
+`
+	w := importUsers(t, s, "?atomic=true", body)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422, got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"line 2"`) {
+		t.Errorf("Expected the bad line in the problem, got %s", w.Body)
+	}
+	if n := countUsers(t, store); n != 2 {
+		t.Errorf("Expected nothing to be created, store has %d users", n)
+	}
+
+	w = importUsers(t, s, "?atomic=true", `{"name":"Carol","email":"carol@example.com"}`)
+	if report := decodeReport(t, w); w.Code != http.StatusOK || report.Created != 1 {
+		t.Errorf("Expected 1 user created, got %d %+v", w.Code, report)
+	}
+}
+
+func TestImportUsersBatches(t *testing.T) {
+	s, store := newTestServer()
+	var body strings.Builder
+	n := importBatchSize*2 + 50
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&body, `{"name":"User %d","email":"user%d@example.com"}`+"\n", i, i)
+	}
+
+	w := importUsers(t, s, "", body.String())
+	if report := decodeReport(t, w); report.Created != n || report.Failed != 0 {
+		t.Errorf("Expected %d created, got %+v", n, report)
+	}
+	if got := countUsers(t, store); got != n+2 {
+		t.Errorf("Expected %d users, got %d", n+2, got)
+	}
+	sub, _, got, _ := s.events.Subscribe(0, false)
+	s.events.Unsubscribe(sub)
+	if got != uint64(n) {
+		t.Errorf("Expected an event per imported user, last event is %d", got)
+	}
+}
+
+// TestImportUsersDoesNotHoldWriteLock creates a user while an import body
+// is still arriving. The import must not keep a transaction open while it
+// waits on the client, or SQLite's write lock makes the create fail with
+// "database is locked".
+func TestImportUsersDoesNotHoldWriteLock(t *testing.T) {
+	for _, atomic := range []string{"", "?atomic=true"} {
+		t.Run("query="+atomic, func(t *testing.T) {
+			// A file database, so the two requests use separate connections;
+			// a short busy timeout makes a held lock fail fast
+			dsn := filepath.Join(t.TempDir(), "users.db") + "?_busy_timeout=500"
+			db, err := sql.Open("sqlite3", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			store, err := NewSQLUserStore(context.Background(), db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newQuietServer(store)
+
+			body, send := io.Pipe()
+			req := httptest.NewRequest("POST", "/users:import"+atomic, body)
+			req.Header.Set("Authorization", bearer(t, s, "admin"))
+			req.Header.Set("Content-Type", mediaNDJSON)
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.handler().ServeHTTP(w, req)
+			}()
+
+			// A full batch and then some; the second write only returns
+			// once the handler has consumed the first
+			var lines strings.Builder
+			for i := 0; i < importBatchSize+10; i++ {
+				fmt.Fprintf(&lines, `{"name":"User %d","email":"user%d@example.com"}`+"\n", i, i)
+			}
+			io.WriteString(send, lines.String())
+			io.WriteString(send, "\n")
+
+			if _, err := store.Create(context.Background(), User{Name: "Other", Email: "other@example.com"}); err != nil {
+				t.Errorf("Expected a concurrent writer to succeed mid-import, got %v", err)
+			}
+
+			send.Close()
+			<-done
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body)
+			}
+			if report := decodeReport(t, w); report.Created != importBatchSize+10 {
+				t.Errorf("Expected %d created, got %+v", importBatchSize+10, report)
+			}
+		})
+	}
+}
+
+func TestImportUsersRejections(t *testing.T) {
+	s, _ := newTestServer()
+
+	tests := []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+	}{
+		{"no token", serveWith(s, http.Header{"Content-Type": {mediaNDJSON}}, "POST", "/users:import", "{}"), http.StatusUnauthorized},
+		{"not admin", serveWith(s, http.Header{
+			"Authorization": {bearer(t, s, "user")},
+			"Content-Type":  {mediaNDJSON},
+		}, "POST", "/users:import", "{}"), http.StatusForbidden},
+		{"JSON body", serveAs(s, bearer(t, s, "admin"), "POST", "/users:import", "[]"), http.StatusUnsupportedMediaType},
+		{"bad atomic", importUsers(t, s, "?atomic=maybe", "{}"), http.StatusBadRequest},
+		{"long line", importUsers(t, s, "", strings.Repeat("x", maxImportLine+1)), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if tt.w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.status, tt.w.Code, tt.w.Body)
+		}
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	s, store := newTestServer()
+	n := exportPageSize + 10
+	for i := 0; i < n; i++ {
+		store.Create(context.Background(), User{Name: "User", Email: fmt.Sprintf("user%d@example.com", i)})
+	}
+
+	w := serve(s, "GET", "/users:export", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != mediaNDJSON {
+		t.Fatalf("Expected NDJSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	scanner := bufio.NewScanner(w.Body)
+	lastID := 0
+	lines := 0
+	for scanner.Scan() {
+		var u User
+		if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			t.Fatalf("Line %d: %v", lines+1, err)
+		}
+		if u.ID <= lastID {
+			t.Fatalf("Expected increasing IDs, got %d after %d", u.ID, lastID)
+		}
+		lastID = u.ID
+		lines++
+	}
+	if lines != n+2 {
+		t.Errorf("Expected %d users, got %d", n+2, lines)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressMinSize is the smallest body worth compressing. Below roughly
+// one packet the gzip header and CPU time outweigh the savings.
+const compressMinSize = 1024
+
+// encoder is what gzip.Writer and zlib.Writer have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools recycle compressors; each one allocates hundreds of KiB.
+// "deflate" in HTTP means the zlib format (RFC 9110 §8.4.1.2), not raw
+// DEFLATE, hence compress/zlib.
+var encoderPools = map[string]*sync.Pool{
+	"gzip":    {New: func() any { return gzip.NewWriter(io.Discard) }},
+	"deflate": {New: func() any { return zlib.NewWriter(io.Discard) }},
+}
+
+// Middleware: Response compression
+// compressMiddleware gzips or deflates responses for clients that accept
+// it. The first minSize bytes are buffered to decide: small bodies,
+// bodies that already have a Content-Encoding and already-compressed
+// media types (images, archives) are sent as they are. A Flush commits
+// early, so streamed responses (NDJSON, events) are compressed and still
+// reach the client chunk by chunk.
+//
+// A compressed body is a different representation, so its ETag gets the
+// coding as a suffix (see encodedETag); matchETag strips it again, and
+// If-Match keeps working whichever encoding the client saw.
+func compressMiddleware(minSize int) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize,
+				ifNoneMatch: r.Header.Get("If-None-Match")}
+			next.ServeHTTP(cw, r)
+			// Not deferred: after a panic the buffered body must be
+			// dropped so recoverMiddleware can still send a clean 500.
+			cw.Close()
+		})
+	}
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip when both are equally welcome. It returns "" when the
+// client accepts neither.
+func acceptedEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			weight = v
+		}
+		q[coding] = weight
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		weight, ok := q[coding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
+
+// incompressible lists Content-Type prefixes that are already compressed.
+var incompressible = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "application/x-bzip2", "application/x-7z-compressed",
+	"application/pdf",
+}
+
+func compressible(contentType string) bool {
+	if strings.HasPrefix(contentType, "image/svg+xml") {
+		return true
+	}
+	for _, prefix := range incompressible {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// to compress it, then either streams through an encoder or passes
+// everything to the underlying writer untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	// ifNoneMatch tells a 304 which tag the client's copy carries
+	ifNoneMatch string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// 1xx responses go out now; the final status waits for the decision
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(false); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the header and the buffered bytes, switching to the
+// encoder if the response qualifies. streaming is set when a Flush forces
+// the decision, in which case a small body is no reason to skip.
+func (w *compressWriter) decide(streaming bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// net/http would sniff the compressed bytes otherwise
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	tag := h.Get("ETag")
+	if w.shouldCompress(streaming) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		if tag != "" {
+			h.Set("ETag", encodedETag(tag, w.encoding))
+		}
+		w.enc = encoderPools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	} else if w.status == http.StatusNotModified && tag != "" &&
+		strings.Contains(w.ifNoneMatch, strings.TrimPrefix(encodedETag(tag, w.encoding), "W/")) {
+		// The cache revalidating holds the compressed body; a 304 updates
+		// its stored headers, so it must get back the tag it sent
+		h.Set("ETag", encodedETag(tag, w.encoding))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.enc != nil {
+		_, err := w.enc.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *compressWriter) shouldCompress(streaming bool) bool {
+	h := w.Header()
+	switch {
+	case w.status == http.StatusNoContent, w.status == http.StatusNotModified:
+		return false
+	case h.Get("Content-Encoding") != "":
+		return false
+	case !compressible(h.Get("Content-Type")):
+		return false
+	}
+	return streaming || len(w.buf) >= w.minSize
+}
+
+// Flush commits to a decision, pushes compressed bytes out of the
+// encoder and flushes the connection.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(true); err != nil {
+			return
+		}
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close sends anything still buffered and finishes the compressed stream.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.enc.Reset(io.Discard)
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+	return err
+}
+
+// Hijack hands the connection over, e.g. for WebSockets; nothing may
+// have been written yet.
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.decided = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
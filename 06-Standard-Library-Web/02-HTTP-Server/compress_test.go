@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"br", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, deflate;q=0.5", "deflate"},
+		{"GZIP", "gzip"},
+		{"gzip;q=bad", ""},
+	}
+	for _, tt := range tests {
+		if got := acceptedEncoding(tt.header); got != tt.want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// compressed serves h through compressMiddleware with the given
+// Accept-Encoding.
+func compressed(h http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	compressMiddleware(compressMinSize)(h).ServeHTTP(w, req)
+	return w
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	if err != nil {
+		t.Fatalf("Failed to open %s body: %v", encoding, err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read %s body: %v", encoding, err)
+	}
+	return string(b)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"name":"Alice","email":"alice@example.com"}`, 100)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantEncoding   string
+	}{
+		{"gzip", "gzip, deflate", "application/json", large, "gzip"},
+		{"deflate", "deflate", "application/json", large, "deflate"},
+		{"not accepted", "", "application/json", large, ""},
+		{"tiny body", "gzip", "application/json", `{"id":1}`, ""},
+		{"already compressed", "gzip", "image/png", large, ""},
+		{"svg", "gzip", "image/svg+xml", large, "gzip"},
+		{"sniffed type", "gzip", "", large, "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := compressed(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.Header().Set("Content-Length", "999")
+				w.WriteHeader(http.StatusCreated)
+				// Several small writes must still add up to one decision
+				for rest := tt.body; rest != ""; {
+					n := min(len(rest), 100)
+					io.WriteString(w, rest[:n])
+					rest = rest[n:]
+				}
+			}, tt.acceptEncoding)
+
+			if w.Code != http.StatusCreated {
+				t.Errorf("Expected 201, got %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Expected Content-Encoding %q, got %q", tt.wantEncoding, got)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Expected Vary: Accept-Encoding, got %q", got)
+			}
+			if tt.wantEncoding != "" && w.Header().Get("Content-Length") != "" {
+				t.Error("Content-Length of the uncompressed body was kept")
+			}
+			if tt.contentType == "" && w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+				t.Errorf("Expected sniffed Content-Type, got %q", w.Header().Get("Content-Type"))
+			}
+			if got := decompress(t, tt.wantEncoding, w.Body.Bytes()); got != tt.body {
+				t.Errorf("Body mismatch: got %d bytes, want %d", len(got), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompressSkipsEncodedAndEmpty(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 4*compressMinSize)
+
+	w := compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(large)
+	}, "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "br" || !bytes.Equal(w.Body.Bytes(), large) {
+		t.Errorf("Pre-encoded body was touched: Content-Encoding %q", got)
+	}
+
+	w = compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusNotModified)
+	}, "gzip")
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected bare 304, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("ETag") != `"abc"` {
+		t.Error("ETag was not passed through")
+	}
+}
+
+// TestCompressETag checks each encoding of a body gets its own strong
+// ETag, and a 304 hands back the tag the client revalidated with.
+func TestCompressETag(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 4*compressMinSize)
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Write(large)
+	}
+
+	identity := compressed(h, "").Header().Get("ETag")
+	gzipped := compressed(h, "gzip").Header().Get("ETag")
+	deflated := compressed(h, "deflate").Header().Get("ETag")
+	if identity != `"abc"` {
+		t.Errorf("Identity ETag = %s, want \"abc\"", identity)
+	}
+	if gzipped == identity || deflated == identity || gzipped == deflated {
+		t.Errorf("Expected distinct ETags, got identity %s, gzip %s, deflate %s", identity, gzipped, deflated)
+	}
+	if !matchETag(gzipped, identity, false) {
+		t.Errorf("Gzip ETag %s does not match identity %s", gzipped, identity)
+	}
+
+	small := compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Write([]byte("a"))
+	}, "gzip")
+	if got := small.Header().Get("ETag"); got != `"abc"` {
+		t.Errorf("Uncompressed body ETag = %s, want \"abc\"", got)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", gzipped)
+	w := httptest.NewRecorder()
+	compressMiddleware(compressMinSize)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusNotModified)
+	})).ServeHTTP(w, req)
+	if got := w.Header().Get("ETag"); got != gzipped {
+		t.Errorf("304 ETag = %s, want %s", got, gzipped)
+	}
+}
+
+// TestCompressStreams checks each flushed chunk reaches the client
+// decodable before the handler returns.
+func TestCompressStreams(t *testing.T) {
+	chunks := make(chan string)
+	next := make(chan struct{})
+	srv := httptest.NewServer(compressMiddleware(compressMinSize)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", mediaNDJSON)
+			for chunk := range chunks {
+				io.WriteString(w, chunk)
+				w.(http.Flusher).Flush()
+				next <- struct{}{}
+			}
+		})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		done <- resp
+	}()
+
+	chunks <- "{\"id\":1}\n"
+	<-next
+	resp := <-done
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Expected gzip stream, got Content-Encoding %q", got)
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := make([]byte, 9)
+	if _, err := io.ReadFull(zr, line); err != nil || string(line) != "{\"id\":1}\n" {
+		t.Fatalf("First chunk not readable before the stream ended: %q, %v", line, err)
+	}
+
+	chunks <- "{\"id\":2}\n"
+	<-next
+	close(chunks)
+	rest, err := io.ReadAll(zr)
+	if err != nil || string(rest) != "{\"id\":2}\n" {
+		t.Errorf("Unexpected rest of stream: %q, %v", rest, err)
+	}
+}
+
+func TestCompressUserList(t *testing.T) {
+	users := make([]User, 100)
+	for i := range users {
+		users[i] = User{ID: i + 1, Name: "User", Email: fmt.Sprintf("user%d@example.com", i+1)}
+	}
+	s := newQuietServer(NewMemoryUserStore(users...))
+
+	w := serveWith(s, http.Header{"Accept-Encoding": {"gzip"}}, "GET", "/users?limit=100", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzipped 200, got %d with %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if got := decodeUsers(t, decompress(t, "gzip", w.Body.Bytes())); len(got) != 100 {
+		t.Errorf("Expected 100 users, got %d", len(got))
+	}
+}
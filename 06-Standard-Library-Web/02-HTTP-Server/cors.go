@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig controls which browser origins may call the API.
+//
+// AllowedOrigins entries are exact origins ("https://app.example.com"),
+// "*" for any origin, or a pattern with a single "*" standing for one or
+// more host labels ("https://*.example.com", "http://localhost:*").
+type corsConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration // how long browsers may cache a preflight
+}
+
+// defaultCORS allows the usual local front-end dev servers. Credentials
+// stay off: the API authenticates with bearer tokens, not cookies.
+func defaultCORS() corsConfig {
+	return corsConfig{
+		AllowedOrigins: []string{"http://localhost:3000", "http://localhost:5173"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{
+			"Authorization", "Content-Type", "If-Match", "If-None-Match",
+			idempotencyHeader, requestIDHeader,
+		},
+		ExposedHeaders: []string{
+			"ETag", "Location", "Link", "X-Total-Count", "Retry-After",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+			replayedHeader, requestIDHeader,
+		},
+		MaxAge: 10 * time.Minute,
+	}
+}
+
+// corsFromEnv starts from defaultCORS and lets CORS_ORIGINS
+// (comma-separated) replace the allowed origins.
+func corsFromEnv() corsConfig {
+	cfg := defaultCORS()
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		cfg.AllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+			}
+		}
+	}
+	return cfg
+}
+
+// Middleware: CORS
+// corsMiddleware answers preflight requests itself and adds the
+// Access-Control-* headers to actual requests from allowed origins.
+// Requests without an Origin header (curl, server-to-server) pass through
+// unchanged; CORS is only enforced by browsers.
+func corsMiddleware(cfg corsConfig) Middleware {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// The answer depends on Origin, so caches must key on it
+			h := w.Header()
+			h.Add("Vary", "Origin")
+
+			preflight := r.Method == http.MethodOptions &&
+				r.Header.Get("Access-Control-Request-Method") != ""
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			if !cfg.originAllowed(origin) {
+				if preflight {
+					writeError(w, http.StatusForbidden, "origin "+origin+" is not allowed")
+					return
+				}
+				// Without Allow-Origin the browser hides the response
+				next.ServeHTTP(w, r)
+				return
+			}
+			cfg.allowOrigin(h, origin)
+
+			if !preflight {
+				if exposed != "" {
+					h.Set("Access-Control-Expose-Headers", exposed)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			method := r.Header.Get("Access-Control-Request-Method")
+			if !slices.Contains(cfg.AllowedMethods, method) {
+				writeError(w, http.StatusForbidden, "method "+method+" is not allowed")
+				return
+			}
+			requested := requestedHeaders(r.Header.Get("Access-Control-Request-Headers"))
+			for _, name := range requested {
+				if !slices.ContainsFunc(cfg.AllowedHeaders, func(allowed string) bool {
+					return strings.EqualFold(allowed, name)
+				}) {
+					writeError(w, http.StatusForbidden, "header "+name+" is not allowed")
+					return
+				}
+			}
+
+			h.Set("Access-Control-Allow-Methods", methods)
+			if len(requested) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+			}
+			if cfg.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// allowOrigin sets Allow-Origin and, if enabled, Allow-Credentials.
+// Browsers reject "*" on credentialed requests, so the origin is echoed
+// instead whenever credentials are allowed or the match was a pattern.
+func (cfg corsConfig) allowOrigin(h http.Header, origin string) {
+	if slices.Contains(cfg.AllowedOrigins, "*") && !cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (cfg corsConfig) originAllowed(origin string) bool {
+	for _, allowed := range cfg.AllowedOrigins {
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin reports whether origin matches pattern. Origins are compared
+// case-insensitively; a "*" in the pattern matches one or more characters
+// that can't include "/" (so it never spans scheme or path).
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == origin
+	}
+	if len(origin) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	return !strings.Contains(origin[len(prefix):len(origin)-len(suffix)], "/")
+}
+
+// requestedHeaders splits Access-Control-Request-Headers into names.
+func requestedHeaders(header string) []string {
+	var names []string
+	for _, name := range strings.Split(header, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "HTTPS://App.Example.com", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"*", "https://anything.test", true},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://app.example.com.evil.com", false},
+		{"http://localhost:*", "http://localhost:5173", true},
+		{"http://localhost:*", "http://localhost", false},
+	}
+	for _, tt := range tests {
+		if got := matchOrigin(tt.pattern, tt.origin); got != tt.want {
+			t.Errorf("matchOrigin(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+		}
+	}
+}
+
+// corsRequest sends a request with the given headers through corsMiddleware
+// and reports whether the wrapped handler ran.
+func corsRequest(cfg corsConfig, method string, header http.Header) (*httptest.ResponseRecorder, bool) {
+	called := false
+	h := corsMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequest(method, "/users", nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w, called
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cfg := defaultCORS()
+	cfg.AllowedOrigins = []string{"https://*.example.com"}
+
+	w, called := corsRequest(cfg, "OPTIONS", http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {"PATCH"},
+		"Access-Control-Request-Headers": {"authorization, if-match"},
+	})
+	if called {
+		t.Error("Preflight reached the handler")
+	}
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", w.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE",
+		"Access-Control-Allow-Headers": "authorization, if-match",
+		"Access-Control-Max-Age":       "600",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("Credentials allowed without AllowCredentials")
+	}
+	if !slices.Contains(w.Header().Values("Vary"), "Origin") {
+		t.Errorf("Expected Vary: Origin, got %q", w.Header().Values("Vary"))
+	}
+}
+
+func TestCORSPreflightRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"origin", http.Header{
+			"Origin":                        {"https://evil.test"},
+			"Access-Control-Request-Method": {"GET"},
+		}},
+		{"method", http.Header{
+			"Origin":                        {"http://localhost:3000"},
+			"Access-Control-Request-Method": {"TRACE"},
+		}},
+		{"header", http.Header{
+			"Origin":                         {"http://localhost:3000"},
+			"Access-Control-Request-Method":  {"GET"},
+			"Access-Control-Request-Headers": {"X-Secret"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, called := corsRequest(defaultCORS(), "OPTIONS", tt.header)
+			if called || w.Code != http.StatusForbidden {
+				t.Errorf("Expected 403 without calling the handler, got %d (called %v)", w.Code, called)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("Expected problem+json, got %q", got)
+			}
+			if tt.name != "origin" && w.Header().Get("Access-Control-Allow-Origin") == "" {
+				t.Error("Rejection for an allowed origin is unreadable by the browser")
+			}
+		})
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         func(*corsConfig)
+		origin      string
+		wantOrigin  string
+		credentials bool
+	}{
+		{"listed origin", nil, "http://localhost:3000", "http://localhost:3000", false},
+		{"unlisted origin", nil, "https://evil.test", "", false},
+		{"any origin", func(c *corsConfig) { c.AllowedOrigins = []string{"*"} }, "https://a.test", "*", false},
+		{"any origin with credentials", func(c *corsConfig) {
+			c.AllowedOrigins = []string{"*"}
+			c.AllowCredentials = true
+		}, "https://a.test", "https://a.test", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultCORS()
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			w, called := corsRequest(cfg, "GET", http.Header{"Origin": {tt.origin}})
+			if !called || w.Code != http.StatusOK {
+				t.Fatalf("Expected the handler to answer, got %d (called %v)", w.Code, called)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Expected Allow-Origin %q, got %q", tt.wantOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+				t.Errorf("Expected Allow-Credentials %v, got %v", tt.credentials, got)
+			}
+			if tt.wantOrigin != "" && w.Header().Get("Access-Control-Expose-Headers") == "" {
+				t.Error("Missing Access-Control-Expose-Headers")
+			}
+		})
+	}
+}
+
+func TestCORSWithoutOrigin(t *testing.T) {
+	w, called := corsRequest(defaultCORS(), "OPTIONS", nil)
+	if !called {
+		t.Error("Plain OPTIONS request did not reach the handler")
+	}
+	for name := range w.Header() {
+		if name == "Vary" || strings.HasPrefix(name, "Access-Control-") {
+			t.Errorf("Unexpected header %s on a request without Origin", name)
+		}
+	}
+}
+
+func TestCORSFromEnv(t *testing.T) {
+	t.Setenv("CORS_ORIGINS", " https://a.test, https://*.b.test ,")
+	cfg := corsFromEnv()
+	if !slices.Equal(cfg.AllowedOrigins, []string{"https://a.test", "https://*.b.test"}) {
+		t.Errorf("Unexpected origins: %q", cfg.AllowedOrigins)
+	}
+	if cfg.MaxAge != 10*time.Minute {
+		t.Errorf("Expected default max-age, got %s", cfg.MaxAge)
+	}
+}
+
+// TestCORSServer checks the browser can read responses from the full
+// stack, including the preflight for a conditional delete.
+func TestCORSServer(t *testing.T) {
+	s, _ := newTestServer()
+	origin := http.Header{"Origin": {"http://localhost:5173"}}
+
+	w := serveWith(s, origin, "GET", "/users/1", "")
+	if w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:5173" {
+		t.Errorf("Missing Allow-Origin on GET, headers: %v", w.Header())
+	}
+
+	w = serveWith(s, http.Header{
+		"Origin":                         {"http://localhost:5173"},
+		"Access-Control-Request-Method":  {"DELETE"},
+		"Access-Control-Request-Headers": {"Authorization, If-Match"},
+	}, "OPTIONS", "/users/1", "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected preflight 204, got %d: %s", w.Code, w.Body)
+	}
+}
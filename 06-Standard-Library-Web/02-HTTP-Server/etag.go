@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// etag returns a strong entity tag for the user's current representation.
+// The version is part of the hash, so a user that is renamed and then
+// renamed back still gets a new tag and stale clients can't win an
+// A -> B -> A race.
+func etag(u User) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%d", u.ID, u.Name, u.Email, u.Version)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagFor returns the tag of the user rendered as mediaType. A strong
+// ETag promises byte-identical bodies, so the XML, CSV and NDJSON
+// renderings each get their own suffix; JSON keeps the plain tag.
+func etagFor(u User, mediaType string) string {
+	tag := etag(u)
+	if mediaType == mediaJSON {
+		return tag
+	}
+	_, sub, _ := strings.Cut(mediaType, "/")
+	return strings.TrimSuffix(tag, `"`) + "-" + sub + `"`
+}
+
+// encodedETag returns tag for a body sent with a content coding. The
+// gzip bytes differ from the identity bytes, so a strong tag can't be
+// shared between them (RFC 9110 §8.8.3); like etagFor, the coding goes
+// into a suffix.
+func encodedETag(tag, coding string) string {
+	if !strings.HasSuffix(tag, `"`) {
+		return tag
+	}
+	return strings.TrimSuffix(tag, `"`) + "-" + coding + `"`
+}
+
+// decodedETag strips a content-coding suffix added by encodedETag.
+func decodedETag(tag string) string {
+	for coding := range encoderPools {
+		if suffix := "-" + coding + `"`; strings.HasSuffix(tag, suffix) {
+			return strings.TrimSuffix(tag, suffix) + `"`
+		}
+	}
+	return tag
+}
+
+// matchETag reports whether tag appears in an If-Match or If-None-Match
+// header value. "*" matches any tag, and a tag the client saw on a
+// compressed body matches the tag it was derived from. With weak set, W/ prefixes are
+// ignored (the weak comparison RFC 9110 uses for If-None-Match);
+// otherwise weak tags never match (the strong comparison for If-Match).
+func matchETag(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[len("W/"):]
+		}
+		if bare := strings.TrimPrefix(tag, "W/"); candidate == bare || decodedETag(candidate) == bare {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified handles If-None-Match for a GET: when the client already
+// has the current representation it writes 304 and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || !matchETag(inm, tag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch enforces optimistic concurrency on writes. Clients must
+// send the ETag they last saw in If-Match, taken from any representation
+// of the user: a missing header is answered with 428 and a stale one with
+// 412, carrying the current tag for mediaType. On failure the response
+// has been written and false is returned.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current User, mediaType string) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		writeError(w, http.StatusPreconditionRequired, "If-Match header is required; fetch the user first and send its ETag")
+		return false
+	}
+
+	matched := false
+	for _, mt := range userMediaTypes {
+		matched = matched || matchETag(im, etagFor(current, mt), false)
+	}
+	if !matched {
+		w.Header().Set("ETag", etagFor(current, mediaType))
+		writeError(w, http.StatusPreconditionFailed, "user has been modified; fetch it again and retry")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		header string
+		tag    string
+		weak   bool
+		want   bool
+	}{
+		{`"abc"`, `"abc"`, false, true},
+		{`"abc"`, `"xyz"`, false, false},
+		{`"xyz", "abc"`, `"abc"`, false, true},
+		{`*`, `"abc"`, false, true},
+		{`W/"abc"`, `"abc"`, false, false},
+		{`W/"abc"`, `"abc"`, true, true},
+		{`"abc"`, `W/"abc"`, true, true},
+		{`abc`, `"abc"`, true, false},
+		{`"abc-gzip"`, `"abc"`, false, true},
+		{`W/"abc-deflate"`, `"abc"`, true, true},
+		{`"abc-gzip"`, `"abd"`, false, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchETag(tt.header, tt.tag, tt.weak); got != tt.want {
+			t.Errorf("matchETag(%q, %q, %v) = %v, want %v", tt.header, tt.tag, tt.weak, got, tt.want)
+		}
+	}
+}
+
+func TestETagChangesWithVersion(t *testing.T) {
+	u := User{ID: 1, Name: "Alice", Email: "alice@example.com", Version: 1}
+	same := u
+	if etag(u) != etag(same) {
+		t.Error("Expected equal users to share an ETag")
+	}
+
+	// Same content, newer version: A -> B -> A must not reuse the old tag
+	same.Version = 3
+	if etag(u) == etag(same) {
+		t.Error("Expected ETag to change with version")
+	}
+}
+
+func TestGetUserConditional(t *testing.T) {
+	s, store := newTestServer()
+	w := serve(s, "GET", "/users/1", "")
+
+	tag := w.Header().Get("ETag")
+	if tag != etag(mustGet(t, store, 1)) {
+		t.Fatalf("Expected ETag %s, got %q", etag(mustGet(t, store, 1)), tag)
+	}
+
+	for _, inm := range []string{tag, "W/" + tag, `"other", ` + tag, "*"} {
+		w = serveWith(s, http.Header{"If-None-Match": {inm}}, "GET", "/users/1", "")
+		if w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: expected 304, got %d", inm, w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: expected empty body, got %q", inm, w.Body)
+		}
+		if w.Header().Get("ETag") != tag {
+			t.Errorf("If-None-Match %s: expected ETag on 304", inm)
+		}
+	}
+
+	w = serveWith(s, http.Header{"If-None-Match": {`"stale"`}}, "GET", "/users/1", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for stale If-None-Match, got %d", w.Code)
+	}
+}
+
+func TestCreateUserETag(t *testing.T) {
+	s, store := newTestServer()
+	w := serve(s, "POST", "/users", `{"name":"Carol","email":"carol@example.com"}`)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+	if got := w.Header().Get("ETag"); got != etag(mustGet(t, store, 3)) {
+		t.Errorf("Unexpected ETag %q", got)
+	}
+}
+
+func TestWritesRequireIfMatch(t *testing.T) {
+	s, store := newTestServer()
+	admin := bearer(t, s, "admin")
+
+	tests := []struct {
+		method string
+		body   string
+	}{
+		{"PUT", `{"name":"Alicia","email":"alicia@example.com"}`},
+		{"PATCH", `{"name":"Alicia"}`},
+		{"DELETE", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			w := serveAs(s, admin, tt.method, "/users/1", tt.body)
+			if w.Code != http.StatusPreconditionRequired {
+				t.Errorf("Expected 428 without If-Match, got %d", w.Code)
+			}
+			decodeProblem(t, w)
+
+			header := http.Header{"Authorization": {admin}, "If-Match": {`"stale"`}}
+			w = serveWith(s, header, tt.method, "/users/1", tt.body)
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("Expected 412 for stale If-Match, got %d", w.Code)
+			}
+			if w.Header().Get("ETag") != etag(mustGet(t, store, 1)) {
+				t.Error("Expected current ETag on 412")
+			}
+			decodeProblem(t, w)
+
+			if got := mustGet(t, store, 1); got.Name != "Alice" {
+				t.Errorf("Failed precondition must not write, got %+v", got)
+			}
+		})
+	}
+}
+
+// TestIfMatchCompressedETag checks the tag from a gzipped response is
+// good for If-Match.
+func TestIfMatchCompressedETag(t *testing.T) {
+	s, store := newTestServer()
+	admin := bearer(t, s, "admin")
+
+	tag := encodedETag(etag(mustGet(t, store, 1)), "gzip")
+	header := http.Header{"Authorization": {admin}, "If-Match": {tag}}
+	w := serveWith(s, header, "PATCH", "/users/1", `{"name":"Alicia"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for gzip ETag, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := mustGet(t, store, 1); got.Name != "Alicia" {
+		t.Errorf("Expected update, got %+v", got)
+	}
+}
+
+func TestIfMatchWildcard(t *testing.T) {
+	s, store := newTestServer()
+	w := serveWith(s, http.Header{"If-Match": {"*"}}, "PATCH", "/users/2", `{"name":"Robert"}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got := mustGet(t, store, 2); got.Name != "Robert" {
+		t.Errorf("Expected patched name, got %+v", got)
+	}
+
+	// "*" still requires the user to exist
+	w = serveWith(s, http.Header{"If-Match": {"*"}}, "PATCH", "/users/42", `{"name":"Nobody"}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+// TestLostUpdate replays the classic race: two clients read the same
+// user, both edit it, and only the first write may succeed.
+func TestLostUpdate(t *testing.T) {
+	s, store := newTestServer()
+	tag := serve(s, "GET", "/users/1", "").Header().Get("ETag")
+	header := http.Header{"If-Match": {tag}}
+
+	first := serveWith(s, header, "PATCH", "/users/1", `{"name":"First"}`)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected first write to succeed, got %d", first.Code)
+	}
+	if first.Header().Get("ETag") == tag {
+		t.Error("Expected a new ETag after the write")
+	}
+
+	second := serveWith(s, header, "PATCH", "/users/1", `{"name":"Second"}`)
+	if second.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected second write to fail with 412, got %d", second.Code)
+	}
+	if got := mustGet(t, store, 1); got.Name != "First" {
+		t.Errorf("Expected first write to survive, got %+v", got)
+	}
+
+	// Retrying with the fresh ETag works
+	header.Set("If-Match", second.Header().Get("ETag"))
+	if w := serveWith(s, header, "PATCH", "/users/1", `{"name":"Second"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected retry to succeed, got %d", w.Code)
+	}
+}
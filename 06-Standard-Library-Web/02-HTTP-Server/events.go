@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// eventLogSize is how many past events a reconnecting client can resume from.
+	eventLogSize = 1000
+	// eventBuffer is how many events a subscriber may fall behind before
+	// it is disconnected as a slow consumer.
+	eventBuffer = 64
+	// sseHeartbeat is how often an idle stream gets a comment line, so
+	// proxies don't time it out and dead clients are noticed.
+	sseHeartbeat = 15 * time.Second
+	// sseWriteTimeout bounds each write to a stream; a client that stops
+	// reading is disconnected once its TCP buffers fill up.
+	sseWriteTimeout = 10 * time.Second
+	// sseRetry tells EventSource clients how long to wait before reconnecting.
+	sseRetry = 3 * time.Second
+)
+
+// Event types sent on GET /users/events.
+const (
+	eventUserCreated = "user.created"
+	eventUserUpdated = "user.updated"
+	eventUserDeleted = "user.deleted"
+	// eventReset tells a client its Last-Event-ID is no longer in the log,
+	// so it must reload /users instead of relying on the stream.
+	eventReset = "reset"
+)
+
+// userEvent is one change to a user, already encoded for the wire.
+type userEvent struct {
+	ID   uint64
+	Type string
+	Data []byte // JSON
+}
+
+// eventBroker keeps a bounded log of recent events and fans new ones out
+// to subscribers. Publish never blocks: a subscriber whose buffer is full
+// is dropped and resumes from the log when it reconnects.
+type eventBroker struct {
+	mu      sync.Mutex
+	log     []userEvent // oldest first, at most size entries
+	size    int
+	buffer  int
+	lastID  uint64
+	subs    map[*subscriber]struct{}
+	closed  bool
+	dropped uint64 // slow consumers disconnected so far
+}
+
+// subscriber receives events on ch; ch is closed when the subscriber is
+// dropped or the broker shuts down.
+type subscriber struct {
+	ch      chan userEvent
+	dropped bool // closed for being too slow, not by shutdown
+}
+
+func newEventBroker(size, buffer int) *eventBroker {
+	return &eventBroker{size: size, buffer: buffer, subs: map[*subscriber]struct{}{}}
+}
+
+// Publish appends an event to the log and sends it to every subscriber.
+func (b *eventBroker) Publish(eventType string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		// Only our own User values are published; this can't happen
+		panic(fmt.Sprintf("events: encode %s: %v", eventType, err))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.lastID++
+	ev := userEvent{ID: b.lastID, Type: eventType, Data: data}
+	if len(b.log) == b.size {
+		copy(b.log, b.log[1:])
+		b.log = b.log[:b.size-1]
+	}
+	b.log = append(b.log, ev)
+
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped = true
+			b.remove(sub)
+			b.dropped++
+		}
+	}
+}
+
+// Subscribe registers a subscriber. With resume set, the events logged
+// after ID after are returned as backlog; ok is false if some of them have
+// already left the log (or after is from an earlier server run). lastID
+// is the newest event ID at the moment of subscribing, for a reset event
+// to carry. The backlog, lastID and the subscription are taken under one
+// lock, so nothing is missed or sent twice. It returns nil once the
+// broker is closed.
+func (b *eventBroker) Subscribe(after uint64, resume bool) (sub *subscriber, backlog []userEvent, lastID uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, 0, false
+	}
+
+	ok = true
+	if resume {
+		oldest := b.lastID + 1
+		if len(b.log) > 0 {
+			oldest = b.log[0].ID
+		}
+		if after > b.lastID || after+1 < oldest {
+			ok = false
+		} else {
+			backlog = append(backlog, b.log[len(b.log)-int(b.lastID-after):]...)
+		}
+	}
+
+	sub = &subscriber{ch: make(chan userEvent, b.buffer)}
+	b.subs[sub] = struct{}{}
+	return sub, backlog, b.lastID, ok
+}
+
+// Unsubscribe removes sub; it is safe to call more than once.
+func (b *eventBroker) Unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+// remove closes sub's channel. The caller must hold b.mu.
+func (b *eventBroker) remove(sub *subscriber) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Close ends every stream, e.g. on server shutdown, so open SSE
+// connections don't hold up the drain.
+func (b *eventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		b.remove(sub)
+	}
+}
+
+// Stats reports the current subscriber count and slow consumers dropped.
+func (b *eventBroker) Stats() (subscribers int, dropped uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs), b.dropped
+}
+
+// publishingStore decorates a UserStore with change events, so every
+// write path (single requests, CSV bulk creates) is covered.
+type publishingStore struct {
+	UserStore
+	events *eventBroker
+}
+
+func (s publishingStore) Create(ctx context.Context, user User) (User, error) {
+	created, err := s.UserStore.Create(ctx, user)
+	if err == nil {
+		s.events.Publish(eventUserCreated, created)
+	}
+	return created, err
+}
+
+func (s publishingStore) Update(ctx context.Context, user User) (User, error) {
+	updated, err := s.UserStore.Update(ctx, user)
+	if err == nil {
+		s.events.Publish(eventUserUpdated, updated)
+	}
+	return updated, err
+}
+
+func (s publishingStore) Delete(ctx context.Context, id, version int) error {
+	err := s.UserStore.Delete(ctx, id, version)
+	if err == nil {
+		s.events.Publish(eventUserDeleted, map[string]int{"id": id})
+	}
+	return err
+}
+
+// Begin wraps the transaction so its users are published once it commits.
+func (s publishingStore) Begin(ctx context.Context) (UserTx, error) {
+	tx, err := s.UserStore.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &publishingTx{UserTx: tx, events: s.events}, nil
+}
+
+// publishingTx holds back events until Commit: nobody should hear about
+// users that a rollback throws away.
+type publishingTx struct {
+	UserTx
+	events  *eventBroker
+	created []User
+}
+
+func (tx *publishingTx) Create(ctx context.Context, user User) (User, error) {
+	created, err := tx.UserTx.Create(ctx, user)
+	if err == nil {
+		tx.created = append(tx.created, created)
+	}
+	return created, err
+}
+
+func (tx *publishingTx) Commit() error {
+	err := tx.UserTx.Commit()
+	if err == nil {
+		for _, u := range tx.created {
+			tx.events.Publish(eventUserCreated, u)
+		}
+	}
+	tx.created = nil
+	return err
+}
+
+// eventsParams documents the resume header for the OpenAPI document.
+type eventsParams struct {
+	LastEventID string `header:"Last-Event-ID" doc:"ID of the last event received; the stream resumes after it"`
+}
+
+// Handle GET /users/events
+// Streams user changes as Server-Sent Events until the client goes away
+// or the server shuts down. Browsers reconnect on their own and send
+// Last-Event-ID, which resumes from the event log when it is recent enough.
+// New clients, and those too far behind, get a "reset" event first: load
+// /users, then apply the events that follow.
+func (s *server) handleUserEvents(w http.ResponseWriter, r *http.Request) {
+	if _, ok := negotiate(r.Header.Get("Accept"), []string{mediaEventStream}); !ok {
+		w.Header().Set("Vary", "Accept")
+		writeError(w, http.StatusNotAcceptable, "this endpoint only serves "+mediaEventStream)
+		return
+	}
+
+	var after uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			// Treat it like an unknown ID: the client can't resume
+			id = ^uint64(0)
+		}
+		after = id
+	}
+
+	sub, backlog, lastID, ok := s.events.Subscribe(after, lastEventID != "")
+	if sub == nil {
+		writeError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	defer s.events.Unsubscribe(sub)
+	resumed := ok && lastEventID != ""
+
+	// Streams outlive the server's WriteTimeout; each write below sets its
+	// own deadline instead
+	rc := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", mediaEventStream)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // nginx would otherwise buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	send := func(write func() error) bool {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		if err := write(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	ok = send(func() error {
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+		if err == nil && !resumed {
+			// lastID, not the broker's current one: an event published
+			// since Subscribe is already on sub.ch and must not be skipped
+			// by a client resuming from the reset
+			err = writeEvent(w, userEvent{ID: lastID, Type: eventReset, Data: []byte("{}")})
+		}
+		for _, ev := range backlog {
+			if err != nil {
+				break
+			}
+			err = writeEvent(w, ev)
+		}
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	heartbeat := time.NewTicker(s.sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, open := <-sub.ch:
+			if !open {
+				if sub.dropped {
+					s.logger.Warn("sse slow consumer dropped",
+						"request_id", requestIDFrom(r.Context()), "remote_addr", r.RemoteAddr)
+				}
+				return
+			}
+			if !send(func() error { return writeEvent(w, ev) }) {
+				return
+			}
+		case <-heartbeat.C:
+			if !send(func() error {
+				_, err := fmt.Fprint(w, ": heartbeat\n\n")
+				return err
+			}) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes ev in the text/event-stream format. Data is JSON
+// without newlines, so it fits on one data line.
+func writeEvent(w http.ResponseWriter, ev userEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one parsed event from a text/event-stream body.
+type sseEvent struct {
+	ID, Type, Data string
+}
+
+// openEvents starts GET /users/events on a real listener and returns a
+// reader for its body. Recorders can't be used: the handler only
+// returns when the client disconnects.
+func openEvents(t *testing.T, s *server, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/users/events", nil)
+	req.Header.Set("Accept", mediaEventStream)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+// nextEvent reads up to the next event, skipping comments and the
+// retry field.
+func nextEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if ev.Type != "" {
+				return ev
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Type = value
+		case "data":
+			ev.Data = value
+		}
+	}
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	b := newEventBroker(3, 8)
+	for i := 0; i < 5; i++ {
+		b.Publish(eventUserCreated, i)
+	}
+
+	tests := []struct {
+		after   uint64
+		wantOK  bool
+		wantIDs []uint64
+	}{
+		{after: 2, wantOK: true, wantIDs: []uint64{3, 4, 5}},
+		{after: 4, wantOK: true, wantIDs: []uint64{5}},
+		{after: 5, wantOK: true},
+		{after: 1, wantOK: false}, // event 2 has left the log
+		{after: 9, wantOK: false}, // from an earlier server run
+	}
+	for _, tt := range tests {
+		sub, backlog, lastID, ok := b.Subscribe(tt.after, true)
+		b.Unsubscribe(sub)
+		if lastID != 5 {
+			t.Errorf("after %d: expected last ID 5, got %d", tt.after, lastID)
+		}
+		if ok != tt.wantOK {
+			t.Errorf("after %d: expected ok %v, got %v", tt.after, tt.wantOK, ok)
+		}
+		var ids []uint64
+		for _, ev := range backlog {
+			ids = append(ids, ev.ID)
+		}
+		if len(ids) != len(tt.wantIDs) {
+			t.Errorf("after %d: expected backlog %v, got %v", tt.after, tt.wantIDs, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.wantIDs[i] {
+				t.Errorf("after %d: expected backlog %v, got %v", tt.after, tt.wantIDs, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestEventBrokerDropsSlowConsumer(t *testing.T) {
+	b := newEventBroker(10, 2)
+	slow, _, _, _ := b.Subscribe(0, false)
+	fast, _, _, _ := b.Subscribe(0, false)
+
+	for i := 0; i < 3; i++ {
+		b.Publish(eventUserUpdated, i)
+		<-fast.ch
+	}
+
+	// The buffered events are still delivered before the channel closes
+	for i := 0; i < 2; i++ {
+		if _, open := <-slow.ch; !open {
+			t.Fatalf("Expected buffered event %d before close", i)
+		}
+	}
+	if _, open := <-slow.ch; open || !slow.dropped {
+		t.Error("Expected slow subscriber to be dropped")
+	}
+	if n, dropped := b.Stats(); n != 1 || dropped != 1 {
+		t.Errorf("Expected 1 subscriber and 1 dropped, got %d and %d", n, dropped)
+	}
+}
+
+func TestEventBrokerClose(t *testing.T) {
+	b := newEventBroker(10, 2)
+	sub, _, _, _ := b.Subscribe(0, false)
+	b.Close()
+
+	if _, open := <-sub.ch; open || sub.dropped {
+		t.Error("Expected channel closed by shutdown")
+	}
+	if sub, _, _, _ := b.Subscribe(0, false); sub != nil {
+		t.Error("Expected no subscriptions after Close")
+	}
+	b.Publish(eventUserCreated, 1) // must not panic on a closed broker
+}
+
+func TestUserEventsStream(t *testing.T) {
+	s, _ := newTestServer()
+	resp, r := openEvents(t, s, "")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != mediaEventStream {
+		t.Errorf("Expected Content-Type %s, got %q", mediaEventStream, ct)
+	}
+	if ev := nextEvent(t, r); ev.Type != eventReset {
+		t.Errorf("Expected a reset event first, got %+v", ev)
+	}
+
+	admin := bearer(t, s, "admin")
+	serve(s, "POST", "/users", `{"name":"Carol","email":"carol@example.com"}`)
+	serveWith(s, http.Header{"If-Match": {"*"}, "Authorization": {admin}}, "PATCH", "/users/3", `{"name":"Caroline"}`)
+	serveWith(s, http.Header{"If-Match": {"*"}, "Authorization": {admin}}, "DELETE", "/users/3", "")
+
+	want := []struct{ typ, data string }{
+		{eventUserCreated, `"name":"Carol"`},
+		{eventUserUpdated, `"name":"Caroline"`},
+		{eventUserDeleted, `{"id":3}`},
+	}
+	for i, w := range want {
+		ev := nextEvent(t, r)
+		if ev.Type != w.typ || !strings.Contains(ev.Data, w.data) {
+			t.Errorf("Event %d: expected %s with %s, got %+v", i, w.typ, w.data, ev)
+		}
+		if ev.ID != strconv.Itoa(i+1) {
+			t.Errorf("Event %d: expected id %d, got %q", i, i+1, ev.ID)
+		}
+	}
+}
+
+func TestUserEventsResume(t *testing.T) {
+	s, _ := newTestServer()
+	serve(s, "POST", "/users", `{"name":"Carol","email":"carol@example.com"}`)
+	serve(s, "POST", "/users", `{"name":"Dave","email":"dave@example.com"}`)
+
+	_, r := openEvents(t, s, "1")
+	if ev := nextEvent(t, r); ev.ID != "2" || !strings.Contains(ev.Data, "Dave") {
+		t.Errorf("Expected to resume with event 2, got %+v", ev)
+	}
+
+	_, r = openEvents(t, s, "not-a-number")
+	if ev := nextEvent(t, r); ev.Type != eventReset || ev.ID != "2" {
+		t.Errorf("Expected reset carrying id 2, got %+v", ev)
+	}
+}
+
+func TestUserEventsHeartbeat(t *testing.T) {
+	s, _ := newTestServer()
+	s.sseHeartbeat = 10 * time.Millisecond
+	_, r := openEvents(t, s, "")
+	nextEvent(t, r) // reset
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ": heartbeat\n" {
+			return
+		}
+	}
+}
+
+func TestUserEventsDisconnect(t *testing.T) {
+	s, _ := newTestServer()
+	resp, r := openEvents(t, s, "")
+	nextEvent(t, r)
+	waitFor(t, func() bool { n, _ := s.events.Stats(); return n == 1 })
+
+	resp.Body.Close()
+	waitFor(t, func() bool { n, _ := s.events.Stats(); return n == 0 })
+}
+
+func TestUserEventsNotAcceptable(t *testing.T) {
+	s, _ := newTestServer()
+	w := serveWith(s, http.Header{"Accept": {mediaJSON}}, "GET", "/users/events", "")
+
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected status 406, got %d", w.Code)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// userList is the XML document for a list of users:
+// <users><user><id>1</id>...</user></users>
+type userList struct {
+	XMLName xml.Name `xml:"users"`
+	Users   []User   `xml:"user"`
+}
+
+// userElement names the root element of a single user in XML.
+var userElement = xml.StartElement{Name: xml.Name{Local: "user"}}
+
+// csvHeader is the header row of every CSV response.
+var csvHeader = []string{"id", "name", "email"}
+
+// ndjsonFlushEvery is how many NDJSON lines are written between flushes,
+// so long lists reach the client while they are still being encoded.
+const ndjsonFlushEvery = 100
+
+// contentTypes maps each negotiated media type to the full Content-Type
+// header sent with it.
+var contentTypes = map[string]string{
+	mediaJSON:   "application/json",
+	mediaXML:    "application/xml; charset=utf-8",
+	mediaCSV:    "text/csv; charset=utf-8",
+	mediaNDJSON: "application/x-ndjson",
+}
+
+// writeUsers sends a list of users in the negotiated format.
+func writeUsers(w http.ResponseWriter, mediaType string, status int, users []User) {
+	w.Header().Set("Content-Type", contentTypes[mediaType])
+	w.WriteHeader(status)
+
+	switch mediaType {
+	case mediaXML:
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(userList{Users: users})
+	case mediaCSV:
+		writeCSV(w, users)
+	case mediaNDJSON:
+		writeNDJSON(w, users)
+	default:
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+// writeUser sends a single user in the negotiated format. CSV and NDJSON
+// have no notion of a lone object, so it becomes a one-row document.
+func writeUser(w http.ResponseWriter, mediaType string, status int, user User) {
+	switch mediaType {
+	case mediaCSV, mediaNDJSON:
+		writeUsers(w, mediaType, status, []User{user})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypes[mediaType])
+	w.WriteHeader(status)
+	if mediaType == mediaXML {
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).EncodeElement(user, userElement)
+		return
+	}
+	json.NewEncoder(w).Encode(user)
+}
+
+func writeCSV(w io.Writer, users []User) {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, u := range users {
+		cw.Write([]string{strconv.Itoa(u.ID), u.Name, u.Email})
+	}
+	cw.Flush()
+}
+
+// writeNDJSON writes one JSON object per line, flushing as it goes.
+// Encoding errors mean the client went away; there is nobody left to
+// report them to.
+func writeNDJSON(w http.ResponseWriter, users []User) {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for i, u := range users {
+		if err := enc.Encode(u); err != nil {
+			return
+		}
+		if (i+1)%ndjsonFlushEvery == 0 {
+			rc.Flush()
+		}
+	}
+	rc.Flush()
+}
+
+// decodeBody decodes a single object from a JSON or XML body, chosen by
+// Content-Type. On failure it writes a problem response and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	mediaType, ok := requestMediaType(w, r, mediaJSON, mediaXML)
+	if !ok {
+		return false
+	}
+	return decodeAs(w, r, mediaType, dst)
+}
+
+// decodeAs decodes the body as mediaType, which must be JSON or XML.
+func decodeAs(w http.ResponseWriter, r *http.Request, mediaType string, dst any) bool {
+	if mediaType == mediaXML {
+		return decodeXML(w, r, dst)
+	}
+	return decodeJSON(w, r, dst)
+}
+
+// decodeXML is decodeJSON for XML bodies: one element, at most
+// maxBodyBytes, nothing but whitespace or comments after it, and no
+// child elements dst has no field for.
+func decodeXML(w http.ResponseWriter, r *http.Request, dst any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	dec := xml.NewTokenDecoder(&strictXML{
+		tokens: xml.NewDecoder(r.Body),
+		known:  xmlFields(reflect.TypeOf(dst)),
+	})
+
+	err := dec.Decode(dst)
+	if err == nil {
+		err = xmlTrailing(dec)
+	}
+	if err == nil {
+		return true
+	}
+
+	var (
+		maxBytesErr *http.MaxBytesError
+		unknownErr  *unknownElementError
+	)
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body must not exceed %d bytes", maxBytesErr.Limit))
+	case errors.Is(err, io.EOF):
+		writeError(w, http.StatusBadRequest, "request body must not be empty")
+	case errors.As(err, &unknownErr):
+		writeValidationErrors(w, http.StatusBadRequest, "request body has unknown fields", ValidationErrors{
+			{unknownErr.Name, "unknown field"},
+		})
+	default:
+		writeError(w, http.StatusBadRequest, "malformed XML: "+err.Error())
+	}
+	return false
+}
+
+// unknownElementError names a child element the target type has no
+// field for.
+type unknownElementError struct {
+	Name string
+}
+
+func (e *unknownElementError) Error() string {
+	return fmt.Sprintf("unknown element <%s>", e.Name)
+}
+
+// strictXML passes tokens through, failing on a child of the root element
+// that isn't in known: encoding/xml has no DisallowUnknownFields, and
+// would drop it silently.
+type strictXML struct {
+	tokens xml.TokenReader
+	known  map[string]bool
+	depth  int
+}
+
+func (s *strictXML) Token() (xml.Token, error) {
+	tok, err := s.tokens.Token()
+	switch t := tok.(type) {
+	case xml.StartElement:
+		s.depth++
+		if s.depth == 2 && !s.known[t.Name.Local] {
+			return nil, &unknownElementError{t.Name.Local}
+		}
+	case xml.EndElement:
+		s.depth--
+	}
+	return tok, err
+}
+
+// xmlFields returns the element names encoding/xml fills in a struct of
+// type t (or pointer to one): the first part of each xml tag, or the
+// field name. Attributes, character data and "-" fields are left out.
+func xmlFields(t reflect.Type) map[string]bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	known := map[string]bool{}
+	if t.Kind() != reflect.Struct {
+		return known
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Name == "XMLName" {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("xml"), ",")
+		if name == "-" || strings.Contains(opts, "attr") || strings.Contains(opts, "chardata") ||
+			strings.Contains(opts, "innerxml") || strings.Contains(opts, "comment") {
+			continue
+		}
+		name, _, _ = strings.Cut(name, ">")
+		if name == "" {
+			name = f.Name
+		}
+		known[name] = true
+	}
+	return known
+}
+
+// xmlTrailing reports an error if another element follows the decoded one.
+func xmlTrailing(dec *xml.Decoder) error {
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.Comment, xml.ProcInst:
+		case xml.CharData:
+			if strings.TrimSpace(string(t)) != "" {
+				return errors.New("body must contain a single XML element")
+			}
+		default:
+			return errors.New("body must contain a single XML element")
+		}
+	}
+}
+
+// csvUser is a user read from one CSV record, with the line it came from
+// so errors can point at it.
+type csvUser struct {
+	Line int
+	User User
+}
+
+// readUsersCSV parses a CSV body whose header row names its columns.
+// name and email are required; an id column is allowed, so an exported
+// file can be posted back, but its values are ignored. Structural
+// problems are returned as plain errors and invalid rows as
+// ValidationErrors naming the line.
+func readUsersCSV(body io.Reader) ([]csvUser, error) {
+	cr := csv.NewReader(body)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("CSV body must start with a header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		// Spreadsheets like to start files with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\uFEFF")))
+		switch name {
+		case "id", "name", "email":
+		default:
+			return nil, fmt.Errorf("unknown CSV column %q; use id, name and email", name)
+		}
+		if _, dup := columns[name]; dup {
+			return nil, fmt.Errorf("duplicate CSV column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, required := range []string{"name", "email"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header must include a %q column", required)
+		}
+	}
+
+	var (
+		users []csvUser
+		errs  ValidationErrors
+		seen  = map[string]int{}
+	)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		u := User{Name: record[columns["name"]], Email: record[columns["email"]]}
+		if err := validateUser(u); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				errs = append(errs, ValidationError{fmt.Sprintf("line %d: %s", line, e.Field), e.Message})
+			}
+		} else if first, dup := seen[u.Email]; dup {
+			errs = append(errs, ValidationError{fmt.Sprintf("line %d: email", line),
+				fmt.Sprintf("duplicates line %d", first)})
+		} else {
+			seen[u.Email] = line
+		}
+		users = append(users, csvUser{Line: line, User: u})
+	}
+
+	if len(users) == 0 {
+		return nil, errors.New("CSV body has no users after the header row")
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return users, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func accept(mediaType string) http.Header {
+	return http.Header{"Accept": {mediaType}}
+}
+
+func TestListUsersXML(t *testing.T) {
+	s, _ := newTestServer()
+	w := serveWith(s, accept("application/xml"), "GET", "/users", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/xml; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+	if !strings.HasPrefix(w.Body.String(), xml.Header) {
+		t.Errorf("Expected XML declaration, got %q", w.Body)
+	}
+
+	var list userList
+	if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Invalid XML: %v\n%s", err, w.Body)
+	}
+	if len(list.Users) != 2 || list.Users[1].Name != "Bob" || list.Users[1].Email != "bob@example.com" {
+		t.Errorf("Unexpected users: %+v", list.Users)
+	}
+}
+
+func TestListUsersCSV(t *testing.T) {
+	s, _ := newTestServer()
+	w := serveWith(s, accept("text/csv"), "GET", "/users?sort=-id", "")
+
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	want := [][]string{
+		{"id", "name", "email"},
+		{"2", "Bob", "bob@example.com"},
+		{"1", "Alice", "alice@example.com"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("Expected %d records, got %v", len(want), records)
+	}
+	for i := range want {
+		if strings.Join(records[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("Row %d: expected %v, got %v", i, want[i], records[i])
+		}
+	}
+}
+
+func TestListUsersNDJSON(t *testing.T) {
+	users := make([]User, ndjsonFlushEvery+5)
+	for i := range users {
+		users[i] = User{ID: i + 1, Name: "User", Email: "user@example.com"}
+	}
+	s := newQuietServer(NewMemoryUserStore(users...))
+	w := serveWith(s, accept("application/x-ndjson"), "GET", "/users?limit=100", "")
+
+	if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+	if !w.Flushed {
+		t.Error("Expected NDJSON response to be flushed")
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var u User
+		if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			t.Fatalf("Line %d is not a JSON object: %v", lines+1, err)
+		}
+		lines++
+		if u.ID != lines {
+			t.Errorf("Line %d: expected ID %d, got %d", lines, lines, u.ID)
+		}
+	}
+	if lines != 100 {
+		t.Errorf("Expected 100 lines, got %d", lines)
+	}
+}
+
+func TestGetUserFormats(t *testing.T) {
+	s, store := newTestServer()
+	alice := mustGet(t, store, 1)
+
+	tests := []struct {
+		accept string
+		body   string
+	}{
+		{"application/json", `{"id":1,"name":"Alice","email":"alice@example.com"}` + "\n"},
+		{"application/xml", xml.Header + `<user><id>1</id><name>Alice</name><email>alice@example.com</email></user>`},
+		{"text/csv", "id,name,email\n1,Alice,alice@example.com\n"},
+		{"application/x-ndjson", `{"id":1,"name":"Alice","email":"alice@example.com"}` + "\n"},
+	}
+
+	tags := map[string]bool{}
+	for _, tt := range tests {
+		w := serveWith(s, accept(tt.accept), "GET", "/users/1", "")
+		if w.Body.String() != tt.body {
+			t.Errorf("%s: expected %q, got %q", tt.accept, tt.body, w.Body)
+		}
+
+		tag := w.Header().Get("ETag")
+		if tag != etagFor(alice, tt.accept) {
+			t.Errorf("%s: unexpected ETag %s", tt.accept, tag)
+		}
+		tags[tag] = true
+
+		// Every representation's tag is good enough for If-Match
+		header := http.Header{"If-Match": {tag}}
+		if w := serveWith(s, header, "PATCH", "/users/1", `{}`); w.Code != http.StatusOK {
+			t.Errorf("%s: expected If-Match with its ETag to succeed, got %d", tt.accept, w.Code)
+		}
+		alice = mustGet(t, store, 1)
+	}
+	if len(tags) != len(tests) {
+		t.Errorf("Expected a distinct ETag per representation, got %v", tags)
+	}
+}
+
+func TestCreateUserXML(t *testing.T) {
+	s, store := newTestServer()
+	header := http.Header{"Content-Type": {"application/xml"}, "Accept": {"application/xml"}}
+	w := serveWith(s, header, "POST", "/users", `<user><name>Carol</name><email>carol@example.com</email></user>`)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if got := mustGet(t, store, 3); got.Name != "Carol" {
+		t.Errorf("Unexpected user %+v", got)
+	}
+
+	var created User
+	if err := xml.Unmarshal(w.Body.Bytes(), &created); err != nil || created.ID != 3 {
+		t.Errorf("Expected created user as XML, got %q (%v)", w.Body, err)
+	}
+}
+
+func TestCreateUserBadXML(t *testing.T) {
+	s, _ := newTestServer()
+	header := http.Header{"Content-Type": {"text/xml"}}
+
+	tests := map[string]string{
+		"empty":     "",
+		"malformed": "<user><name>Carol</user>",
+		"two roots": "<user><name>A</name></user><user><name>B</name></user>",
+	}
+	for name, body := range tests {
+		w := serveWith(s, header, "POST", "/users", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, w.Code)
+		}
+	}
+
+	w := serveWith(s, header, "POST", "/users", "<user><name></name><email>nope</email></user>")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for invalid fields, got %d", w.Code)
+	}
+}
+
+// TestCreateUserXMLUnknownElement checks XML bodies are as strict as JSON
+// ones about fields the user doesn't have.
+func TestCreateUserXMLUnknownElement(t *testing.T) {
+	s, store := newTestServer()
+	header := http.Header{"Content-Type": {"application/xml"}}
+
+	w := serveWith(s, header, "POST", "/users",
+		"<user><name>Carol</name><email>carol@example.com</email><role>admin</role></user>")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for unknown element, got %d: %s", w.Code, w.Body.String())
+	}
+	p := decodeProblem(t, w)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "role" {
+		t.Errorf("Expected an error for role, got %+v", p.Errors)
+	}
+	if n := countUsers(t, store); n != 2 {
+		t.Errorf("Expected no user to be created, have %d", n)
+	}
+
+	// The same body without it goes through
+	w = serveWith(s, header, "POST", "/users",
+		"<user><name>Carol</name><email>carol@example.com</email></user>")
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for a known shape, got %d", w.Code)
+	}
+}
+
+func TestCreateUsersCSV(t *testing.T) {
+	s, store := newTestServer()
+	header := http.Header{"Content-Type": {"text/csv"}, "Accept": {"text/csv"}}
+	body := "\uFEFFid,Name,Email\n99,Carol,carol@example.com\n,\"Dave, Jr.\",dave@example.com\n"
+	w := serveWith(s, header, "POST", "/users", body)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Body.String(); got != "id,name,email\n3,Carol,carol@example.com\n4,\"Dave, Jr.\",dave@example.com\n" {
+		t.Errorf("Unexpected response %q", got)
+	}
+	if got := mustGet(t, store, 4); got.Name != "Dave, Jr." {
+		t.Errorf("Unexpected user %+v", got)
+	}
+}
+
+func TestCreateUsersCSVErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		fields []string
+	}{
+		{"no header", "", http.StatusBadRequest, nil},
+		{"header only", "name,email\n", http.StatusBadRequest, nil},
+		{"missing column", "name\nCarol\n", http.StatusBadRequest, nil},
+		{"unknown column", "name,email,role\nCarol,carol@example.com,admin\n", http.StatusBadRequest, nil},
+		{"ragged row", "name,email\nCarol\n", http.StatusBadRequest, nil},
+		{
+			"invalid rows",
+			"name,email\nCarol,carol@example.com\n,not-an-email\nDave,carol@example.com\n",
+			http.StatusUnprocessableEntity,
+			[]string{"line 3: name", "line 3: email", "line 4: email"},
+		},
+		{
+			"existing email",
+			"name,email\nCarol,carol@example.com\nAlice,alice@example.com\n",
+			http.StatusConflict,
+			[]string{"line 3: email"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store := newTestServer()
+			w := serveWith(s, http.Header{"Content-Type": {"text/csv"}}, "POST", "/users", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("Expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.fields != nil {
+				if got := fields(decodeProblem(t, w).Errors); got != strings.Join(tt.fields, ",") {
+					t.Errorf("Expected errors for %v, got %v", tt.fields, got)
+				}
+			}
+
+			// Nothing is created when the file is rejected
+			if _, err := store.Get(context.Background(), 3); err == nil {
+				t.Error("Expected no users to be created")
+			}
+		})
+	}
+}
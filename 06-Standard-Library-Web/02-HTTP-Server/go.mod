@@ -1,4 +1,5 @@
 module github.com/codinsec/go-learning-lab/06-standard-library-web/http-server
 
-go 1.21
+go 1.22
 
+require github.com/mattn/go-sqlite3 v1.14.17
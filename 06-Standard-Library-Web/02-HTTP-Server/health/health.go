@@ -0,0 +1,283 @@
+// Package health runs named dependency checks and serves their results
+// as Kubernetes-style /livez and /readyz endpoints, using only the
+// standard library.
+//
+// Components register checks on a Checker when they start:
+//
+//	checker := health.NewChecker()
+//	checker.AddReadiness(health.Check{
+//		Name:     "database",
+//		Check:    db.PingContext,
+//		Timeout:  time.Second,
+//		Interval: 10 * time.Second,
+//	})
+//	mux.Handle("GET /livez", checker.LiveHandler())
+//	mux.Handle("GET /readyz", checker.ReadyHandler())
+//
+// Liveness checks answer "should this process be restarted?" and should
+// only fail when a restart would help. Readiness checks answer "should
+// this process get traffic?"; /readyz runs them and the liveness checks.
+// Registering the same name twice is a programming error and panics.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds a check that doesn't set Timeout.
+	DefaultTimeout = 2 * time.Second
+	// DefaultProbeTimeout bounds a whole probe, however many checks it runs.
+	DefaultProbeTimeout = 5 * time.Second
+)
+
+// Status is the outcome of a check or of a whole probe.
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusFail Status = "fail"
+)
+
+// Check describes one dependency check.
+type Check struct {
+	// Name identifies the check in reports, e.g. "database".
+	Name string
+	// Check returns nil when the dependency is healthy. It must give up
+	// when ctx is done.
+	Check func(ctx context.Context) error
+	// Timeout bounds each run; DefaultTimeout if zero.
+	Timeout time.Duration
+	// Interval is how long a result is reused before the check runs
+	// again. Zero runs the check on every probe, which suits cheap
+	// in-process checks; a database ping should be cached so that
+	// frequent probes don't add load.
+	Interval time.Duration
+}
+
+// Result is the latest outcome of one check.
+type Result struct {
+	Name      string        `json:"name"`
+	Status    Status        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration_ns"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// Report is a probe's answer: StatusOK only if every check passed.
+// Checks is sorted by name.
+type Report struct {
+	Status Status   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+// Checker holds the registered checks. It is safe for concurrent use.
+type Checker struct {
+	// ProbeTimeout bounds each probe; DefaultProbeTimeout if zero. A
+	// check still running at the deadline is reported as failed.
+	ProbeTimeout time.Duration
+
+	mu        sync.Mutex
+	names     map[string]bool
+	liveness  []*check
+	readiness []*check
+	now       func() time.Time // replaced in tests
+}
+
+// NewChecker returns a Checker without checks; its probes pass.
+func NewChecker() *Checker {
+	return &Checker{names: make(map[string]bool), now: time.Now}
+}
+
+// AddLiveness registers a check run by /livez and /readyz.
+func (c *Checker) AddLiveness(chk Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, c.newCheck(chk))
+}
+
+// AddReadiness registers a check run by /readyz only.
+func (c *Checker) AddReadiness(chk Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, c.newCheck(chk))
+}
+
+// newCheck validates chk. The caller must hold c.mu.
+func (c *Checker) newCheck(chk Check) *check {
+	if chk.Name == "" || chk.Check == nil {
+		panic("health: a check needs a name and a func")
+	}
+	if c.names[chk.Name] {
+		panic(fmt.Sprintf("health: duplicate check %q", chk.Name))
+	}
+	c.names[chk.Name] = true
+	if chk.Timeout <= 0 {
+		chk.Timeout = DefaultTimeout
+	}
+	return &check{Check: chk}
+}
+
+// Live runs the liveness checks.
+func (c *Checker) Live(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append([]*check(nil), c.liveness...)
+	c.mu.Unlock()
+	return c.probe(ctx, checks)
+}
+
+// Ready runs the liveness and readiness checks.
+func (c *Checker) Ready(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append(append([]*check(nil), c.liveness...), c.readiness...)
+	c.mu.Unlock()
+	return c.probe(ctx, checks)
+}
+
+// probe runs checks concurrently and waits for all of them, or for the
+// probe deadline.
+func (c *Checker) probe(ctx context.Context, checks []*check) Report {
+	timeout := c.ProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, chk := range checks {
+		wg.Add(1)
+		go func(i int, chk *check) {
+			defer wg.Done()
+			results[i] = chk.result(ctx, c.now)
+		}(i, chk)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	report := Report{Status: StatusOK, Checks: results}
+	for _, r := range results {
+		if r.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// LiveHandler serves Live; see Handler.
+func (c *Checker) LiveHandler() http.Handler {
+	return Handler(c.Live)
+}
+
+// ReadyHandler serves Ready; see Handler.
+func (c *Checker) ReadyHandler() http.Handler {
+	return Handler(c.Ready)
+}
+
+// Handler serves a probe as JSON: 200 when it passes, 503 when it fails.
+// The body is {"status":"ok"}, which is all a kubelet or load balancer
+// needs; ?verbose adds every check's result, error and timing.
+func Handler(probe func(context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := probe(r.Context())
+		if _, verbose := r.URL.Query()["verbose"]; !verbose {
+			report.Checks = nil
+		}
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// check is a registered Check and its cached result.
+type check struct {
+	Check
+
+	mu      sync.Mutex
+	last    Result
+	expires time.Time
+	running chan struct{} // closed when the run in flight finishes
+}
+
+// result returns the cached result while it is fresh. Otherwise it starts
+// a run, or joins the one already in flight, so concurrent probes never
+// run a check twice. Runs don't use the probe's context: a probe that
+// gives up doesn't cancel the run, whose result is cached for the next.
+func (chk *check) result(ctx context.Context, now func() time.Time) Result {
+	chk.mu.Lock()
+	if chk.running == nil && now().Before(chk.expires) {
+		r := chk.last
+		chk.mu.Unlock()
+		return r
+	}
+	done := chk.running
+	if done == nil {
+		done = make(chan struct{})
+		chk.running = done
+		go chk.run(done, now)
+	}
+	chk.mu.Unlock()
+
+	select {
+	case <-done:
+		chk.mu.Lock()
+		defer chk.mu.Unlock()
+		return chk.last
+	case <-ctx.Done():
+		return Result{
+			Name:      chk.Name,
+			Status:    StatusFail,
+			Error:     "check did not finish before the probe deadline",
+			CheckedAt: now(),
+		}
+	}
+}
+
+// run runs the check once under its timeout and stores the result.
+func (chk *check) run(done chan struct{}, now func() time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), chk.Timeout)
+	defer cancel()
+
+	start := now()
+	err := safeCheck(ctx, chk.Check.Check)
+	if err == nil && ctx.Err() != nil {
+		// The check ignored its deadline; don't trust a late success
+		err = ctx.Err()
+	}
+	r := Result{Name: chk.Name, Status: StatusOK, Duration: now().Sub(start), CheckedAt: start}
+	if err != nil {
+		r.Status = StatusFail
+		r.Error = err.Error()
+	}
+
+	chk.mu.Lock()
+	defer chk.mu.Unlock()
+	chk.last = r
+	chk.expires = start.Add(chk.Interval)
+	chk.running = nil
+	close(done)
+}
+
+// safeCheck turns a panicking check into a failed one: a probe must not
+// take the process down.
+func safeCheck(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("check panicked: %v", rec)
+		}
+	}()
+	return fn(ctx)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/health"
+)
+
+// minFreeDisk is the free space the SQLite database needs to stay ready.
+const minFreeDisk = 100 << 20 // 100 MiB
+
+// healthParams documents the probe query for the OpenAPI document.
+type healthParams struct {
+	Verbose bool `query:"verbose" doc:"List every check with its status, error and duration"`
+}
+
+// pinger is implemented by stores backed by a database.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// registerHealthChecks adds the checks for the server's own dependencies.
+// There are no liveness checks: nothing here gets stuck in a way a
+// restart would fix, and a database outage must not make the orchestrator
+// restart every replica at once. It only takes them out of rotation.
+func (s *server) registerHealthChecks(store UserStore) {
+	s.health.AddReadiness(health.Check{
+		Name: "draining",
+		Check: func(ctx context.Context) error {
+			if !s.ready.Load() {
+				return errors.New("not accepting traffic: starting up or draining")
+			}
+			return nil
+		},
+	})
+	if p, ok := store.(pinger); ok {
+		s.health.AddReadiness(health.Check{
+			Name:     "database",
+			Check:    p.Ping,
+			Timeout:  time.Second,
+			Interval: 10 * time.Second,
+		})
+	}
+}
+
+// addDiskCheck makes readiness fail when the disk holding the SQLite file
+// at dbPath runs low, before writes start failing.
+func (s *server) addDiskCheck(dbPath string) {
+	s.health.AddReadiness(health.Check{
+		Name:     "disk",
+		Check:    health.DiskSpace(filepath.Dir(dbPath), minFreeDisk),
+		Interval: 30 * time.Second,
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/health"
+)
+
+func decodeHealth(t *testing.T, s *server, target string) (int, health.Report) {
+	t.Helper()
+	w := serve(s, "GET", target, "")
+	var report health.Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report
+}
+
+func TestReadyzFollowsDraining(t *testing.T) {
+	s, _ := newTestServer()
+
+	code, report := decodeHealth(t, s, "/readyz?verbose")
+	if code != http.StatusServiceUnavailable || len(report.Checks) != 1 || report.Checks[0].Name != "draining" {
+		t.Errorf("Expected 503 from the draining check before startup, got %d %+v", code, report)
+	}
+	// Liveness doesn't care: a starting or draining server needs no restart
+	if code, _ := decodeHealth(t, s, "/livez"); code != http.StatusOK {
+		t.Errorf("Expected /livez 200, got %d", code)
+	}
+
+	s.ready.Store(true)
+	if code, report := decodeHealth(t, s, "/readyz"); code != http.StatusOK || report.Checks != nil {
+		t.Errorf("Expected a terse 200 once ready, got %d %+v", code, report)
+	}
+}
+
+func TestReadyzPingsDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	store, err := NewSQLUserStore(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newQuietServer(store)
+	s.ready.Store(true)
+
+	if code, report := decodeHealth(t, s, "/readyz?verbose"); code != http.StatusOK || len(report.Checks) != 2 {
+		t.Errorf("Expected draining and database to pass, got %d %+v", code, report)
+	}
+
+	// The last result is cached, so use a fresh server to see the outage
+	db.Close()
+	s = newQuietServer(store)
+	s.ready.Store(true)
+	code, report := decodeHealth(t, s, "/readyz?verbose")
+	if code != http.StatusServiceUnavailable || report.Checks[0].Name != "database" || report.Checks[0].Status != health.StatusFail {
+		t.Errorf("Expected the database check to fail, got %d %+v", code, report)
+	}
+}
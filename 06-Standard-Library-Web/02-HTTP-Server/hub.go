@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/websocket"
+)
+
+const (
+	// wsSendBuffer is how many messages a client may fall behind before
+	// the hub disconnects it.
+	wsSendBuffer = 32
+	// wsMaxMessage is the largest message a client may send.
+	wsMaxMessage = 64 << 10
+	// wsPongWait is how long a client may stay silent; wsPingPeriod must
+	// be shorter so that a live client's pong arrives in time.
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsWriteWait bounds each write to a client.
+	wsWriteWait = 10 * time.Second
+)
+
+// wsMessage is one message for every client in a room.
+type wsMessage struct {
+	room string
+	typ  websocket.Opcode
+	data []byte
+}
+
+// wsClient is one connection in a room. The hub owns send: only the
+// hub's goroutine sends on it or closes it.
+type wsClient struct {
+	room      string
+	conn      *websocket.Conn
+	send      chan wsMessage
+	closeCode int // why send was closed; read after the close
+}
+
+// hub broadcasts messages to rooms of WebSocket clients. Its state lives
+// in the run goroutine and everything else talks to it over channels, the
+// same confinement pattern as the 05-Concurrency lessons: no mutex, and
+// register, unregister and broadcast can never race.
+type hub struct {
+	register   chan *wsClient
+	unregister chan *wsClient
+	broadcast  chan wsMessage
+	quit       chan struct{} // closed by Close
+	done       chan struct{} // closed when run has disconnected everyone
+
+	clients atomic.Int64  // connected clients, for metrics
+	dropped atomic.Uint64 // slow clients disconnected so far
+}
+
+// newHub starts a hub; Close stops it.
+func newHub() *hub {
+	h := &hub{
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		broadcast:  make(chan wsMessage),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+func (h *hub) run() {
+	rooms := map[string]map[*wsClient]struct{}{}
+	remove := func(c *wsClient, code int) {
+		delete(rooms[c.room], c)
+		if len(rooms[c.room]) == 0 {
+			delete(rooms, c.room)
+		}
+		c.closeCode = code
+		close(c.send)
+		h.clients.Add(-1)
+	}
+
+	for {
+		select {
+		case c := <-h.register:
+			if rooms[c.room] == nil {
+				rooms[c.room] = map[*wsClient]struct{}{}
+			}
+			rooms[c.room][c] = struct{}{}
+			h.clients.Add(1)
+
+		case c := <-h.unregister:
+			if _, ok := rooms[c.room][c]; ok {
+				remove(c, websocket.CloseNormal)
+			}
+
+		case msg := <-h.broadcast:
+			// Fan out without blocking: one stuck client must not hold
+			// up the room, so it is dropped instead
+			for c := range rooms[msg.room] {
+				select {
+				case c.send <- msg:
+				default:
+					remove(c, websocket.CloseTryAgainLater)
+					h.dropped.Add(1)
+				}
+			}
+
+		case <-h.quit:
+			for _, clients := range rooms {
+				for c := range clients {
+					remove(c, websocket.CloseGoingAway)
+				}
+			}
+			close(h.done)
+			return
+		}
+	}
+}
+
+// Close disconnects every client with CloseGoingAway and stops the hub.
+// Hijacked connections are not tracked by http.Server, so lifecycle
+// registers this with RegisterOnShutdown.
+func (h *hub) Close() {
+	select {
+	case <-h.quit:
+	default:
+		close(h.quit)
+	}
+	<-h.done
+}
+
+// join adds c to its room; it returns false once the hub has stopped.
+func (h *hub) join(c *wsClient) bool {
+	select {
+	case h.register <- c:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+func (h *hub) leave(c *wsClient) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+func (h *hub) publish(msg wsMessage) {
+	select {
+	case h.broadcast <- msg:
+	case <-h.done:
+	}
+}
+
+// Handle GET /ws/rooms/{room}
+// Upgrades to a WebSocket and joins the room: every text or binary
+// message a client sends is broadcast to everyone in the room, itself
+// included. Rooms exist while they have clients.
+func (s *server) handleRoom(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if !validRoomName(room) {
+		writeError(w, http.StatusBadRequest, "room names are 1-64 letters, digits, '-' or '_'")
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r, nil)
+	if err != nil {
+		var he *websocket.HandshakeError
+		if errors.As(err, &he) {
+			writeError(w, he.Status, he.Message)
+		}
+		return
+	}
+
+	c := &wsClient{room: room, conn: conn, send: make(chan wsMessage, wsSendBuffer)}
+	if !s.hub.join(c) {
+		conn.Close(websocket.CloseGoingAway, "server is shutting down")
+		return
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.writeRoom(c)
+	}()
+	s.readRoom(c)
+	s.hub.leave(c)
+	<-written
+
+	if c.closeCode == websocket.CloseTryAgainLater {
+		s.logger.Warn("websocket slow consumer dropped",
+			"request_id", requestIDFrom(r.Context()), "room", room, "remote_addr", r.RemoteAddr)
+	}
+}
+
+// readRoom publishes c's messages until the connection fails or closes.
+// A client that answers no ping within wsPongWait is considered gone.
+func (s *server) readRoom(c *wsClient) {
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func([]byte) {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		typ, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.hub.publish(wsMessage{room: c.room, typ: typ, data: data})
+	}
+}
+
+// writeRoom sends c its messages and keepalive pings. When the hub
+// closes c.send it starts the close handshake with the hub's reason.
+func (s *server) writeRoom(c *wsClient) {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				c.conn.Close(c.closeCode, closeReasons[c.closeCode])
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(msg.typ, msg.data); err != nil {
+				// Keep draining until the hub closes send: readRoom
+				// fails next and the hub lets go of c
+				c.conn.Close(websocket.CloseInternalError, "")
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			c.conn.Ping(nil)
+		}
+	}
+}
+
+var closeReasons = map[int]string{
+	websocket.CloseGoingAway:     "server is shutting down",
+	websocket.CloseTryAgainLater: "too slow; reconnect",
+}
+
+// validRoomName keeps room names short and safe to log.
+func validRoomName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// wsParams documents the room path parameter for the OpenAPI document.
+type wsParams struct {
+	Room string `path:"room" doc:"Room to join; created on first join"`
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/websocket"
+)
+
+// joinRoom connects a WebSocket client to room on ts.
+func joinRoom(t *testing.T, ts *httptest.Server, room string) *websocket.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/rooms/"+room, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	t.Cleanup(func() { conn.Close(websocket.CloseNormal, "") })
+	return conn
+}
+
+func TestHubBroadcastsToRoom(t *testing.T) {
+	s, _ := newTestServer()
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	alice := joinRoom(t, ts, "general")
+	bob := joinRoom(t, ts, "general")
+	carol := joinRoom(t, ts, "random")
+	waitFor(t, func() bool { return s.hub.clients.Load() == 3 })
+
+	if err := alice.WriteMessage(websocket.OpText, []byte("hi all")); err != nil {
+		t.Fatal(err)
+	}
+	for name, conn := range map[string]*websocket.Conn{"alice": alice, "bob": bob} {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil || typ != websocket.OpText || string(msg) != "hi all" {
+			t.Errorf("%s: expected the broadcast, got %v %q %v", name, typ, msg, err)
+		}
+	}
+
+	// carol is in another room; her first message is her own
+	carol.WriteMessage(websocket.OpBinary, []byte{1, 2, 3})
+	if typ, msg, err := carol.ReadMessage(); err != nil || typ != websocket.OpBinary || len(msg) != 3 {
+		t.Errorf("carol: expected only her own message, got %v %v %v", typ, msg, err)
+	}
+}
+
+func TestHubLeave(t *testing.T) {
+	s, _ := newTestServer()
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	conn := joinRoom(t, ts, "general")
+	waitFor(t, func() bool { return s.hub.clients.Load() == 1 })
+
+	conn.Close(websocket.CloseNormal, "bye")
+	if _, _, err := conn.ReadMessage(); websocket.CloseStatus(err) != websocket.CloseNormal {
+		t.Errorf("Expected the close to be echoed, got %v", err)
+	}
+	waitFor(t, func() bool { return s.hub.clients.Load() == 0 })
+}
+
+func TestHubDropsSlowConsumer(t *testing.T) {
+	h := newHub()
+	defer h.Close()
+
+	slow := &wsClient{room: "general", send: make(chan wsMessage, 1)}
+	h.join(slow)
+	h.publish(wsMessage{room: "general", typ: websocket.OpText, data: []byte("1")})
+	h.publish(wsMessage{room: "general", typ: websocket.OpText, data: []byte("2")})
+
+	// The buffered message is still delivered before the channel closes
+	if msg, ok := <-slow.send; !ok || string(msg.data) != "1" {
+		t.Fatalf("Expected buffered message, got %q %v", msg.data, ok)
+	}
+	if _, ok := <-slow.send; ok {
+		t.Fatal("Expected send to be closed")
+	}
+	if slow.closeCode != websocket.CloseTryAgainLater || h.dropped.Load() != 1 {
+		t.Errorf("Expected drop with code %d, got %d (dropped %d)", websocket.CloseTryAgainLater, slow.closeCode, h.dropped.Load())
+	}
+}
+
+func TestHubCloseDisconnectsClients(t *testing.T) {
+	s, _ := newTestServer()
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	conn := joinRoom(t, ts, "general")
+	waitFor(t, func() bool { return s.hub.clients.Load() == 1 })
+
+	s.hub.Close()
+	if _, _, err := conn.ReadMessage(); websocket.CloseStatus(err) != websocket.CloseGoingAway {
+		t.Errorf("Expected close code %d, got %v", websocket.CloseGoingAway, err)
+	}
+
+	// Late joiners are turned away the same way
+	late := joinRoom(t, ts, "general")
+	if _, _, err := late.ReadMessage(); websocket.CloseStatus(err) != websocket.CloseGoingAway {
+		t.Errorf("Expected late join to be closed with %d, got %v", websocket.CloseGoingAway, err)
+	}
+}
+
+func TestHandleRoomRejections(t *testing.T) {
+	s, _ := newTestServer()
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/ws/rooms/general", http.StatusUpgradeRequired},
+		{"/ws/rooms/no%20spaces", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serve(s, "GET", tt.target, "")
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.target, tt.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: expected a problem response, got %q", tt.target, ct)
+		}
+	}
+}
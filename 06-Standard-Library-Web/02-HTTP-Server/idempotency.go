@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// replayedHeader marks a response that was stored, not produced again.
+	replayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKey bounds the memory one key can take.
+	maxIdempotencyKey = 255
+	// defaultIdempotencyTTL is how long a key is remembered after its
+	// first response; IDEMPOTENCY_TTL overrides it.
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+// storedResponse is what a replay sends: the status, the headers the
+// handler set and the body.
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyEntry tracks one key. done is closed once the first request
+// finishes; resp is nil if it failed and may be retried.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	resp        *storedResponse
+	expires     time.Time // zero while in flight
+}
+
+// idempotencyStore remembers the first response for each Idempotency-Key,
+// so a client retrying a POST after a timeout gets the original answer
+// instead of creating the user twice. Keys are scoped by clientKey: two
+// clients can't see each other's responses by picking the same key.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	ttl     time.Duration
+	now     func() time.Time // replaced in tests
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		entries: make(map[string]*idempotencyEntry),
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// begin returns the entry for key. leader is true when the caller must
+// run the request, because the key is new, expired or its last attempt
+// failed; otherwise the caller waits on entry.done.
+func (st *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (e *idempotencyEntry, leader bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if e, ok := st.entries[key]; ok && (e.expires.IsZero() || st.now().Before(e.expires)) {
+		return e, false
+	}
+	e = &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	st.entries[key] = e
+	return e, true
+}
+
+// finish stores resp for key and wakes the waiters. A nil resp (a 5xx
+// or a panic) forgets the key, so the next attempt runs again.
+func (st *idempotencyStore) finish(key string, e *idempotencyEntry, resp *storedResponse) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if resp == nil {
+		delete(st.entries, key)
+	} else {
+		e.resp = resp
+		e.expires = st.now().Add(st.ttl)
+	}
+	close(e.done)
+}
+
+// cleanup drops expired keys and returns how many were removed.
+func (st *idempotencyStore) cleanup() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	removed := 0
+	for key, e := range st.entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(st.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// startCleanup runs cleanup every interval until ctx is cancelled.
+func (st *idempotencyStore) startCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				st.cleanup()
+			}
+		}
+	}()
+}
+
+// Middleware: Idempotency keys
+// Requests without an Idempotency-Key pass through. The first request
+// with a key runs and its response is stored along with a fingerprint of
+// the request. A retry with the same body gets the stored response and an
+// Idempotent-Replayed header; one with a different body gets a 422.
+// Retries that arrive while the first request is still running wait for
+// it instead of running twice. 5xx responses aren't stored.
+func (st *idempotencyStore) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeError(w, http.StatusBadRequest,
+				fmt.Sprintf("%s must not exceed %d characters", idempotencyHeader, maxIdempotencyKey))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			writeError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body must not exceed %d bytes", maxBytesErr.Limit))
+			return
+		case err != nil:
+			writeError(w, http.StatusBadRequest, "could not read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scoped := clientKey(r) + " " + key
+		fingerprint := requestFingerprint(r, body)
+		for {
+			e, leader := st.begin(scoped, fingerprint)
+			if leader {
+				st.lead(w, r, next, scoped, e)
+				return
+			}
+			if e.fingerprint != fingerprint {
+				writeError(w, http.StatusUnprocessableEntity,
+					idempotencyHeader+" was already used for a different request")
+				return
+			}
+
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+			if e.resp != nil {
+				replay(w, e.resp)
+				return
+			}
+			// The first attempt failed; try to run it ourselves
+		}
+	})
+}
+
+// lead runs the request for a new key and records its response. If the
+// handler panics the key is released before the panic moves on to
+// recoverMiddleware, so waiting retries don't hang.
+func (st *idempotencyStore) lead(w http.ResponseWriter, r *http.Request, next http.Handler, key string, e *idempotencyEntry) {
+	rec := &responseRecorder{ResponseWriter: w, before: w.Header().Clone()}
+	finished := false
+	defer func() {
+		if !finished {
+			st.finish(key, e, nil)
+		}
+	}()
+
+	next.ServeHTTP(rec, r)
+	finished = true
+	if rec.status == 0 || rec.status >= 500 {
+		st.finish(key, e, nil)
+		return
+	}
+	st.finish(key, e, &storedResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()})
+}
+
+// replay writes a stored response. Headers set by outer middleware for
+// this request (request ID, rate limits, CORS) are kept.
+func replay(w http.ResponseWriter, resp *storedResponse) {
+	h := w.Header()
+	for name, values := range resp.header {
+		h[name] = slices.Clone(values)
+	}
+	h.Set(replayedHeader, "true")
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// requestFingerprint hashes what makes two requests "the same": method,
+// path, query, body type and body.
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n%s\n", r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"))
+	h.Write(body)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// responseRecorder passes a response through while keeping a copy of
+// its status, body and the headers the handler added.
+type responseRecorder struct {
+	http.ResponseWriter
+	before http.Header // headers set before the handler ran
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+		rec.header = http.Header{}
+		for name, values := range rec.Header() {
+			if !slices.Equal(rec.before[name], values) {
+				rec.header[name] = slices.Clone(values)
+			}
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
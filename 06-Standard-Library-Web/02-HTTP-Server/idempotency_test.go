@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// postWithKey sends POST /users with an Idempotency-Key.
+func postWithKey(s *server, key, body string) *httptest.ResponseRecorder {
+	return serveWith(s, http.Header{idempotencyHeader: {key}}, "POST", "/users", body)
+}
+
+func countUsers(t *testing.T, store UserStore) int {
+	t.Helper()
+	users, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(users)
+}
+
+func TestIdempotentCreateReplays(t *testing.T) {
+	s, store := newTestServer()
+	body := `{"name":"Carol","email":"carol@example.com"}`
+
+	first := postWithKey(s, "key-1", body)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", first.Code)
+	}
+	second := postWithKey(s, "key-1", body)
+
+	if second.Code != http.StatusCreated {
+		t.Errorf("Expected replayed 201, got %d", second.Code)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("Expected the same body, got %q and %q", first.Body, second.Body)
+	}
+	for _, h := range []string{"Location", "ETag", "Content-Type"} {
+		if second.Header().Get(h) != first.Header().Get(h) {
+			t.Errorf("Expected %s %q to be replayed, got %q", h, first.Header().Get(h), second.Header().Get(h))
+		}
+	}
+	if second.Header().Get(replayedHeader) != "true" || first.Header().Get(replayedHeader) != "" {
+		t.Error("Expected only the replay to be marked")
+	}
+	if second.Header().Get(requestIDHeader) == first.Header().Get(requestIDHeader) {
+		t.Error("Expected the replay to keep its own request ID")
+	}
+	if n := countUsers(t, store); n != 3 {
+		t.Errorf("Expected one user to be created, store has %d", n)
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentBody(t *testing.T) {
+	s, store := newTestServer()
+	postWithKey(s, "key-1", `{"name":"Carol","email":"carol@example.com"}`)
+	w := postWithKey(s, "key-1", `{"name":"Dave","email":"dave@example.com"}`)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422, got %d", w.Code)
+	}
+	if n := countUsers(t, store); n != 3 {
+		t.Errorf("Expected no second user, store has %d", n)
+	}
+}
+
+func TestIdempotencyKeyScopedByClient(t *testing.T) {
+	s, store := newTestServer()
+	for _, addr := range []string{"192.0.2.1:1234", "192.0.2.2:1234"} {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(`{"name":"Carol","email":"carol@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyHeader, "shared")
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		s.handler().ServeHTTP(w, req)
+		if w.Header().Get(replayedHeader) != "" {
+			t.Errorf("%s: expected its own response, got a replay", addr)
+		}
+	}
+	// The second client ran its own create, which hit the unique email
+	if n := countUsers(t, store); n != 3 {
+		t.Errorf("Expected 3 users, got %d", n)
+	}
+}
+
+func TestIdempotencyConcurrentDuplicatesWait(t *testing.T) {
+	st := newIdempotencyStore(time.Hour)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := st.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/users", strings.NewReader("{}"))
+			req.Header.Set(idempotencyHeader, "same")
+			results[i] = httptest.NewRecorder()
+			h.ServeHTTP(results[i], req)
+		}(i)
+	}
+	waitFor(t, func() bool { return calls.Load() == 1 })
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", n)
+	}
+	for i, w := range results {
+		if w.Code != http.StatusCreated || w.Body.String() != "created" {
+			t.Errorf("Request %d: expected the first response, got %d %q", i, w.Code, w.Body)
+		}
+	}
+}
+
+func TestIdempotencyServerErrorsNotStored(t *testing.T) {
+	st := newIdempotencyStore(time.Hour)
+	var calls atomic.Int32
+	h := st.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusCreated, http.StatusCreated} {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader("{}"))
+		req.Header.Set(idempotencyHeader, "retry-me")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Expected %d, got %d", want, w.Code)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected the 503 to be retried and the 201 replayed, handler ran %d times", n)
+	}
+}
+
+func TestIdempotencyPanicReleasesKey(t *testing.T) {
+	s, store := newTestServer()
+	h := s.idempotency.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() { recover() }()
+		req := httptest.NewRequest("POST", "/users", strings.NewReader("{}"))
+		req.Header.Set(idempotencyHeader, "k")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	if w := postWithKey(s, "k", `{"name":"Carol","email":"carol@example.com"}`); w.Code != http.StatusCreated {
+		t.Errorf("Expected the key to be free after a panic, got %d", w.Code)
+	}
+	if n := countUsers(t, store); n != 3 {
+		t.Errorf("Expected 3 users, got %d", n)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	s, store := newTestServer()
+	now := time.Now()
+	s.idempotency.ttl = time.Hour
+	s.idempotency.now = func() time.Time { return now }
+
+	postWithKey(s, "k", `{"name":"Carol","email":"carol@example.com"}`)
+	now = now.Add(time.Hour)
+	if removed := s.idempotency.cleanup(); removed != 1 {
+		t.Errorf("Expected 1 expired key, removed %d", removed)
+	}
+
+	// The key is free again, so it can be used for a new create
+	if w := postWithKey(s, "k", `{"name":"Carol","email":"carol2@example.com"}`); w.Code != http.StatusCreated || w.Header().Get(replayedHeader) != "" {
+		t.Errorf("Expected a fresh 201, got %d", w.Code)
+	}
+	if n := countUsers(t, store); n != 4 {
+		t.Errorf("Expected 4 users, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	s, _ := newTestServer()
+	w := postWithKey(s, strings.Repeat("k", maxIdempotencyKey+1), `{"name":"Carol","email":"carol@example.com"}`)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
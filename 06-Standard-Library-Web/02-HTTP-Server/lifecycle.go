@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// lifecycleConfig controls how the server drains on shutdown.
+type lifecycleConfig struct {
+	// DrainTimeout is how long Shutdown waits for in-flight requests.
+	DrainTimeout time.Duration
+	// ReadinessDelay keeps the listener open after /readyz turns 503,
+	// giving load balancers time to stop routing new traffic here.
+	ReadinessDelay time.Duration
+}
+
+// lifecycleConfigFromEnv reads SHUTDOWN_TIMEOUT and READINESS_DELAY
+// (Go duration strings such as "30s"), falling back to defaults.
+func lifecycleConfigFromEnv() (lifecycleConfig, error) {
+	cfg := lifecycleConfig{
+		DrainTimeout:   10 * time.Second,
+		ReadinessDelay: 0,
+	}
+	if err := durationFromEnv("SHUTDOWN_TIMEOUT", &cfg.DrainTimeout); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("READINESS_DELAY", &cfg.ReadinessDelay); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func durationFromEnv(key string, dst *time.Duration) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = d
+	return nil
+}
+
+// run serves srv on ln until ctx is cancelled (e.g. by SIGINT/SIGTERM),
+// then drains in-flight requests within cfg.DrainTimeout.
+//
+// Shutdown sequence:
+//  1. readiness flips to false so /readyz returns 503
+//  2. wait cfg.ReadinessDelay while still serving
+//  3. srv.Shutdown stops accepting connections and waits for handlers
+func (s *server) run(ctx context.Context, srv *http.Server, ln net.Listener, cfg lifecycleConfig) error {
+	// Event streams never finish on their own, and Shutdown doesn't track
+	// hijacked WebSocket connections; end both when draining starts
+	srv.RegisterOnShutdown(s.events.Close)
+	srv.RegisterOnShutdown(s.hub.Close)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		// ServeTLS takes certificates from srv.TLSConfig and enables HTTP/2
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+
+	s.ready.Store(true)
+	log.Printf("Listening on %s", ln.Addr())
+
+	select {
+	case err := <-serveErr:
+		s.ready.Store(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	s.ready.Store(false)
+	log.Printf("Shutdown requested: %d request(s) in flight", s.inFlight.Load())
+
+	if cfg.ReadinessDelay > 0 {
+		log.Printf("Not ready; serving for %v before draining", cfg.ReadinessDelay)
+		time.Sleep(cfg.ReadinessDelay)
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+
+	log.Printf("Draining %d request(s) (deadline %v)", s.inFlight.Load(), cfg.DrainTimeout)
+	err := srv.Shutdown(drainCtx)
+	if err != nil {
+		log.Printf("Drain deadline exceeded with %d request(s) still in flight", s.inFlight.Load())
+		srv.Close()
+	}
+
+	// Serve returns ErrServerClosed once Shutdown or Close is called
+	if serveErr := <-serveErr; !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+	if err == nil {
+		log.Println("Shutdown complete")
+	}
+	return err
+}
+
+// trackInFlight counts requests currently being handled.
+func (s *server) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
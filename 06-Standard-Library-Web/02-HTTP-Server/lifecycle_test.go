@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestServer runs s.run on an ephemeral port with handler and returns
+// the base URL, a cancel func that triggers shutdown, and run's result.
+func startTestServer(t *testing.T, s *server, handler http.Handler, cfg lifecycleConfig) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{Handler: s.trackInFlight(handler)}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(ctx, srv, ln, cfg)
+	}()
+	t.Cleanup(cancel)
+
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+// waitFor polls cond until it is true or the test times out.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunServesRequests(t *testing.T) {
+	s, _ := newTestServer()
+	url, cancel, done := startTestServer(t, s, s.routes(), lifecycleConfig{DrainTimeout: time.Second})
+
+	waitFor(t, s.ready.Load)
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected /readyz 200, got %d", resp.StatusCode)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if s.ready.Load() {
+		t.Error("Expected server to be not ready after shutdown")
+	}
+}
+
+func TestShutdownCompletesInFlightRequests(t *testing.T) {
+	s, _ := newTestServer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "finished")
+	})
+
+	url, cancel, done := startTestServer(t, s, slow, lifecycleConfig{DrainTimeout: 5 * time.Second})
+	waitFor(t, s.ready.Load)
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		got <- result{string(b), err}
+	}()
+
+	<-started
+	if n := s.inFlight.Load(); n != 1 {
+		t.Errorf("Expected 1 request in flight, got %d", n)
+	}
+
+	// Trigger shutdown while the request is still running
+	cancel()
+	waitFor(t, func() bool { return !s.ready.Load() })
+
+	select {
+	case err := <-done:
+		t.Fatalf("run returned before in-flight request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	r := <-got
+	if r.err != nil || r.body != "finished" {
+		t.Errorf("In-flight request did not complete: body=%q err=%v", r.body, r.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if n := s.inFlight.Load(); n != 0 {
+		t.Errorf("Expected 0 requests in flight, got %d", n)
+	}
+}
+
+func TestShutdownDrainDeadline(t *testing.T) {
+	s, _ := newTestServer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	stuck := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	url, cancel, done := startTestServer(t, s, stuck, lifecycleConfig{DrainTimeout: 50 * time.Millisecond})
+	waitFor(t, s.ready.Load)
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestReadinessDelayKeepsServing(t *testing.T) {
+	s, _ := newTestServer()
+	cfg := lifecycleConfig{DrainTimeout: time.Second, ReadinessDelay: 300 * time.Millisecond}
+	url, cancel, done := startTestServer(t, s, s.routes(), cfg)
+	waitFor(t, s.ready.Load)
+
+	cancel()
+	waitFor(t, func() bool { return !s.ready.Load() })
+
+	// Still accepting connections, but reporting not ready
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatalf("Expected server to keep serving during readiness delay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 while draining, got %d", resp.StatusCode)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+func TestLifecycleConfigFromEnv(t *testing.T) {
+	t.Setenv("SHUTDOWN_TIMEOUT", "30s")
+	t.Setenv("READINESS_DELAY", "2s")
+
+	cfg, err := lifecycleConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DrainTimeout != 30*time.Second || cfg.ReadinessDelay != 2*time.Second {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	t.Setenv("SHUTDOWN_TIMEOUT", "soon")
+	if _, err := lifecycleConfigFromEnv(); err == nil {
+		t.Error("Expected error for invalid duration")
+	}
+}
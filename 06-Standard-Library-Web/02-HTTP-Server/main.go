@@ -1,168 +1,817 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/health"
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/metrics"
 )
 
 // This program demonstrates HTTP server in Go
 
 // User struct for API
 type User struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
+	// ID is assigned by the store; an id in a request body is ignored.
+	ID    int    `json:"id" xml:"id" readonly:"true"`
+	Name  string `json:"name" xml:"name"`
+	Email string `json:"email" xml:"email"`
+	// Version is bumped by the store on every update. Clients see it
+	// only through the ETag header.
+	Version int `json:"-" xml:"-"`
+}
+
+// userPatch holds the fields a PATCH request may change.
+// Nil fields are left untouched.
+type userPatch struct {
+	Name  *string `json:"name" xml:"name"`
+	Email *string `json:"email" xml:"email"`
 }
 
-// In-memory user store
-var users = []User{
+// createParams are the parameters of POST /users.
+type createParams struct {
+	IdempotencyKey string `header:"Idempotency-Key" doc:"Unique key for this create; a retry with the same key and body gets the first response"`
+}
+
+// getUserParams are the parameters of GET /users/{id}.
+type getUserParams struct {
+	ID          int    `path:"id" doc:"User ID"`
+	IfNoneMatch string `header:"If-None-Match" doc:"ETag of a cached copy; 304 if it is still current"`
+}
+
+// writeUserParams are the parameters of PUT, PATCH and DELETE /users/{id}.
+type writeUserParams struct {
+	ID      int    `path:"id" doc:"User ID"`
+	IfMatch string `header:"If-Match" required:"true" doc:"ETag from a previous response, or * for any version"`
+}
+
+// seedUsers is the initial data for the in-memory store
+var seedUsers = []User{
 	{ID: 1, Name: "Alice", Email: "alice@example.com"},
 	{ID: 2, Name: "Bob", Email: "bob@example.com"},
 }
 
-var nextID = 3
+// server holds the dependencies shared by the handlers.
+// Handlers are methods so they reach the store through s, not globals.
+type server struct {
+	store       UserStore
+	auth        *tokenAuth
+	credentials *credentialStore
+	limiter     *rateLimiter
+	idempotency *idempotencyStore
+	logger      *slog.Logger
+	events      *eventBroker
+	hub         *hub
+	health      *health.Checker
+	cors        corsConfig
+	metrics     *metrics.Registry
+	httpMetrics *metrics.HTTPMetrics
+
+	mtls         bool          // protected routes require a client certificate
+	sseHeartbeat time.Duration // idle interval between SSE heartbeat comments
+	ready        atomic.Bool   // false while starting up and draining
+	inFlight     atomic.Int64  // requests currently being handled
+	panics       atomic.Int64  // handler panics recovered since startup
+}
+
+// newServer injects the user store and authentication into the handlers.
+// Writes through s.store publish change events for GET /users/events.
+func newServer(store UserStore, auth *tokenAuth, credentials *credentialStore) *server {
+	reg := metrics.NewRegistry()
+	metrics.RegisterRuntime(reg)
+	events := newEventBroker(eventLogSize, eventBuffer)
+
+	s := &server{
+		store:       publishingStore{UserStore: store, events: events},
+		auth:        auth,
+		credentials: credentials,
+		limiter:     newRateLimiter(10 * time.Minute),
+		idempotency: newIdempotencyStore(defaultIdempotencyTTL),
+		logger:      slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+		events:      events,
+		hub:         newHub(),
+		health:      health.NewChecker(),
+		cors:        defaultCORS(),
+		metrics:     reg,
+		httpMetrics: metrics.NewHTTPMetrics(reg),
+
+		sseHeartbeat: sseHeartbeat,
+	}
+	reg.NewCounterFunc("http_panics_total", "Handler panics recovered by the server.",
+		func() float64 { return float64(s.panics.Load()) })
+	reg.NewGaugeFunc("sse_subscribers", "Open GET /users/events streams.",
+		func() float64 { n, _ := events.Stats(); return float64(n) })
+	reg.NewCounterFunc("sse_slow_consumers_total", "Event streams dropped for falling behind.",
+		func() float64 { _, n := events.Stats(); return float64(n) })
+	reg.NewGaugeFunc("websocket_clients", "Connected WebSocket clients across all rooms.",
+		func() float64 { return float64(s.hub.clients.Load()) })
+	reg.NewCounterFunc("websocket_slow_consumers_total", "WebSocket clients dropped for falling behind.",
+		func() float64 { return float64(s.hub.dropped.Load()) })
+	s.registerHealthChecks(store)
+	return s
+}
 
 func main() {
 	fmt.Println("=== HTTP Server ===")
 	fmt.Println()
 	fmt.Println("Starting server on :8080")
 	fmt.Println("Endpoints:")
-	fmt.Println("  GET  /users     - Get all users")
-	fmt.Println("  GET  /users/:id - Get user by ID")
-	fmt.Println("  POST /users     - Create user")
-	fmt.Println("  GET  /health    - Health check")
+	fmt.Println("  GET    /users      - List users (?limit ?offset ?cursor ?name ?email ?sort)")
+	fmt.Println("  POST   /users      - Create user")
+	fmt.Println("  POST   /users:import - Import users from NDJSON (role: admin, ?atomic)")
+	fmt.Println("  GET    /users:export - Export every user as NDJSON")
+	fmt.Println("  GET    /users/events - Stream user changes (Server-Sent Events)")
+	fmt.Println("  GET    /users/{id} - Get user by ID")
+	fmt.Println("  PUT    /users/{id} - Replace user")
+	fmt.Println("  PATCH  /users/{id} - Update user fields")
+	fmt.Println("  DELETE /users/{id} - Delete user (role: admin)")
+	fmt.Println("  POST   /login      - Get a bearer token")
+	fmt.Println("  GET    /protected  - Requires a bearer token")
+	fmt.Println("  GET    /ws/rooms/{room} - Join a WebSocket broadcast room")
+	fmt.Println("  GET    /livez      - Liveness (?verbose for every check)")
+	fmt.Println("  GET    /health     - Same as /livez")
+	fmt.Println("  GET    /readyz     - Readiness: draining, database, disk (?verbose)")
+	fmt.Println("  GET    /metrics    - Prometheus metrics")
+	fmt.Println("  GET    /openapi.json - OpenAPI 3.1 description of these routes")
 	fmt.Println()
 
-	// 1. Basic route handler
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Welcome to Go HTTP Server!")
-	})
-
-	// 2. GET /users - Get all users
-	http.HandleFunc("/users", handleUsers)
-
-	// 3. GET /users/:id - Get user by ID
-	http.HandleFunc("/users/", handleUserByID)
-
-	// 4. POST /users - Create user
-	http.HandleFunc("/users/create", handleCreateUser)
-
-	// 5. Health check
-	http.HandleFunc("/health", handleHealth)
+	// 1-6. Pick a store and register routes on a dedicated mux.
+	// Set USERS_DB=users.db to use SQLite instead of memory.
+	store, closeStore, err := openStore(context.Background(), os.Getenv("USERS_DB"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStore()
 
-	// 6. Custom middleware example
-	http.HandleFunc("/protected", loggingMiddleware(authMiddleware(handleProtected)))
+	auth, err := authFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := newServer(store, auth, demoCredentials())
+	if dbPath := os.Getenv("USERS_DB"); dbPath != "" {
+		s.addDiskCheck(dbPath)
+	}
+	// CORS_ORIGINS=https://app.example.com,https://*.example.com
+	s.cors = corsFromEnv()
+	// IDEMPOTENCY_TTL=1h shortens how long Idempotency-Keys are remembered
+	idempotencyTTL := defaultIdempotencyTTL
+	if err := durationFromEnv("IDEMPOTENCY_TTL", &idempotencyTTL); err != nil {
+		log.Fatal(err)
+	}
+	s.idempotency = newIdempotencyStore(idempotencyTTL)
 
-	// 7. Start server
+	// 7. Configure server
 	server := &http.Server{
 		Addr:         ":8080",
+		Handler:      s.handler(),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	fmt.Println("Server started. Visit http://localhost:8080")
+	// 8. Shutdown on Ctrl+C (SIGINT) or SIGTERM (docker stop, Kubernetes)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s.limiter.startCleanup(ctx, time.Minute)
+	s.idempotency.startCleanup(ctx, time.Minute)
+
+	cfg, err := lifecycleConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 9. Optional HTTPS with HTTP/2. TLS=on uses a generated localhost
+	// certificate; TLS_CERT_FILE/TLS_KEY_FILE use your own.
+	tlsCfg, err := tlsSettingsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheme := "http"
+	if tlsCfg.Enabled {
+		if err := s.setupTLS(ctx, server, tlsCfg); err != nil {
+			log.Fatal(err)
+		}
+		scheme = "https"
+	}
+
+	// 10. Start server
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Server started. Visit %s://localhost%s\n", scheme, server.Addr)
 	fmt.Println("Press Ctrl+C to stop")
-	
-	// Uncomment to start server:
-	// log.Fatal(server.ListenAndServe())
-	
-	// For demonstration, we'll just show the setup
-	fmt.Println("\n(Server not started - uncomment ListenAndServe to run)")
+
+	if err := s.run(ctx, server, ln, cfg); err != nil {
+		log.Printf("Server stopped with error: %v", err)
+	}
+}
+
+// openStore returns a SQLite store when dbPath is set, otherwise a seeded
+// in-memory store. The returned func releases the store's resources.
+func openStore(ctx context.Context, dbPath string) (UserStore, func() error, error) {
+	if dbPath == "" {
+		fmt.Println("Using in-memory user store")
+		return NewMemoryUserStore(seedUsers...), func() error { return nil }, nil
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := NewSQLUserStore(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	fmt.Printf("Using SQLite user store: %s\n", dbPath)
+	return store, db.Close, nil
+}
+
+// demoCredentials creates the accounts listed in the README.
+// Real services load password hashes from storage, never plain text.
+func demoCredentials() *credentialStore {
+	creds := newCredentialStore()
+	for _, demo := range []struct{ user, password, role string }{
+		{"alice", "alice-password", "user"},
+		{"admin", "admin-password", "admin"},
+	} {
+		hash, err := hashPassword(demo.password, defaultPasswordIterations)
+		if err != nil {
+			log.Fatal(err)
+		}
+		creds.Add(demo.user, hash, demo.role)
+	}
+	fmt.Println("Demo logins: alice/alice-password (user), admin/admin-password (admin)")
+	return creds
+}
+
+// handler wraps the routes in the global middleware stack that every
+// request passes through. Recovery sits inside logging so a recovered
+// panic is logged with its 500 status, and inside CORS so the browser can
+// read that 500. Compression is innermost, so a panic discards its buffer.
+func (s *server) handler() http.Handler {
+	global := NewChain(
+		requestIDMiddleware,
+		s.trackInFlight,
+		loggingMiddleware(s.logger),
+		corsMiddleware(s.cors),
+		s.recoverMiddleware,
+		compressMiddleware(compressMinSize),
+	)
+	return global.Then(s.routes())
+}
+
+// routes registers every route in routeTable using method and path
+// patterns (Go 1.22+), plus GET /openapi.json describing them all.
+// Requests with a known path but an unregistered method get a 405 with an
+// Allow header from the mux itself; muxErrors turns it into problem+json.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	// The document describes its own route too, so it is built from the
+	// full table and only read once serving starts
+	var spec []byte
+	table := append(s.routeTable(), route{
+		Method:    "GET",
+		Path:      "/openapi.json",
+		Summary:   "This OpenAPI document",
+		Responses: map[int]any{200: map[string]any{}},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(spec)
+		}),
+	})
+	spec = marshalOpenAPI(table)
+
+	// Instrumenting per route labels metrics with the pattern, not the
+	// raw path, so /users/1 and /users/2 share one series
+	for _, rt := range table {
+		mux.Handle(rt.pattern(), s.httpMetrics.Instrument(rt.Path, rt.Handler))
+	}
+	return muxErrors(mux)
+}
+
+// routeTable lists every endpoint with its handler and contract. The
+// contract (params, bodies, statuses) feeds the OpenAPI document, so
+// change it together with the handler; TestOpenAPIGolden catches a
+// forgotten update.
+func (s *server) routeTable() []route {
+	// Per-route middleware stacks. Users routes share one rate limit per
+	// client; authMiddleware runs first on admin routes so the limiter
+	// can key on the principal. Protected routes also need a client
+	// certificate when mutual TLS is on.
+	users := NewChain(s.limiter.limit("users", usersRateLimit))
+	protected := NewChain(s.requireClientCert, s.authMiddleware)
+	admin := protected.
+		Append(s.limiter.limit("users", usersRateLimit), requireRole("admin"))
+
+	return []route{
+		// 1. Basic route handler ({$} matches "/" exactly, not every path)
+		{
+			Method:    "GET",
+			Path:      "/{$}",
+			Summary:   "Welcome message",
+			Produces:  []string{"text/plain"},
+			Responses: map[int]any{200: ""},
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "Welcome to Go HTTP Server!")
+			}),
+		},
+
+		// 2. Collection routes
+		{
+			Method:    "GET",
+			Path:      "/users",
+			Summary:   "List users with paging, filtering and sorting",
+			Params:    listParams{},
+			Produces:  userMediaTypes,
+			Responses: map[int]any{200: []User{}, 400: problem{}, 406: problem{}, 429: problem{}},
+			Handler:   users.ThenFunc(s.handleUsers),
+		},
+		{
+			Method:   "POST",
+			Path:     "/users",
+			Summary:  "Create a user, or several from a CSV file",
+			Params:   createParams{},
+			Request:  User{},
+			Consumes: []string{mediaJSON, mediaXML, mediaCSV},
+			Produces: userMediaTypes,
+			Responses: map[int]any{
+				201: User{}, 400: problem{}, 406: problem{}, 409: problem{},
+				413: problem{}, 415: problem{}, 422: problem{}, 429: problem{},
+			},
+			Handler: users.Append(s.idempotency.idempotent).ThenFunc(s.handleCreateUser),
+		},
+
+		// Bulk import and export, one user per NDJSON line
+		{
+			Method:   "POST",
+			Path:     "/users:import",
+			Summary:  "Import users from NDJSON in batches (role: admin)",
+			Params:   importParams{},
+			Request:  User{},
+			Consumes: []string{mediaNDJSON},
+			Auth:     true,
+			Responses: map[int]any{
+				200: importReport{}, 400: problem{}, 401: problem{}, 403: problem{}, 409: problem{},
+				413: problem{}, 415: problem{}, 422: problem{}, 429: problem{},
+			},
+			Handler: admin.ThenFunc(s.handleImportUsers),
+		},
+		{
+			Method:    "GET",
+			Path:      "/users:export",
+			Summary:   "Stream every user as NDJSON",
+			Produces:  []string{mediaNDJSON},
+			Responses: map[int]any{200: User{}, 429: problem{}},
+			Handler:   users.ThenFunc(s.handleExportUsers),
+		},
+
+		// Change stream; more specific than /users/{id}, so it wins
+		{
+			Method:    "GET",
+			Path:      "/users/events",
+			Summary:   "Stream user changes as Server-Sent Events",
+			Params:    eventsParams{},
+			Produces:  []string{mediaEventStream},
+			Responses: map[int]any{200: "", 406: problem{}, 429: problem{}, 503: problem{}},
+			Handler:   users.ThenFunc(s.handleUserEvents),
+		},
+
+		// 3. Item routes - {id} is read with r.PathValue("id")
+		{
+			Method:    "GET",
+			Path:      "/users/{id}",
+			Summary:   "Get a user",
+			Params:    getUserParams{},
+			Produces:  userMediaTypes,
+			Responses: map[int]any{200: User{}, 304: nil, 400: problem{}, 404: problem{}, 406: problem{}, 429: problem{}},
+			Handler:   users.ThenFunc(s.handleUserByID),
+		},
+		{
+			Method:   "PUT",
+			Path:     "/users/{id}",
+			Summary:  "Replace a user",
+			Params:   writeUserParams{},
+			Request:  User{},
+			Consumes: []string{mediaJSON, mediaXML},
+			Produces: userMediaTypes,
+			Responses: map[int]any{
+				200: User{}, 400: problem{}, 404: problem{}, 406: problem{}, 409: problem{},
+				412: problem{}, 413: problem{}, 415: problem{}, 422: problem{}, 428: problem{}, 429: problem{},
+			},
+			Handler: users.ThenFunc(s.handleReplaceUser),
+		},
+		{
+			Method:   "PATCH",
+			Path:     "/users/{id}",
+			Summary:  "Update some fields of a user",
+			Params:   writeUserParams{},
+			Request:  userPatch{},
+			Consumes: []string{mediaJSON, mediaXML},
+			Produces: userMediaTypes,
+			Responses: map[int]any{
+				200: User{}, 400: problem{}, 404: problem{}, 406: problem{}, 409: problem{},
+				412: problem{}, 413: problem{}, 415: problem{}, 422: problem{}, 428: problem{}, 429: problem{},
+			},
+			Handler: users.ThenFunc(s.handlePatchUser),
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/users/{id}",
+			Summary: "Delete a user (role: admin)",
+			Params:  writeUserParams{},
+			Auth:    true,
+			Responses: map[int]any{
+				204: nil, 400: problem{}, 401: problem{}, 403: problem{}, 404: problem{},
+				412: problem{}, 428: problem{}, 429: problem{},
+			},
+			Handler: admin.ThenFunc(s.handleDeleteUser),
+		},
+
+		// 4. Health and readiness checks
+		{
+			Method:    "GET",
+			Path:      "/livez",
+			Summary:   "Liveness: 503 if the process should be restarted",
+			Params:    healthParams{},
+			Responses: map[int]any{200: health.Report{}, 503: health.Report{}},
+			Handler:   s.health.LiveHandler(),
+		},
+		{
+			Method:    "GET",
+			Path:      "/health",
+			Summary:   "Liveness (same as /livez)",
+			Params:    healthParams{},
+			Responses: map[int]any{200: health.Report{}, 503: health.Report{}},
+			Handler:   s.health.LiveHandler(),
+		},
+		{
+			Method:    "GET",
+			Path:      "/metrics",
+			Summary:   "Prometheus metrics in the text exposition format",
+			Produces:  []string{"text/plain"},
+			Responses: map[int]any{200: ""},
+			Handler:   s.metrics.Handler(),
+		},
+		{
+			Method:    "GET",
+			Path:      "/readyz",
+			Summary:   "Readiness: 503 while draining or when a dependency fails",
+			Params:    healthParams{},
+			Responses: map[int]any{200: health.Report{}, 503: health.Report{}},
+			Handler:   s.health.ReadyHandler(),
+		},
+
+		// 5. Authentication and a custom middleware example
+		{
+			Method:    "POST",
+			Path:      "/login",
+			Summary:   "Exchange a username and password for a bearer token",
+			Request:   loginRequest{},
+			Responses: map[int]any{200: loginResponse{}, 400: problem{}, 401: problem{}, 413: problem{}, 429: problem{}},
+			Handler:   NewChain(s.limiter.limit("login", loginRateLimit)).ThenFunc(s.handleLogin),
+		},
+		{
+			Method:    "GET",
+			Path:      "/ws/rooms/{room}",
+			Summary:   "Upgrade to a WebSocket and join a broadcast room",
+			Params:    wsParams{},
+			Responses: map[int]any{101: nil, 400: problem{}, 403: problem{}, 426: problem{}, 429: problem{}},
+			Handler:   NewChain(s.limiter.limit("rooms", usersRateLimit)).ThenFunc(s.handleRoom),
+		},
+		{
+			Method:    "GET",
+			Path:      "/protected",
+			Summary:   "Show the caller's token subject and roles",
+			Auth:      true,
+			Responses: map[int]any{200: map[string]any{}, 401: problem{}},
+			Handler:   protected.ThenFunc(handleProtected),
+		},
+	}
 }
 
 // Handle GET /users
-func handleUsers(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// Supports ?limit, ?offset, ?cursor, ?name, ?email and ?sort (see listQuery).
+// The response format follows the Accept header (see negotiateUsers).
+func (s *server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateUsers(w, r)
+	if !ok {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	q, errs := parseListQuery(r.URL.Query())
+	if errs != nil {
+		writeValidationErrors(w, http.StatusBadRequest, "invalid query parameters", errs)
+		return
+	}
+
+	users, err := s.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	p := q.apply(users)
+	setPageHeaders(w, r, q, p)
+	writeUsers(w, mediaType, http.StatusOK, p.Users)
 }
 
-// Handle GET /users/:id
-func handleUserByID(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// Handle GET /users/{id}
+func (s *server) handleUserByID(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+	id, ok := userID(w, r)
+	if !ok {
 		return
 	}
 
-	// Simple ID extraction (in production, use a router)
-	id := 1 // Simplified for example
-	for _, user := range users {
-		if user.ID == id {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(user)
+	user, err := s.store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	tag := etagFor(user, mediaType)
+	w.Header().Set("ETag", tag)
+	if notModified(w, r, tag) {
+		return
+	}
+	writeUser(w, mediaType, http.StatusOK, user)
+}
+
+// Handle POST /users
+// Accepts a JSON or XML user, or a CSV file to create several at once.
+func (s *server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+	bodyType, ok := requestMediaType(w, r, mediaJSON, mediaXML, mediaCSV)
+	if !ok {
+		return
+	}
+	if bodyType == mediaCSV {
+		s.createUsersCSV(w, r, mediaType)
+		return
+	}
+
+	var user User
+	if !decodeAs(w, r, bodyType, &user) {
+		return
+	}
+	if err := validateUser(user); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	user, err := s.store.Create(r.Context(), user)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/users/%d", user.ID))
+	w.Header().Set("ETag", etagFor(user, mediaType))
+	writeUser(w, mediaType, http.StatusCreated, user)
+}
+
+// createUsersCSV handles a CSV POST /users. Every row is validated before
+// anything is written, and emails already in the store are reported up
+// front, so a bad file normally creates nobody. Only a user created by
+// another request in the meantime can stop the import halfway; the 409
+// then says how many rows went in.
+func (s *server) createUsersCSV(w http.ResponseWriter, r *http.Request, mediaType string) {
+	rows, err := readUsersCSV(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	var (
+		maxBytesErr *http.MaxBytesError
+		errs        ValidationErrors
+	)
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body must not exceed %d bytes", maxBytesErr.Limit))
+		return
+	case errors.As(err, &errs):
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "the CSV has invalid rows", errs)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, "malformed CSV: "+err.Error())
+		return
+	}
+
+	existing, err := s.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	taken := make(map[string]bool, len(existing))
+	for _, u := range existing {
+		taken[u.Email] = true
+	}
+	for _, row := range rows {
+		if taken[row.User.Email] {
+			errs = append(errs, ValidationError{fmt.Sprintf("line %d: email", row.Line), ErrEmailTaken.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, http.StatusConflict, "some emails are already in use", errs)
+		return
+	}
+
+	created := make([]User, 0, len(rows))
+	for _, row := range rows {
+		user, err := s.store.Create(r.Context(), row.User)
+		if errors.Is(err, ErrEmailTaken) {
+			writeError(w, http.StatusConflict,
+				fmt.Sprintf("line %d: %v; the %d user(s) before it were created", row.Line, err, len(created)))
 			return
 		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		created = append(created, user)
 	}
 
-	http.Error(w, "User not found", http.StatusNotFound)
+	writeUsers(w, mediaType, http.StatusCreated, created)
 }
 
-// Handle POST /users/create
-func handleCreateUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// Handle PUT /users/{id}
+func (s *server) handleReplaceUser(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+	id, ok := userID(w, r)
+	if !ok {
 		return
 	}
 
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeBody(w, r, &user) {
+		return
+	}
+	if err := validateUser(user); err != nil {
+		writeInvalid(w, err)
 		return
 	}
 
-	user.ID = nextID
-	nextID++
-	users = append(users, user)
+	current, err := s.store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !checkIfMatch(w, r, current, mediaType) {
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	// The path is authoritative; any ID in the body is ignored
+	user.ID = id
+	user.Version = current.Version
+	user, err = s.store.Update(r.Context(), user)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etagFor(user, mediaType))
+	writeUser(w, mediaType, http.StatusOK, user)
 }
 
-// Handle GET /health
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "healthy",
-		"time":   time.Now().Format(time.RFC3339),
-	})
+// Handle PATCH /users/{id}
+func (s *server) handlePatchUser(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+
+	var patch userPatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+	if err := patch.validate(); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	user, err := s.store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !checkIfMatch(w, r, user, mediaType) {
+		return
+	}
+
+	if patch.Name != nil {
+		user.Name = *patch.Name
+	}
+	if patch.Email != nil {
+		user.Email = *patch.Email
+	}
+
+	user, err = s.store.Update(r.Context(), user)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etagFor(user, mediaType))
+	writeUser(w, mediaType, http.StatusOK, user)
+}
+
+// Handle DELETE /users/{id}
+func (s *server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := s.store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !checkIfMatch(w, r, user, mediaJSON) {
+		return
+	}
+
+	if err := s.store.Delete(r.Context(), id, user.Version); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Handle protected route
 func handleProtected(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	principal, _ := principalFrom(r.Context())
+	body := map[string]any{
 		"message": "This is a protected route",
-	})
+		"user":    principal.Subject,
+		"roles":   principal.Roles,
+	}
+	if client := clientCertSubject(r); client != "" {
+		body["client_certificate"] = client
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
 }
 
-// Middleware: Logging
-func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("%s %s", r.Method, r.URL.Path)
-		next(w, r)
-		log.Printf("Completed in %v", time.Since(start))
+// userID parses the {id} path value. On failure it writes a 400 and
+// returns false, so handlers can simply return.
+func userID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user ID")
+		return 0, false
 	}
+	return id, true
 }
 
-// Middleware: Authentication (simplified)
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
-	}
+// writeJSON sends v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
+// writeStoreError maps UserStore errors to HTTP status codes.
+// Unexpected errors are logged and hidden from the client.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrEmailTaken):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrVersionConflict):
+		// Another request won the race between our If-Match check
+		// and the write.
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	default:
+		log.Printf("store error: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal server error")
+	}
+}
@@ -1,17 +1,113 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/codinsec/go-learning-lab/06-standard-library-web/http-server/metrics"
 )
 
-func TestHandleUsers(t *testing.T) {
-	req := httptest.NewRequest("GET", "/users", nil)
+// newTestServer returns a server backed by a fresh seeded memory store,
+// so tests don't depend on each other.
+func newTestServer() (*server, *MemoryUserStore) {
+	store := NewMemoryUserStore(seedUsers...)
+	return newQuietServer(store), store
+}
+
+// newQuietServer discards access logs so test output stays readable.
+func newQuietServer(store UserStore) *server {
+	s := newServer(store, newTestAuth(), newTestCredentials())
+	s.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return s
+}
+
+// newTestAuth uses a fixed secret so tokens are reproducible.
+func newTestAuth() *tokenAuth {
+	return newTokenAuth([]byte("0123456789abcdef0123456789abcdef"), "test-issuer", "test-audience", time.Hour)
+}
+
+// newTestCredentials uses a low PBKDF2 cost to keep tests fast.
+func newTestCredentials() *credentialStore {
+	creds := newCredentialStore()
+	for user, role := range map[string]string{"alice": "user", "admin": "admin"} {
+		hash, _ := hashPassword(user+"-password", 1000)
+		creds.Add(user, hash, role)
+	}
+	return creds
+}
+
+// bearer returns an Authorization header value for a principal with roles.
+func bearer(t *testing.T, s *server, roles ...string) string {
+	t.Helper()
+	token, _, err := s.auth.Issue(Principal{Subject: "tester", Roles: roles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+// serve sends a request through the global middleware and router and
+// returns the recorder.
+func serve(s *server, method, target, body string) *httptest.ResponseRecorder {
+	return serveAs(s, "", method, target, body)
+}
+
+// serveAs is serve with an Authorization header.
+func serveAs(s *server, authorization, method, target, body string) *httptest.ResponseRecorder {
+	header := http.Header{}
+	if authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+	return serveWith(s, header, method, target, body)
+}
+
+// serveWith is serve with extra request headers.
+func serveWith(s *server, header http.Header, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
 	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, req)
+	return w
+}
 
-	handleUsers(w, req)
+// mustGet fetches a user straight from the store.
+func mustGet(t *testing.T, store UserStore, id int) User {
+	t.Helper()
+	user, err := store.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Get(%d): %v", id, err)
+	}
+	return user
+}
+
+// ifMatch returns headers carrying the user's current ETag, plus an
+// optional Authorization header.
+func ifMatch(t *testing.T, store UserStore, id int, authorization string) http.Header {
+	t.Helper()
+	header := http.Header{}
+	header.Set("If-Match", etag(mustGet(t, store, id)))
+	if authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+	return header
+}
+
+func TestHandleUsers(t *testing.T) {
+	s, _ := newTestServer()
+	w := serve(s, "GET", "/users", "")
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
@@ -29,51 +125,230 @@ func TestHandleUsers(t *testing.T) {
 }
 
 func TestHandleCreateUser(t *testing.T) {
-	req := httptest.NewRequest("POST", "/users/create", 
-		httptest.NewRequest("POST", "/", nil).Body)
-	req.Header.Set("Content-Type", "application/json")
-	w := httptest.NewRecorder()
+	s, _ := newTestServer()
+	w := serve(s, "POST", "/users", `{"name":"Test User","email":"test@example.com"}`)
 
-	// Create JSON body
-	userJSON := `{"name":"Test User","email":"test@example.com"}`
-	req.Body = http.Request{}.Body // Simplified for test
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", w.Code)
+	}
+	if got := w.Header().Get("Location"); got != "/users/3" {
+		t.Errorf("Expected Location /users/3, got %q", got)
+	}
 
-	handleCreateUser(w, req)
+	var user User
+	if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if user.ID != 3 || user.Name != "Test User" {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+}
 
-	if w.Code != http.StatusCreated {
-		t.Errorf("Expected status 201, got %d", w.Code)
+func TestHandleUserByID(t *testing.T) {
+	s, _ := newTestServer()
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		want   string
+	}{
+		{"first user", "/users/1", http.StatusOK, "Alice"},
+		{"second user", "/users/2", http.StatusOK, "Bob"},
+		{"unknown user", "/users/42", http.StatusNotFound, ""},
+		{"invalid id", "/users/abc", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, "GET", tt.target, "")
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.want == "" {
+				decodeProblem(t, w)
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected JSON content type, got %q", ct)
+			}
+			var user User
+			if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if user.Name != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, user.Name)
+			}
+		})
 	}
 }
 
-func TestHandleHealth(t *testing.T) {
-	req := httptest.NewRequest("GET", "/health", nil)
-	w := httptest.NewRecorder()
+func TestHandleReplaceUser(t *testing.T) {
+	s, store := newTestServer()
+	w := serveWith(s, ifMatch(t, store, 1, ""), "PUT", "/users/1", `{"id":99,"name":"Alicia","email":"alicia@example.com"}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	got := mustGet(t, store, 1)
+	if got != (User{ID: 1, Name: "Alicia", Email: "alicia@example.com", Version: 2}) {
+		t.Errorf("User not replaced: %+v", got)
+	}
+	if w.Header().Get("ETag") != etag(got) {
+		t.Errorf("Expected ETag %s, got %s", etag(got), w.Header().Get("ETag"))
+	}
+
+	w = serve(s, "PUT", "/users/42", `{"name":"Nobody","email":"nobody@example.com"}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
 
-	handleHealth(w, req)
+func TestHandlePatchUser(t *testing.T) {
+	s, store := newTestServer()
+	w := serveWith(s, ifMatch(t, store, 2, ""), "PATCH", "/users/2", `{"email":"robert@example.com"}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if got := mustGet(t, store, 2); got.Name != "Bob" || got.Email != "robert@example.com" {
+		t.Errorf("Unexpected patch result: %+v", got)
+	}
+}
+
+func TestHandleDeleteUser(t *testing.T) {
+	s, store := newTestServer()
+	w := serveWith(s, ifMatch(t, store, 1, bearer(t, s, "admin")), "DELETE", "/users/1", "")
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+
+	w = serve(s, "GET", "/users/1", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected deleted user to be gone, got %d", w.Code)
+	}
+	if p := decodeProblem(t, w); p.Detail == "" {
+		t.Error("Expected detail in 404 body")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s, _ := newTestServer()
+	h := s.handler()
+	for _, target := range []string{"/users/1", "/users/2", "/users/42"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	s.panics.Add(1)
+
+	w := serve(s, "GET", "/metrics", "")
+	if got := w.Header().Get("Content-Type"); got != metrics.ContentType {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+	families, err := metrics.ParseText(w.Body)
+	if err != nil {
+		t.Fatalf("Invalid exposition format: %v", err)
+	}
+
+	// value finds a sample; histogram samples live in their base family
+	value := func(name string, labels map[string]string) float64 {
+		t.Helper()
+		f, ok := families[strings.TrimSuffix(name, "_bucket")]
+		if !ok {
+			t.Fatalf("Missing family %s", name)
+		}
+		for _, s := range f.Samples {
+			if s.Name == name && len(labels) == len(s.Labels) && fmt.Sprint(labels) == fmt.Sprint(s.Labels) {
+				return s.Value
+			}
+		}
+		t.Fatalf("No %s sample with labels %v", name, labels)
+		return 0
+	}
+
+	// Requests are labelled by route pattern, not by path
+	ok := map[string]string{"method": "GET", "route": "/users/{id}", "status": "200"}
+	if got := value("http_requests_total", ok); got != 2 {
+		t.Errorf("Expected 2 requests for /users/{id}, got %v", got)
+	}
+	notFound := map[string]string{"method": "GET", "route": "/users/{id}", "status": "404"}
+	if got := value("http_requests_total", notFound); got != 1 {
+		t.Errorf("Expected 1 not found, got %v", got)
+	}
+
+	buckets := families["http_request_duration_seconds"]
+	if buckets == nil || buckets.Type != "histogram" {
+		t.Fatalf("Expected latency histogram, got %+v", buckets)
+	}
+	infOK := map[string]string{"method": "GET", "route": "/users/{id}", "status": "200", "le": "+Inf"}
+	if got := value("http_request_duration_seconds_bucket", infOK); got != 2 {
+		t.Errorf("Expected +Inf bucket to hold every request, got %v", got)
+	}
+
+	// The scrape itself is in flight while the output is rendered
+	if got := value("http_requests_in_flight", map[string]string{"route": "/metrics"}); got != 1 {
+		t.Errorf("Expected the scrape to be in flight, got %v", got)
+	}
+	if got := value("http_panics_total", nil); got != 1 {
+		t.Errorf("Expected panic counter from server, got %v", got)
+	}
+	if got := value("go_goroutines", nil); got < 1 {
+		t.Errorf("Expected runtime stats, got go_goroutines %v", got)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	s, _ := newTestServer()
+	w := serve(s, "GET", "/health", "")
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 
-	var result map[string]string
+	var result map[string]any
 	err := json.NewDecoder(w.Body).Decode(&result)
 	if err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
-	if result["status"] != "healthy" {
-		t.Errorf("Expected status 'healthy', got %s", result["status"])
+	if result["status"] != "ok" {
+		t.Errorf("Expected status 'ok', got %s", result["status"])
 	}
 }
 
-func TestMethodNotAllowed(t *testing.T) {
-	req := httptest.NewRequest("POST", "/users", nil)
-	w := httptest.NewRecorder()
-
-	handleUsers(w, req)
+func TestCreateDuplicateEmail(t *testing.T) {
+	s, _ := newTestServer()
+	w := serve(s, "POST", "/users", `{"name":"Alice 2","email":"alice@example.com"}`)
 
-	if w.Code != http.StatusMethodNotAllowed {
-		t.Errorf("Expected status 405, got %d", w.Code)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", w.Code)
 	}
 }
 
+func TestMethodNotAllowed(t *testing.T) {
+	s, _ := newTestServer()
+	tests := []struct {
+		method string
+		target string
+		allow  []string
+	}{
+		{"DELETE", "/users", []string{"GET", "POST"}},
+		{"POST", "/users/1", []string{"GET", "PUT", "PATCH", "DELETE"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := serve(s, tt.method, tt.target, "")
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("Expected status 405, got %d", w.Code)
+			}
+			allow := w.Header().Get("Allow")
+			for _, m := range tt.allow {
+				if !strings.Contains(allow, m) {
+					t.Errorf("Allow header %q missing %s", allow, m)
+				}
+			}
+			decodeProblem(t, w)
+		})
+	}
+}
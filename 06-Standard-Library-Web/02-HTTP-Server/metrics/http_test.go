@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstrument(t *testing.T) {
+	reg := NewRegistry()
+	m := NewHTTPMetrics(reg)
+
+	var inFlight float64
+	h := m.Instrument("/users/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = m.inFlight.Value("/users/{id}")
+		if r.URL.Path == "/users/404" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/users/1", nil),
+		httptest.NewRequest("GET", "/users/2", nil),
+		httptest.NewRequest("GET", "/users/404", nil),
+		httptest.NewRequest("BREW", "/users/1", nil),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if inFlight != 1 {
+		t.Errorf("Expected in-flight gauge 1 during the request, got %v", inFlight)
+	}
+
+	families := scrape(t, reg)
+	requests := families["http_requests_total"]
+	ok := map[string]string{"method": "GET", "route": "/users/{id}", "status": "200"}
+	if got := find(t, requests, "http_requests_total", ok); got != 2 {
+		t.Errorf("Expected 2 requests by route pattern, got %v", got)
+	}
+	notFound := map[string]string{"method": "GET", "route": "/users/{id}", "status": "404"}
+	if got := find(t, requests, "http_requests_total", notFound); got != 1 {
+		t.Errorf("Expected 1 not found, got %v", got)
+	}
+	other := map[string]string{"method": "OTHER", "route": "/users/{id}", "status": "200"}
+	if got := find(t, requests, "http_requests_total", other); got != 1 {
+		t.Errorf("Expected unknown methods folded into OTHER, got %v", got)
+	}
+
+	duration := families["http_request_duration_seconds"]
+	if got := find(t, duration, "http_request_duration_seconds_count", ok); got != 2 {
+		t.Errorf("Expected 2 latency observations, got %v", got)
+	}
+	if got := find(t, families["http_requests_in_flight"], "http_requests_in_flight", map[string]string{"route": "/users/{id}"}); got != 0 {
+		t.Errorf("Expected in-flight back at 0, got %v", got)
+	}
+}
+
+func TestInstrumentPanic(t *testing.T) {
+	reg := NewRegistry()
+	m := NewHTTPMetrics(reg)
+	h := m.Instrument("/boom", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() { recover() }()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/boom", nil))
+	}()
+
+	if got := m.requests.Value("GET", "/boom", "500"); got != 1 {
+		t.Errorf("Expected panic counted as 500, got %v", got)
+	}
+	if got := m.inFlight.Value("/boom"); got != 0 {
+		t.Errorf("Expected in-flight released after panic, got %v", got)
+	}
+}
+
+func TestInstrumentPassesFlush(t *testing.T) {
+	m := NewHTTPMetrics(NewRegistry())
+	h := m.Instrument("/stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Expected wrapped writer to implement http.Flusher")
+		}
+		w.(http.Flusher).Flush()
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+	if !w.Flushed {
+		t.Error("Expected flush to reach the recorder")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("demo_total", "Demo.").Inc()
+
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := w.Header().Get("Content-Type"); got != ContentType {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+	if !strings.Contains(w.Body.String(), "demo_total 1\n") {
+		t.Errorf("Unexpected body:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,384 @@
+// Package metrics implements counters, gauges and histograms with labels
+// and renders them in the Prometheus text exposition format (version
+// 0.0.4), using only the standard library.
+//
+// Metrics are created on a Registry and live for the life of the program:
+//
+//	reg := metrics.NewRegistry()
+//	requests := reg.NewCounter("jobs_total", "Jobs processed.", "queue", "result")
+//	requests.Inc("emails", "ok")
+//	http.Handle("/metrics", reg.Handler())
+//
+// Label values are passed to every update in the order the label names
+// were declared. Registration mistakes (bad names, duplicates) and a wrong
+// number of label values are programming errors and panic.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets, in seconds. They suit
+// request latencies from a few milliseconds to ten seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Registry holds a set of metrics and renders them on demand.
+// It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	hooks    []func()
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// kind is the # TYPE of a metric family.
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// family is every series of one metric name.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64      // histograms only
+	fn      func() float64 // func metrics only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is one combination of label values.
+type series struct {
+	labelValues []string
+	value       float64  // counters and gauges
+	counts      []uint64 // histograms: observations per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+// Counter is a value that only goes up, such as requests served.
+type Counter struct{ f *family }
+
+// Gauge is a value that goes up and down, such as requests in flight.
+type Gauge struct{ f *family }
+
+// Histogram counts observations, such as latencies, in buckets.
+type Histogram struct{ f *family }
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, kind: counterKind, labels: labels})}
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, kind: gaugeKind, labels: labels})}
+}
+
+// NewHistogram registers a histogram. buckets are the upper bounds,
+// strictly increasing; nil means DefBuckets. A +Inf bucket is implied.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	for i := range buckets {
+		if i > 0 && buckets[i] <= buckets[i-1] {
+			panic(fmt.Sprintf("metrics: %s buckets must be strictly increasing", name))
+		}
+	}
+	for _, l := range labels {
+		if l == "le" {
+			panic(fmt.Sprintf("metrics: %s: label le is reserved for histogram buckets", name))
+		}
+	}
+	buckets = append([]float64(nil), buckets...)
+	return &Histogram{r.register(&family{name: name, help: help, kind: histogramKind, labels: labels, buckets: buckets})}
+}
+
+// NewCounterFunc registers a counter whose value is read from fn at
+// scrape time, for totals another package already keeps.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: counterKind, fn: fn})
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: gaugeKind, fn: fn})
+}
+
+// OnScrape registers fn to run before every scrape, under the registry's
+// lock. Use it to take one snapshot that several func metrics read.
+func (r *Registry) OnScrape(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+func (r *Registry) register(f *family) *family {
+	if !metricNameRE.MatchString(f.name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", f.name))
+	}
+	seen := map[string]bool{}
+	for _, l := range f.labels {
+		if !labelNameRE.MatchString(l) || strings.HasPrefix(l, "__") || seen[l] {
+			panic(fmt.Sprintf("metrics: %s: invalid or duplicate label name %q", f.name, l))
+		}
+		seen[l] = true
+	}
+	f.labels = append([]string(nil), f.labels...)
+	f.series = make(map[string]*series)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.families[f.name]; dup {
+		panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+	}
+	r.families[f.name] = f
+	return f
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.f.name))
+	}
+	c.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the counter's current value.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.f.value(labelValues)
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value = v })
+}
+
+// Add adds v, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Inc adds 1 to the gauge.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts 1 from the gauge.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value returns the gauge's current value.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.f.value(labelValues)
+}
+
+// Observe records one observation of v.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	// The first bucket whose upper bound is >= v; len(buckets) means +Inf only
+	i := sort.SearchFloat64s(h.f.buckets, v)
+	h.f.update(labelValues, func(s *series) {
+		if i < len(s.counts) {
+			s.counts[i]++
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// Count returns how many observations were recorded.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	var n uint64
+	h.f.read(labelValues, func(s *series) { n = s.count })
+	return n
+}
+
+// update applies fn to the series for labelValues, creating it on first use.
+func (f *family) update(labelValues []string, fn func(*series)) {
+	f.checkLabels(labelValues)
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == histogramKind {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// read calls fn with the series for labelValues if it exists.
+func (f *family) read(labelValues []string, fn func(*series)) {
+	f.checkLabels(labelValues)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[strings.Join(labelValues, "\xff")]; ok {
+		fn(s)
+	}
+}
+
+func (f *family) value(labelValues []string) float64 {
+	var v float64
+	f.read(labelValues, func(s *series) { v = s.value })
+	return v
+}
+
+func (f *family) checkLabels(labelValues []string) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values %v, got %d",
+			f.name, len(f.labels), f.labels, len(labelValues)))
+	}
+}
+
+// Write renders every metric in the text exposition format. Families are
+// sorted by name and series by label values, so output is stable.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, hook := range r.hooks {
+		hook()
+	}
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.families[name].write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry in the text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Render first so a failure can still become a 500
+		var buf bytes.Buffer
+		if err := r.Write(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+func (f *family) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	if f.fn != nil {
+		fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.fn()))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != histogramKind {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelString(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelString(s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelString(s.labelValues, ""), s.count)
+	}
+}
+
+// labelString renders {name="value",...}, adding le when it is set.
+func (f *family) labelString(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, escapeLabel(values[i]))
+	}
+	if le != "" {
+		if len(f.labels) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `le="%s"`, le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
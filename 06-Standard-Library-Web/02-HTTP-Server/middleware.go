@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour
+// (logging, auth, rate limiting, ...).
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered list of middleware. The first middleware is the
+// outermost, so it sees the request first and the response last.
+// Chains are immutable: Append returns a new Chain.
+type Chain struct {
+	middlewares []Middleware
+}
+
+// NewChain returns a chain that applies middlewares in order.
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain{middlewares: append([]Middleware(nil), middlewares...)}
+}
+
+// Append returns a new chain with middlewares added after c's.
+// c itself is left unchanged, so a shared base chain can be extended
+// per route without the routes affecting each other.
+func (c Chain) Append(middlewares ...Middleware) Chain {
+	combined := make([]Middleware, 0, len(c.middlewares)+len(middlewares))
+	combined = append(combined, c.middlewares...)
+	combined = append(combined, middlewares...)
+	return Chain{middlewares: combined}
+}
+
+// Then wraps h with every middleware in the chain.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// ThenFunc is Then for a handler function.
+func (c Chain) ThenFunc(fn http.HandlerFunc) http.Handler {
+	return c.Then(fn)
+}
+
+// statusWriter wraps an http.ResponseWriter and records the status code,
+// body size and time taken. It still exposes Flush and Hijack, so
+// streaming responses and connection upgrades keep working.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	start       time.Time
+	wroteHeader bool
+}
+
+// wrapWriter returns w as a *statusWriter, reusing it if an outer
+// middleware already wrapped it.
+func wrapWriter(w http.ResponseWriter) *statusWriter {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: w, start: time.Now()}
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// 1xx informational responses may precede the real status
+	if status >= 100 && status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.status = status
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher when the underlying writer does.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker when the underlying writer does.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && !w.wroteHeader {
+		// The connection now belongs to the handler (e.g. WebSocket)
+		w.status = http.StatusSwitchingProtocols
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the status code sent, or 200 if the handler never
+// wrote one (net/http sends 200 in that case).
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Bytes returns the number of body bytes written.
+func (w *statusWriter) Bytes() int64 {
+	return w.bytes
+}
+
+// Duration returns the time since the writer was wrapped.
+func (w *statusWriter) Duration() time.Duration {
+	return time.Since(w.start)
+}
+
+// WroteHeader reports whether a final status has been sent.
+func (w *statusWriter) WroteHeader() bool {
+	return w.wroteHeader
+}
+
+// Middleware: Logging
+// Writes one structured access log line per request via slog, at Info for
+// success, Warn for 4xx and Error for 5xx.
+func loggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := wrapWriter(w)
+			next.ServeHTTP(sw, r)
+
+			level := slog.LevelInfo
+			switch {
+			case sw.Status() >= 500:
+				level = slog.LevelError
+			case sw.Status() >= 400:
+				level = slog.LevelWarn
+			}
+
+			logger.LogAttrs(r.Context(), level, "request",
+				slog.String("request_id", requestIDFrom(r.Context())),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", sw.Status()),
+				slog.Int64("bytes", sw.Bytes()),
+				slog.Duration("duration", sw.Duration()),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		})
+	}
+}
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key for the request ID.
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID set by requestIDMiddleware, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Middleware: Request ID
+// Reuses a well-formed X-Request-ID from the client (so IDs can follow a
+// request across services) or generates one, then echoes it in the
+// response and stores it in the context for logging.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts short IDs made of safe characters, so client
+// input can't inject anything into logs or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
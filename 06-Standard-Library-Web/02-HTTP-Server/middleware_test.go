@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tag returns middleware that records its name before and after next.
+func tag(name string, trace *[]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*trace = append(*trace, name+">")
+			next.ServeHTTP(w, r)
+			*trace = append(*trace, "<"+name)
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var trace []string
+	handler := NewChain(tag("a", &trace), tag("b", &trace)).
+		Append(tag("c", &trace)).
+		ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+			trace = append(trace, "handler")
+		})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	want := "a> b> c> handler <c <b <a"
+	if got := strings.Join(trace, " "); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestChainAppendDoesNotShare(t *testing.T) {
+	var trace []string
+	base := NewChain(tag("base", &trace))
+	one := base.Append(tag("one", &trace))
+	two := base.Append(tag("two", &trace))
+
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	req := httptest.NewRequest("GET", "/", nil)
+
+	one.Then(noop).ServeHTTP(httptest.NewRecorder(), req)
+	two.Then(noop).ServeHTTP(httptest.NewRecorder(), req)
+	base.Then(noop).ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "base> one> <one <base base> two> <two <base base> <base"
+	if got := strings.Join(trace, " "); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		bytes   int64
+	}{
+		{"implicit 200", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}, 200, 5},
+		{"no body", func(w http.ResponseWriter, r *http.Request) {}, 200, 0},
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			io.WriteString(w, "short and stout")
+		}, 418, 15},
+		{"second WriteHeader ignored", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, 201, 0},
+		{"informational first", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusAccepted)
+		}, 202, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			sw := wrapWriter(rec)
+			tt.handler(sw, httptest.NewRequest("GET", "/", nil))
+
+			if sw.Status() != tt.status || sw.Bytes() != tt.bytes {
+				t.Errorf("Expected %d/%d bytes, got %d/%d", tt.status, tt.bytes, sw.Status(), sw.Bytes())
+			}
+			// httptest.ResponseRecorder keeps the first status, even a 1xx
+			if rec.Code != tt.status && rec.Code >= 200 {
+				t.Errorf("Underlying writer got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	if wrapWriter(wrapWriter(rec)).ResponseWriter != rec {
+		t.Error("Expected wrapWriter to reuse an existing statusWriter")
+	}
+}
+
+func TestStatusWriterFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = wrapWriter(rec)
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("Expected statusWriter to implement http.Flusher")
+	}
+	io.WriteString(w, "chunk")
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("Expected flush to reach the underlying writer")
+	}
+
+	// http.ResponseController finds Flush through Unwrap too
+	rec = httptest.NewRecorder()
+	if err := http.NewResponseController(wrapWriter(rec)).Flush(); err != nil || !rec.Flushed {
+		t.Errorf("ResponseController flush failed: %v", err)
+	}
+}
+
+func TestStatusWriterHijack(t *testing.T) {
+	var sw *statusWriter
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw = wrapWriter(w)
+		conn, buf, err := sw.Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "hijacked" {
+		t.Errorf("Expected hijacked body, got %q", body)
+	}
+	if sw.Status() != http.StatusSwitchingProtocols {
+		t.Errorf("Expected hijacked status 101, got %d", sw.Status())
+	}
+
+	// Recorders can't be hijacked; the wrapper must say so, not panic
+	if _, _, err := wrapWriter(httptest.NewRecorder()).Hijack(); err == nil {
+		t.Error("Expected error hijacking a non-hijackable writer")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	handler := loggingMiddleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+
+	for _, path := range []string{"/ok", "/missing"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", "test-agent")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var entries []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Log line is not JSON: %s", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d", len(entries))
+	}
+
+	ok, missing := entries[0], entries[1]
+	if ok["level"] != "INFO" || ok["msg"] != "request" || ok["path"] != "/ok" ||
+		ok["status"] != float64(200) || ok["bytes"] != float64(2) || ok["user_agent"] != "test-agent" {
+		t.Errorf("Unexpected access log: %v", ok)
+	}
+	if _, has := ok["duration"]; !has {
+		t.Error("Expected duration in access log")
+	}
+	if missing["level"] != "WARN" || missing["status"] != float64(404) {
+		t.Errorf("Expected WARN with status 404, got %v", missing)
+	}
+}
+
+func TestServerHandlerLogsRequests(t *testing.T) {
+	s, _ := newTestServer()
+	var buf bytes.Buffer
+	s.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	serve(s, "GET", "/users/999", "")
+
+	if !strings.Contains(buf.String(), `"status":404`) {
+		t.Errorf("Expected the global chain to log the 404, got %s", buf.String())
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"generated", "", false},
+		{"propagated", "abc-123_x.y", true},
+		{"too long", strings.Repeat("a", 65), false},
+		{"unsafe characters", "id\nforged=1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			got := w.Header().Get("X-Request-ID")
+			if got == "" || got != seen {
+				t.Fatalf("Expected matching header and context IDs, got %q and %q", got, seen)
+			}
+			if (got == tt.incoming) != tt.keep {
+				t.Errorf("Incoming %q, got %q (keep=%v)", tt.incoming, got, tt.keep)
+			}
+		})
+	}
+}
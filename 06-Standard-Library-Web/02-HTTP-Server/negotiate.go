@@ -0,0 +1,137 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types the users API can produce and consume.
+const (
+	mediaJSON   = "application/json"
+	mediaXML    = "application/xml"
+	mediaCSV    = "text/csv"
+	mediaNDJSON = "application/x-ndjson"
+	// mediaEventStream is only served by GET /users/events
+	mediaEventStream = "text/event-stream"
+)
+
+// userMediaTypes lists the response formats for users, in server
+// preference order: when the client likes several equally, the first wins.
+var userMediaTypes = []string{mediaJSON, mediaXML, mediaCSV, mediaNDJSON}
+
+// acceptRange is one entry of an Accept header, e.g. "text/*;q=0.5".
+type acceptRange struct {
+	Type    string
+	Subtype string
+	Q       float64
+}
+
+// parseAccept splits an Accept header into media ranges. Malformed
+// entries are skipped rather than failing the whole request.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		typ, sub, ok := strings.Cut(mediaType, "/")
+		if !ok || (typ == "*" && sub != "*") {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{Type: typ, Subtype: sub, Q: q})
+	}
+	return ranges
+}
+
+// negotiate picks the offer the client prefers. Each offer takes the q
+// value of the most specific range that matches it, so
+// "text/*;q=0.5, text/csv" rates text/csv at 1. A missing Accept header
+// accepts anything. It returns false when no offer is acceptable.
+func negotiate(header string, offers []string) (string, bool) {
+	if strings.TrimSpace(header) == "" {
+		return offers[0], true
+	}
+	ranges := parseAccept(header)
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, sub, _ := strings.Cut(offer, "/")
+		q, specificity := 0.0, -1
+		for _, ar := range ranges {
+			var s int
+			switch {
+			case ar.Type == typ && ar.Subtype == sub:
+				s = 2
+			case ar.Type == typ && ar.Subtype == "*":
+				s = 1
+			case ar.Type == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity = ar.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, best != ""
+}
+
+// negotiateUsers chooses the response format for a users route. It sets
+// Vary: Accept so caches keep one copy per format, and answers 406 when
+// none of userMediaTypes is acceptable. Handlers call it before doing any
+// work, so a request that can't be answered has no side effects.
+func negotiateUsers(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+	mediaType, ok := negotiate(r.Header.Get("Accept"), userMediaTypes)
+	if !ok {
+		writeError(w, http.StatusNotAcceptable,
+			"cannot produce "+r.Header.Get("Accept")+"; available: "+strings.Join(userMediaTypes, ", "))
+		return "", false
+	}
+	return mediaType, true
+}
+
+// requestMediaType returns the body's media type, or mediaJSON when the
+// client didn't send a Content-Type. If the type isn't one of accepted it
+// writes 415 with an Accept header listing the supported ones.
+func requestMediaType(w http.ResponseWriter, r *http.Request, accepted ...string) (string, bool) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return mediaJSON, true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err == nil {
+		if mediaType == "text/xml" {
+			mediaType = mediaXML
+		}
+		for _, a := range accepted {
+			if mediaType == a {
+				return mediaType, true
+			}
+		}
+	}
+
+	w.Header().Set("Accept", strings.Join(accepted, ", "))
+	writeError(w, http.StatusUnsupportedMediaType,
+		"cannot read "+header+"; send one of "+strings.Join(accepted, ", "))
+	return "", false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", mediaJSON, true},
+		{"*/*", mediaJSON, true},
+		{"application/json", mediaJSON, true},
+		{"application/xml", mediaXML, true},
+		{"text/csv", mediaCSV, true},
+		{"application/x-ndjson", mediaNDJSON, true},
+		{"text/*", mediaCSV, true},
+		{"application/*", mediaJSON, true},
+		{"application/xml;q=0.9, text/csv", mediaCSV, true},
+		{"text/html, application/xml;q=0.8, */*;q=0.1", mediaXML, true},
+		{"application/json;q=0, */*", mediaXML, true},
+		{"text/*;q=0.2, text/csv;q=0.9, application/xml;q=0.5", mediaCSV, true},
+		{"APPLICATION/XML", mediaXML, true},
+		{"image/png", "", false},
+		{"application/json;q=0", "", false},
+		{"*/*;q=0", "", false},
+		{"not a media type", "", false},
+		{"garbage;;, application/xml", mediaXML, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := negotiate(tt.accept, userMediaTypes)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("negotiate(%q) = %q, %v; want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUsersNotAcceptable(t *testing.T) {
+	s, store := newTestServer()
+
+	for _, tt := range []struct{ method, target, body string }{
+		{"GET", "/users", ""},
+		{"GET", "/users/1", ""},
+		{"POST", "/users", `{"name":"Carol","email":"carol@example.com"}`},
+	} {
+		w := serveWith(s, http.Header{"Accept": {"image/png"}}, tt.method, tt.target, tt.body)
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf("%s %s: expected 406, got %d", tt.method, tt.target, w.Code)
+		}
+		if got := w.Header().Values("Vary"); !slices.Contains(got, "Accept") {
+			t.Errorf("%s %s: expected Vary: Accept, got %q", tt.method, tt.target, got)
+		}
+		decodeProblem(t, w)
+	}
+
+	// The 406 must come before the write
+	if users, _ := store.List(context.Background()); len(users) != 2 {
+		t.Errorf("Expected no user created, got %d users", len(users))
+	}
+}
+
+func TestUsersVaryAccept(t *testing.T) {
+	s, _ := newTestServer()
+	w := serve(s, "GET", "/users", "")
+	if got := w.Header().Values("Vary"); !slices.Contains(got, "Accept") {
+		t.Errorf("Expected Vary: Accept, got %q", got)
+	}
+}
+
+func TestUnsupportedContentType(t *testing.T) {
+	s, store := newTestServer()
+
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	w := serveWith(s, header, "POST", "/users", "name=Carol&email=carol@example.com")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected 415, got %d", w.Code)
+	}
+	if got := w.Header().Get("Accept"); got != "application/json, application/xml, text/csv" {
+		t.Errorf("Unexpected Accept header on 415: %q", got)
+	}
+	decodeProblem(t, w)
+
+	// CSV only creates; it can't replace a single user
+	header = ifMatch(t, store, 1, "")
+	header.Set("Content-Type", "text/csv")
+	w = serveWith(s, header, "PUT", "/users/1", "name,email\nAlicia,alicia@example.com\n")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for CSV PUT, got %d", w.Code)
+	}
+}
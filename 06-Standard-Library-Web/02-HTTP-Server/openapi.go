@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// route describes one endpoint. routes registers each one with the mux,
+// and openAPIDocument turns the same list into the API description, so
+// the two can't drift apart.
+type route struct {
+	Method  string
+	Path    string // a ServeMux path such as "/users/{id}"
+	Summary string
+
+	// Params is a struct whose fields are tagged path:"name",
+	// query:"name" or header:"Name", with optional doc and
+	// required:"true" tags. Path parameters are always required.
+	Params any
+	// Request is a value of the body type, e.g. User{}; nil if none.
+	Request any
+	// Consumes and Produces list the media types of the request and of
+	// successful responses. Both default to application/json.
+	Consumes []string
+	Produces []string
+	// Responses maps each status code to a value of its body type, or
+	// nil for no body. problem{} bodies are sent as problem+json.
+	Responses map[int]any
+	// Auth marks routes that need a bearer token.
+	Auth bool
+
+	Handler http.Handler
+}
+
+// pattern is the ServeMux pattern for the route.
+func (rt route) pattern() string {
+	return rt.Method + " " + rt.Path
+}
+
+// marshalOpenAPI renders the document for routes as indented JSON.
+func marshalOpenAPI(routes []route) []byte {
+	// Only maps, slices and strings: marshaling can't fail
+	spec, _ := json.MarshalIndent(openAPIDocument(routes), "", "  ")
+	return append(spec, '\n')
+}
+
+// openAPIDocument builds an OpenAPI 3.1 document for routes. Schemas for
+// request and response bodies are derived from the Go types by
+// reflection and collected under components/schemas.
+func openAPIDocument(routes []route) map[string]any {
+	schemas := schemaSet{}
+	paths := map[string]map[string]any{}
+
+	for _, rt := range routes {
+		op := map[string]any{
+			"summary":   rt.Summary,
+			"responses": schemas.responses(rt),
+		}
+		if params := schemas.parameters(rt.Params); len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  schemas.content(orJSON(rt.Consumes), rt.Request),
+			}
+		}
+		if rt.Auth {
+			op["security"] = []map[string][]string{{"bearerAuth": {}}}
+		}
+
+		// "/{$}" only means "exactly /" to the mux
+		path := strings.TrimSuffix(rt.Path, "{$}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]string{
+			"title":   "Go Learning Lab Users API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]string{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+				},
+			},
+		},
+	}
+}
+
+func orJSON(mediaTypes []string) []string {
+	if len(mediaTypes) == 0 {
+		return []string{mediaJSON}
+	}
+	return mediaTypes
+}
+
+// schemaSet collects the named schemas referenced by the document.
+type schemaSet map[string]any
+
+// responses describes every status of rt.
+func (set schemaSet) responses(rt route) map[string]any {
+	out := map[string]any{}
+	for status, body := range rt.Responses {
+		resp := map[string]any{"description": http.StatusText(status)}
+		switch body.(type) {
+		case nil:
+		case problem:
+			resp["content"] = set.content([]string{"application/problem+json"}, body)
+		default:
+			resp["content"] = set.content(orJSON(rt.Produces), body)
+		}
+		out[strconv.Itoa(status)] = resp
+	}
+	return out
+}
+
+// content maps each media type to the schema of body. CSV, NDJSON and
+// event streams are line-oriented text with no JSON Schema of their own.
+func (set schemaSet) content(mediaTypes []string, body any) map[string]any {
+	out := map[string]any{}
+	for _, mt := range mediaTypes {
+		schema := map[string]any{"type": "string"}
+		switch mt {
+		case mediaCSV:
+			schema["description"] = "CSV with a header row: id,name,email"
+		case mediaNDJSON:
+			schema["description"] = "One JSON user per line"
+		case mediaEventStream:
+			schema["description"] = "Server-Sent Events: user.created, user.updated, user.deleted and reset"
+		default:
+			schema = set.schemaOf(reflect.TypeOf(body))
+		}
+		out[mt] = map[string]any{"schema": schema}
+	}
+	return out
+}
+
+// parameters reads path, query and header parameters from the tags of
+// the params struct.
+func (set schemaSet) parameters(params any) []map[string]any {
+	if params == nil {
+		return nil
+	}
+
+	var out []map[string]any
+	t := reflect.TypeOf(params)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		for _, in := range []string{"path", "query", "header"} {
+			name, ok := f.Tag.Lookup(in)
+			if !ok {
+				continue
+			}
+			p := map[string]any{
+				"name":   name,
+				"in":     in,
+				"schema": set.schemaOf(f.Type),
+			}
+			if in == "path" || f.Tag.Get("required") == "true" {
+				p["required"] = true
+			}
+			if doc := f.Tag.Get("doc"); doc != "" {
+				p["description"] = doc
+			}
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the JSON Schema for t. Named structs are added to the
+// set once and referenced with $ref; everything else is inlined.
+func (set schemaSet) schemaOf(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return set.schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": set.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": set.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return set.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := set[name]; !ok {
+			set[name] = nil // reserve the name first so recursive types terminate
+			set[name] = set.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	// interface{} and anything else accept any value
+	return map[string]any{}
+}
+
+// structSchema describes a struct the way encoding/json sees it: fields
+// are named by their json tags, "-" and unexported fields are skipped,
+// and a field is required unless it is a pointer or tagged omitempty.
+// Fields tagged readonly:"true" are set by the server: they are marked
+// readOnly and never required, since request bodies leave them out.
+func (set schemaSet) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := set.schemaOf(f.Type)
+		readOnly := f.Tag.Get("readonly") == "true"
+		if readOnly {
+			schema["readOnly"] = true
+		}
+		properties[name] = schema
+		if !readOnly && f.Type.Kind() != reflect.Pointer && !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaName exports the Go type name, so problem becomes Problem.
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
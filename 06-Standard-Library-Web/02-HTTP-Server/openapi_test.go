@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestOpenAPIGolden fails when a route's contract changes and the
+// committed document wasn't regenerated. Review the diff, then run
+//
+//	go test -run OpenAPIGolden -update
+func TestOpenAPIGolden(t *testing.T) {
+	s, _ := newTestServer()
+	w := serve(s, "GET", "/openapi.json", "")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Unexpected Content-Type %q", got)
+	}
+
+	golden := filepath.Join("testdata", "openapi.json")
+	if *update {
+		if err := os.WriteFile(golden, w.Body.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Missing golden file (run with -update): %v", err)
+	}
+	if !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("/openapi.json differs from %s; if the change is intended, run go test -run OpenAPIGolden -update", golden)
+	}
+}
+
+// TestOpenAPIRoutesRegistered checks that every documented operation is
+// what the mux actually serves.
+func TestOpenAPIRoutesRegistered(t *testing.T) {
+	s, _ := newTestServer()
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(serve(s, "GET", "/openapi.json", "").Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	operations := 0
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			operations++
+			target := strings.ReplaceAll(path, "{id}", "1")
+			header := http.Header{}
+			if strings.Contains(string(op), mediaEventStream) {
+				// A 406 shows it is routed without opening an endless stream
+				header.Set("Accept", mediaJSON)
+			}
+			w := serveWith(s, header, strings.ToUpper(method), target, "")
+			if w.Code == 404 && !strings.Contains(path, "{id}") || w.Code == 405 {
+				t.Errorf("%s %s is documented but not routed (got %d)", method, path, w.Code)
+			}
+		}
+	}
+	if want := len(s.routeTable()) + 1; operations != want {
+		t.Errorf("Expected %d operations, got %d", want, operations)
+	}
+}
+
+func TestSchemaOf(t *testing.T) {
+	set := schemaSet{}
+	ref := set.schemaOf(reflect.TypeOf([]User{}))
+	if ref["type"] != "array" || !reflect.DeepEqual(ref["items"], map[string]any{"$ref": "#/components/schemas/User"}) {
+		t.Errorf("Unexpected list schema: %v", ref)
+	}
+
+	user := set["User"].(map[string]any)
+	// id is assigned by the server, so request bodies may leave it out
+	if got := user["required"]; !reflect.DeepEqual(got, []string{"name", "email"}) {
+		t.Errorf("Unexpected required fields: %v", got)
+	}
+	if id := user["properties"].(map[string]any)["id"].(map[string]any); id["readOnly"] != true {
+		t.Errorf("Expected id to be readOnly: %v", id)
+	}
+	if _, ok := user["properties"].(map[string]any)["Version"]; ok {
+		t.Error(`Fields tagged json:"-" must not be documented`)
+	}
+
+	// Pointer fields are optional; omitempty fields too
+	set.schemaOf(reflect.TypeOf(userPatch{}))
+	if _, ok := set["UserPatch"].(map[string]any)["required"]; ok {
+		t.Errorf("Expected no required fields for UserPatch: %v", set["UserPatch"])
+	}
+	set.schemaOf(reflect.TypeOf(problem{}))
+	if got := set["Problem"].(map[string]any)["required"]; !reflect.DeepEqual(got, []string{"type", "title", "status"}) {
+		t.Errorf("Unexpected required fields for Problem: %v", got)
+	}
+	if _, ok := set["ValidationError"]; !ok {
+		t.Error("Expected nested ValidationError schema to be collected")
+	}
+}
+
+func TestSchemaOfRecursive(t *testing.T) {
+	type node struct {
+		Children []node `json:"children"`
+	}
+	set := schemaSet{}
+	set.schemaOf(reflect.TypeOf(node{}))
+	if _, ok := set["Node"]; !ok {
+		t.Error("Expected recursive type to be collected")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// problem is an RFC 7807 "problem details" document. Every error response
+// from the server uses this shape with Content-Type application/problem+json.
+type problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Errors   []ValidationError `json:"errors,omitempty"`
+}
+
+// newProblem returns a problem whose title is the standard status text.
+// "about:blank" means the status code alone explains the problem type.
+func newProblem(status int, detail string) problem {
+	return problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// writeProblem sends p as application/problem+json.
+func writeProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeError sends a problem document with the given status and detail.
+func writeError(w http.ResponseWriter, status int, detail string) {
+	writeProblem(w, newProblem(status, detail))
+}
+
+// writeValidationErrors sends every failing field in one response.
+func writeValidationErrors(w http.ResponseWriter, status int, detail string, errs ValidationErrors) {
+	p := newProblem(status, detail)
+	p.Errors = errs
+	writeProblem(w, p)
+}
+
+// muxErrors replaces the plain-text 404 and 405 replies of http.ServeMux
+// with problem documents. The mux still decides which one applies and
+// sets the Allow header; only its body is discarded.
+func muxErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		capture := &statusCapture{header: w.Header()}
+		h.ServeHTTP(capture, r)
+		if capture.status < 400 {
+			// Redirects (e.g. "/users/" -> "/users") pass through untouched
+			w.WriteHeader(capture.status)
+			return
+		}
+
+		detail := "no route for " + r.URL.Path
+		if capture.status == http.StatusMethodNotAllowed {
+			detail = r.Method + " is not allowed; use " + strings.Join(w.Header().Values("Allow"), ", ")
+		}
+		w.Header().Del("Content-Length")
+		writeError(w, capture.status, detail)
+	})
+}
+
+// statusCapture records the status code written by a handler and drops
+// its body. Headers go straight to the real response.
+type statusCapture struct {
+	header http.Header
+	status int
+}
+
+func (c *statusCapture) Header() http.Header { return c.header }
+
+func (c *statusCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *statusCapture) Write(b []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits for GET /users pagination
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+// listParams documents the query parameters parseListQuery accepts for
+// the OpenAPI document.
+type listParams struct {
+	Limit  int    `query:"limit" doc:"Page size, 1-100 (default 50)"`
+	Offset int    `query:"offset" doc:"Number of users to skip; not allowed with cursor"`
+	Cursor string `query:"cursor" doc:"Opaque cursor from a previous Link rel=next header"`
+	Name   string `query:"name" doc:"Case-insensitive substring filter on name"`
+	Email  string `query:"email" doc:"Case-insensitive substring filter on email"`
+	Sort   string `query:"sort" doc:"Comma-separated fields (id, name, email); prefix - for descending"`
+}
+
+// listQuery is the parsed form of the GET /users query string.
+//
+//	?limit=10&offset=20        offset pagination
+//	?limit=10&cursor=...       cursor pagination (the default; cursors come from Link headers)
+//	?name=ali&email=example    case-insensitive substring filters
+//	?sort=name,-id             sort keys, "-" for descending
+type listQuery struct {
+	Limit  int
+	Offset int
+	Paged  bool // offset was given: link with offsets instead of cursors
+	Cursor *cursor
+	Name   string
+	Email  string
+	Sort   []sortKey
+}
+
+// sortKey is one field of a ?sort= list.
+type sortKey struct {
+	Field string
+	Desc  bool
+}
+
+// cursor marks the last user of a page. The next page starts with the
+// first user that sorts after it. Because every sort ends with id as a
+// tie-breaker, the position is stable even when users are added or removed.
+type cursor struct {
+	Sort  string `json:"s"`
+	ID    int    `json:"i"`
+	Name  string `json:"n"`
+	Email string `json:"e"`
+}
+
+var (
+	knownListParams = map[string]bool{
+		"limit": true, "offset": true, "cursor": true,
+		"name": true, "email": true, "sort": true,
+	}
+	sortableFields = map[string]bool{"id": true, "name": true, "email": true}
+)
+
+// parseListQuery validates the query string of GET /users.
+// It returns every invalid parameter, not just the first.
+func parseListQuery(values url.Values) (listQuery, ValidationErrors) {
+	q := listQuery{Limit: defaultPageLimit}
+	var errs ValidationErrors
+
+	// Sorted so error order is deterministic
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if !knownListParams[k] {
+			errs = append(errs, ValidationError{k, "unknown parameter"})
+		} else if len(values[k]) > 1 {
+			errs = append(errs, ValidationError{k, "must be given at most once"})
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			errs = append(errs, ValidationError{"limit", fmt.Sprintf("must be an integer between 1 and %d", maxPageLimit)})
+		} else {
+			q.Limit = n
+		}
+	}
+
+	if v := values.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, ValidationError{"offset", "must be a non-negative integer"})
+		} else {
+			q.Offset = n
+			q.Paged = true
+		}
+	}
+
+	q.Name = values.Get("name")
+	q.Email = values.Get("email")
+
+	sortSpec := values.Get("sort")
+	if v := values.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		switch {
+		case err != nil:
+			errs = append(errs, ValidationError{"cursor", "is malformed"})
+		case values.Has("offset"):
+			errs = append(errs, ValidationError{"cursor", "cannot be combined with offset"})
+		case values.Has("sort") && sortSpec != c.Sort:
+			errs = append(errs, ValidationError{"cursor", "was issued for a different sort"})
+		default:
+			q.Cursor = &c
+			sortSpec = c.Sort
+		}
+	}
+
+	keys, err := parseSort(sortSpec)
+	if err != nil {
+		errs = append(errs, ValidationError{"sort", err.Error()})
+	}
+	q.Sort = keys
+
+	if len(errs) > 0 {
+		return listQuery{}, errs
+	}
+	return q, nil
+}
+
+// parseSort turns "name,-id" into sort keys. id is always appended as a
+// final tie-breaker so the order is total.
+func parseSort(spec string) ([]sortKey, error) {
+	var keys []sortKey
+	seen := map[string]bool{}
+	if spec != "" {
+		for _, part := range strings.Split(spec, ",") {
+			k := sortKey{Field: part}
+			if strings.HasPrefix(part, "-") {
+				k = sortKey{Field: part[1:], Desc: true}
+			}
+			if !sortableFields[k.Field] {
+				return nil, fmt.Errorf("unknown field %q (use id, name or email)", k.Field)
+			}
+			if seen[k.Field] {
+				return nil, fmt.Errorf("field %q listed twice", k.Field)
+			}
+			seen[k.Field] = true
+			keys = append(keys, k)
+		}
+	}
+	if !seen["id"] {
+		keys = append(keys, sortKey{Field: "id"})
+	}
+	return keys, nil
+}
+
+// sortSpec renders keys back to the ?sort= form.
+func sortSpec(keys []sortKey) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k.Field
+		if k.Desc {
+			parts[i] = "-" + k.Field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// compareUsers orders a and b by keys, returning -1, 0 or 1.
+func compareUsers(a, b User, keys []sortKey) int {
+	for _, k := range keys {
+		var c int
+		switch k.Field {
+		case "id":
+			c = compareInts(a.ID, b.ID)
+		case "name":
+			c = strings.Compare(a.Name, b.Name)
+		case "email":
+			c = strings.Compare(a.Email, b.Email)
+		}
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// page is one page of results plus what's needed to link to its neighbours.
+type page struct {
+	Users []User
+	Total int // matching users across all pages
+	Next  *cursor
+}
+
+// apply filters, sorts and slices users according to q.
+func (q listQuery) apply(users []User) page {
+	matched := make([]User, 0, len(users))
+	for _, u := range users {
+		if containsFold(u.Name, q.Name) && containsFold(u.Email, q.Email) {
+			matched = append(matched, u)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return compareUsers(matched[i], matched[j], q.Sort) < 0
+	})
+
+	start := q.Offset
+	if q.Cursor != nil {
+		after := User{ID: q.Cursor.ID, Name: q.Cursor.Name, Email: q.Cursor.Email}
+		start = sort.Search(len(matched), func(i int) bool {
+			return compareUsers(matched[i], after, q.Sort) > 0
+		})
+	}
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + q.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	p := page{Users: matched[start:end], Total: len(matched)}
+	if end < len(matched) && len(p.Users) > 0 {
+		last := p.Users[len(p.Users)-1]
+		p.Next = &cursor{Sort: sortSpec(q.Sort), ID: last.ID, Name: last.Name, Email: last.Email}
+	}
+	return p
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// encodeCursor makes a cursor opaque to clients.
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// setPageHeaders writes X-Total-Count and an RFC 8288 Link header.
+// "next" links carry a cursor unless the client paginates by offset,
+// in which case offsets are used and a "prev" link is added.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, q listQuery, p page) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(p.Total))
+
+	link := func(rel string, set func(v url.Values)) string {
+		v := url.Values{}
+		v.Set("limit", strconv.Itoa(q.Limit))
+		if q.Name != "" {
+			v.Set("name", q.Name)
+		}
+		if q.Email != "" {
+			v.Set("email", q.Email)
+		}
+		if s := sortSpec(q.Sort); s != "id" {
+			v.Set("sort", s)
+		}
+		set(v)
+		u := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	links := []string{link("first", func(url.Values) {})}
+	if p.Next != nil {
+		links = append(links, link("next", func(v url.Values) {
+			if q.Paged {
+				v.Set("offset", strconv.Itoa(q.Offset+q.Limit))
+			} else {
+				v.Set("cursor", encodeCursor(*p.Next))
+			}
+		}))
+	}
+	if q.Paged && q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", func(v url.Values) {
+			v.Set("offset", strconv.Itoa(prev))
+		}))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
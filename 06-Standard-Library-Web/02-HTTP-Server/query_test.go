@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newPagingServer seeds a server with users whose names sort differently
+// from their IDs.
+func newPagingServer(t *testing.T) *server {
+	t.Helper()
+	store := NewMemoryUserStore(
+		User{ID: 1, Name: "Dave", Email: "dave@example.com"},
+		User{ID: 2, Name: "alice", Email: "alice@example.org"},
+		User{ID: 3, Name: "Carol", Email: "carol@example.com"},
+		User{ID: 4, Name: "Bob", Email: "bob@example.com"},
+		User{ID: 5, Name: "Alice", Email: "alice.b@example.com"},
+	)
+	return newQuietServer(store)
+}
+
+func decodeUsers(t *testing.T, body string) []User {
+	t.Helper()
+	var users []User
+	if err := json.Unmarshal([]byte(body), &users); err != nil {
+		t.Fatalf("Failed to decode users: %v (%s)", err, body)
+	}
+	return users
+}
+
+func ids(users []User) string {
+	parts := make([]string, len(users))
+	for i, u := range users {
+		parts[i] = fmt.Sprint(u.ID)
+	}
+	return strings.Join(parts, ",")
+}
+
+var linkRE = regexp.MustCompile(`<([^>]*)>; rel="(\w+)"`)
+
+// links parses a Link header into rel -> URL.
+func links(header string) map[string]string {
+	m := map[string]string{}
+	for _, match := range linkRE.FindAllStringSubmatch(header, -1) {
+		m[match[2]] = match[1]
+	}
+	return m
+}
+
+func TestListUsersQuery(t *testing.T) {
+	s := newPagingServer(t)
+
+	tests := []struct {
+		query string
+		want  string
+		total string
+	}{
+		{"", "1,2,3,4,5", "5"},
+		{"?limit=2", "1,2", "5"},
+		{"?limit=2&offset=2", "3,4", "5"},
+		{"?offset=10", "", "5"},
+		{"?sort=-id", "5,4,3,2,1", "5"},
+		{"?sort=name", "5,4,3,1,2", "5"},
+		{"?sort=name,-id", "5,4,3,1,2", "5"},
+		{"?sort=email", "5,2,4,3,1", "5"},
+		{"?name=ALICE", "2,5", "2"},
+		{"?email=.com&sort=-name", "1,3,4,5", "4"},
+		{"?name=alice&email=.org", "2", "1"},
+		{"?name=zed", "", "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := serve(s, "GET", "/users"+tt.query, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+			}
+			if got := ids(decodeUsers(t, w.Body.String())); got != tt.want {
+				t.Errorf("Expected IDs [%s], got [%s]", tt.want, got)
+			}
+			if got := w.Header().Get("X-Total-Count"); got != tt.total {
+				t.Errorf("Expected X-Total-Count %s, got %s", tt.total, got)
+			}
+		})
+	}
+}
+
+func TestListUsersOffsetLinks(t *testing.T) {
+	s := newPagingServer(t)
+	w := serve(s, "GET", "/users?limit=1&offset=1&name=a", "")
+
+	l := links(w.Header().Get("Link"))
+	if l["next"] != "/users?limit=1&name=a&offset=2" {
+		t.Errorf("Unexpected next link: %q", l["next"])
+	}
+	if l["prev"] != "/users?limit=1&name=a&offset=0" {
+		t.Errorf("Unexpected prev link: %q", l["prev"])
+	}
+	if l["first"] != "/users?limit=1&name=a" {
+		t.Errorf("Unexpected first link: %q", l["first"])
+	}
+}
+
+func TestListUsersCursorPagination(t *testing.T) {
+	s := newPagingServer(t)
+
+	// Follow "next" links until they run out
+	var got []string
+	target := "/users?limit=2&sort=name"
+	for pages := 0; target != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("Too many pages")
+		}
+		w := serve(s, "GET", target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d: %s", target, w.Code, w.Body)
+		}
+		got = append(got, ids(decodeUsers(t, w.Body.String())))
+		target = links(w.Header().Get("Link"))["next"]
+	}
+
+	if strings.Join(got, "|") != "5,4|3,1|2" {
+		t.Errorf("Unexpected pages: %v", got)
+	}
+}
+
+func TestListUsersCursorSurvivesInsert(t *testing.T) {
+	s := newPagingServer(t)
+	w := serve(s, "GET", "/users?limit=2", "")
+	next := links(w.Header().Get("Link"))["next"]
+
+	// A new user sorting before the cursor must not shift the next page
+	serve(s, "POST", "/users", `{"name":"Aaron","email":"aaron@example.com"}`)
+	if w := serveWith(s, ifMatch(t, s.store, 1, bearer(t, s, "admin")), "DELETE", "/users/1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected delete to succeed, got %d", w.Code)
+	}
+
+	w = serve(s, "GET", next, "")
+	if got := ids(decodeUsers(t, w.Body.String())); got != "3,4" {
+		t.Errorf("Expected IDs [3,4], got [%s]", got)
+	}
+}
+
+func TestListUsersBadQuery(t *testing.T) {
+	s := newPagingServer(t)
+	cur := encodeCursor(cursor{Sort: "id", ID: 1})
+
+	tests := []struct {
+		query  string
+		params []string
+	}{
+		{"?page=2", []string{"page"}},
+		{"?limit=0", []string{"limit"}},
+		{"?limit=1000", []string{"limit"}},
+		{"?limit=ten&offset=-1", []string{"limit", "offset"}},
+		{"?sort=age", []string{"sort"}},
+		{"?sort=name,name", []string{"sort"}},
+		{"?limit=1&limit=2", []string{"limit"}},
+		{"?cursor=not-a-cursor!", []string{"cursor"}},
+		{"?cursor=" + cur + "&offset=2", []string{"cursor"}},
+		{"?cursor=" + cur + "&sort=name", []string{"cursor"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := serve(s, "GET", "/users"+tt.query, "")
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Expected 400, got %d", w.Code)
+			}
+
+			p := decodeProblem(t, w)
+			var params []string
+			for _, e := range p.Errors {
+				params = append(params, e.Field)
+				if e.Message == "" {
+					t.Errorf("Missing message for %s", e.Field)
+				}
+			}
+			if strings.Join(params, ",") != strings.Join(tt.params, ",") {
+				t.Errorf("Expected errors for %v, got %v", tt.params, params)
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := cursor{Sort: "name,-id", ID: 7, Name: "Zoë", Email: "z@example.com"}
+	encoded := encodeCursor(c)
+	if url.QueryEscape(encoded) != encoded {
+		t.Errorf("Cursor is not URL-safe: %s", encoded)
+	}
+	got, err := decodeCursor(encoded)
+	if err != nil || got != c {
+		t.Errorf("Round trip failed: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit configures one token bucket: Rate tokens are added per second
+// up to Burst, and each request takes one token.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Per-route limits
+var (
+	loginRateLimit = rateLimit{Rate: 5.0 / 60, Burst: 5} // 5 per minute
+	usersRateLimit = rateLimit{Rate: 20, Burst: 40}
+)
+
+// bucket is the state of one client on one route.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds a token bucket per (route, client) pair.
+// Buckets idle for longer than idleTTL are dropped by cleanup, so memory
+// is bounded by the number of recently active clients.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	idleTTL time.Duration
+	now     func() time.Time // replaced in tests
+}
+
+func newRateLimiter(idleTTL time.Duration) *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*bucket),
+		idleTTL: idleTTL,
+		now:     time.Now,
+	}
+}
+
+// decision is the outcome of one allow call.
+type decision struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, when not allowed
+}
+
+// allow takes a token from the bucket for key, refilling it first.
+func (l *rateLimiter) allow(key string, limit rateLimit) decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	}
+	b.last = now
+
+	d := decision{Allowed: b.tokens >= 1}
+	if d.Allowed {
+		b.tokens--
+	} else {
+		d.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return d
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// cleanup drops buckets that have not been used within idleTTL and
+// returns how many were removed. An idle bucket is full again anyway,
+// so dropping it doesn't change any client's limit.
+func (l *rateLimiter) cleanup() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := l.now().Add(-l.idleTTL)
+	removed := 0
+	for key, b := range l.buckets {
+		if b.last.Before(cutoff) {
+			delete(l.buckets, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// size returns the number of live buckets.
+func (l *rateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// startCleanup runs cleanup every interval until ctx is cancelled.
+func (l *rateLimiter) startCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		l.cleanupLoop(ctx, ticker.C)
+	}()
+}
+
+// cleanupLoop calls cleanup on every tick. Tests drive ticks by hand.
+func (l *rateLimiter) cleanupLoop(ctx context.Context, ticks <-chan time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			l.cleanup()
+		}
+	}
+}
+
+// clientKey identifies the caller: the authenticated principal when
+// authMiddleware ran first, otherwise the client IP.
+//
+// RemoteAddr is used rather than X-Forwarded-For, which any client can
+// forge. Behind a trusted proxy, derive the IP from the proxy's header instead.
+func clientKey(r *http.Request) string {
+	if p, ok := principalFrom(r.Context()); ok {
+		return "user:" + p.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware: Rate limiting
+// Each route gets its own buckets, named by route, so a client exhausting
+// one route's limit can still use the others.
+func (l *rateLimiter) limit(route string, limit rateLimit) Middleware {
+	policy := fmt.Sprintf("%d;w=%d", limit.Burst, int(math.Ceil(float64(limit.Burst)/limit.Rate)))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := l.allow(route+"|"+clientKey(r), limit)
+
+			// IETF draft-ietf-httpapi-ratelimit-headers
+			h := w.Header()
+			h.Set("RateLimit-Policy", policy)
+			h.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+			h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+
+			if !d.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+				writeError(w, http.StatusTooManyRequests,
+					fmt.Sprintf("rate limit exceeded; retry in %ds", ceilSeconds(d.RetryAfter)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds rounds up so clients never retry too early.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
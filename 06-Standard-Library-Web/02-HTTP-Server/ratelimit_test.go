@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock, safe for concurrent use.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_700_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter() (*rateLimiter, *fakeClock) {
+	clock := newFakeClock()
+	l := newRateLimiter(time.Minute)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := rateLimit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if d := l.allow("k", limit); !d.Allowed || d.Remaining != 2-i {
+			t.Fatalf("Request %d: expected allowed with %d remaining, got %+v", i, 2-i, d)
+		}
+	}
+
+	d := l.allow("k", limit)
+	if d.Allowed {
+		t.Fatal("Expected 4th request in burst to be limited")
+	}
+	if d.RetryAfter != time.Second {
+		t.Errorf("Expected RetryAfter 1s, got %v", d.RetryAfter)
+	}
+	if d.Reset != 3*time.Second {
+		t.Errorf("Expected Reset 3s, got %v", d.Reset)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if d := l.allow("k", limit); d.Allowed || d.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Expected limited with 500ms retry, got %+v", d)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if d := l.allow("k", limit); !d.Allowed {
+		t.Error("Expected a token after 1s")
+	}
+
+	// Refill never exceeds the burst
+	clock.Advance(time.Hour)
+	if d := l.allow("k", limit); d.Remaining != 2 {
+		t.Errorf("Expected refill capped at burst, got %+v", d)
+	}
+
+	// Other keys have their own bucket
+	if d := l.allow("other", limit); !d.Allowed || d.Remaining != 2 {
+		t.Errorf("Expected independent bucket, got %+v", d)
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := rateLimit{Rate: 1, Burst: 1}
+
+	l.allow("old", limit)
+	clock.Advance(45 * time.Second)
+	l.allow("recent", limit)
+	clock.Advance(30 * time.Second)
+
+	if removed := l.cleanup(); removed != 1 {
+		t.Errorf("Expected 1 bucket removed, got %d", removed)
+	}
+	if l.size() != 1 {
+		t.Errorf("Expected 1 bucket left, got %d", l.size())
+	}
+
+	// The background loop cleans up on each tick and stops with ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		l.cleanupLoop(ctx, ticks)
+		close(done)
+	}()
+
+	clock.Advance(2 * time.Minute)
+	ticks <- clock.Now()
+	ticks <- clock.Now() // second send returns once the first cleanup finished
+	if l.size() != 0 {
+		t.Errorf("Expected all buckets removed, got %d", l.size())
+	}
+
+	cancel()
+	<-done
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	l, clock := newTestLimiter()
+	handler := l.limit("test", rateLimit{Rate: 0.5, Burst: 2})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	request("10.0.0.1:1111")
+	w := request("10.0.0.1:2222") // same IP, different port
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("Expected RateLimit-Remaining 0, got %s", got)
+	}
+	if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+		t.Errorf("Expected RateLimit-Limit 2, got %s", got)
+	}
+	if got := w.Header().Get("RateLimit-Policy"); got != "2;w=4" {
+		t.Errorf("Expected RateLimit-Policy 2;w=4, got %s", got)
+	}
+
+	w = request("10.0.0.1:3333")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After 2, got %s", got)
+	}
+	if got := w.Header().Get("RateLimit-Reset"); got != "4" {
+		t.Errorf("Expected RateLimit-Reset 4, got %s", got)
+	}
+	decodeProblem(t, w)
+
+	if w := request("10.0.0.2:1111"); w.Code != http.StatusOK {
+		t.Errorf("Expected a different IP to be allowed, got %d", w.Code)
+	}
+
+	clock.Advance(2 * time.Second)
+	if w := request("10.0.0.1:4444"); w.Code != http.StatusOK {
+		t.Errorf("Expected request allowed after Retry-After, got %d", w.Code)
+	}
+}
+
+func TestRateLimitKeysOnPrincipal(t *testing.T) {
+	s, store := newTestServer()
+	clock := newFakeClock()
+	s.limiter.now = clock.Now
+
+	// An authenticated and an anonymous caller on the same IP get separate buckets
+	authed := serveWith(s, ifMatch(t, store, 1, bearer(t, s, "admin")), "DELETE", "/users/1", "")
+	if authed.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", authed.Code)
+	}
+	if got := authed.Header().Get("RateLimit-Remaining"); got != fmt.Sprint(usersRateLimit.Burst-1) {
+		t.Errorf("Expected fresh bucket for principal, got remaining %s", got)
+	}
+
+	anon := serve(s, "GET", "/users", "")
+	if got := anon.Header().Get("RateLimit-Remaining"); got != fmt.Sprint(usersRateLimit.Burst-1) {
+		t.Errorf("Expected separate IP bucket, got remaining %s", got)
+	}
+}
+
+func TestLoginRateLimited(t *testing.T) {
+	s, _ := newTestServer()
+	clock := newFakeClock()
+	s.limiter.now = clock.Now
+
+	for i := 0; i < loginRateLimit.Burst; i++ {
+		serve(s, "POST", "/login", `{"username":"alice","password":"wrong"}`)
+	}
+	w := serve(s, "POST", "/login", `{"username":"alice","password":"alice-password"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after %d attempts, got %d", loginRateLimit.Burst, w.Code)
+	}
+
+	// The users API has its own budget
+	if w := serve(s, "GET", "/users", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected /users unaffected by login limit, got %d", w.Code)
+	}
+
+	clock.Advance(12 * time.Second)
+	if w := serve(s, "POST", "/login", `{"username":"alice","password":"alice-password"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected login allowed after refill, got %d", w.Code)
+	}
+}
+
+// TestRateLimiterConcurrent is meant to be run with -race. Exactly Burst
+// requests must get through no matter how they interleave.
+func TestRateLimiterConcurrent(t *testing.T) {
+	l, _ := newTestLimiter()
+	limit := rateLimit{Rate: 1, Burst: 50}
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if l.allow("shared", limit).Allowed {
+				allowed.Add(1)
+			}
+			l.allow(fmt.Sprintf("key-%d", i%10), limit)
+			if i%50 == 0 {
+				l.cleanup()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != int64(limit.Burst) {
+		t.Errorf("Expected exactly %d allowed, got %d", limit.Burst, got)
+	}
+}
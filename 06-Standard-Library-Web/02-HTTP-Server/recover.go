@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Middleware: Panic recovery
+// The same defer/recover pattern as recoverExample and safeFunction in
+// 02-Data-Structures-Functions/04-Defer-Panic-Recover, applied per request:
+// a panicking handler becomes a 500 problem response instead of a dropped
+// connection, and the stack trace goes to the structured log.
+func (s *server) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := wrapWriter(w)
+		// Headers set by outer middleware (request ID, CORS) belong on
+		// the 500 too; anything the handler adds later does not.
+		outer := sw.Header().Clone()
+
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// ErrAbortHandler is net/http's way to abort a response on
+			// purpose; it must keep propagating.
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			s.panics.Add(1)
+			s.logger.LogAttrs(r.Context(), slog.LevelError, "panic recovered",
+				slog.String("request_id", requestIDFrom(r.Context())),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("panic", fmt.Sprint(rec)),
+				slog.String("stack", string(debug.Stack())),
+			)
+
+			if sw.WroteHeader() {
+				// Too late for a 500: the client already has a status line
+				// and maybe part of the body. Abort the connection so the
+				// truncated response can't be mistaken for a complete one.
+				panic(http.ErrAbortHandler)
+			}
+
+			// Drop headers the handler set for the response it never sent
+			// (Content-Type, Location, ETag, ...)
+			h := sw.Header()
+			clear(h)
+			for name, values := range outer {
+				h[name] = values
+			}
+			writeError(sw, http.StatusInternalServerError, "internal server error")
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newPanicServer returns a server whose logs go to buf.
+func newPanicServer(buf *bytes.Buffer) *server {
+	s, _ := newTestServer()
+	s.logger = slog.New(slog.NewJSONHandler(buf, nil))
+	return s
+}
+
+// withGlobal wraps h in the server's global stack, like s.handler does.
+func withGlobal(s *server, h http.HandlerFunc) http.Handler {
+	return NewChain(
+		requestIDMiddleware,
+		loggingMiddleware(s.logger),
+		corsMiddleware(s.cors),
+		s.recoverMiddleware,
+		compressMiddleware(compressMinSize),
+	).Then(h)
+}
+
+func TestRecoverBeforeWrite(t *testing.T) {
+	var buf bytes.Buffer
+	s := newPanicServer(&buf)
+	h := withGlobal(s, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Location", "/users/99")
+		panic("boom")
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d", w.Code)
+	}
+	p := decodeProblem(t, w)
+	if strings.Contains(p.Detail, "boom") {
+		t.Error("Panic value must not leak to the client")
+	}
+	if w.Header().Get("Location") != "" {
+		t.Error("Expected headers from the failed handler to be dropped")
+	}
+	if w.Header().Get("X-Request-ID") != "req-123" {
+		t.Error("Expected request ID to survive recovery")
+	}
+	if s.panics.Load() != 1 {
+		t.Errorf("Expected panic count 1, got %d", s.panics.Load())
+	}
+
+	// One panic line with the stack, then the access log line with 500
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	var panicLog, accessLog map[string]any
+	json.Unmarshal([]byte(lines[0]), &panicLog)
+	json.Unmarshal([]byte(lines[1]), &accessLog)
+
+	if panicLog["msg"] != "panic recovered" || panicLog["panic"] != "boom" || panicLog["request_id"] != "req-123" {
+		t.Errorf("Unexpected panic log: %v", panicLog)
+	}
+	if stack, _ := panicLog["stack"].(string); !strings.Contains(stack, "TestRecoverBeforeWrite") {
+		t.Errorf("Expected stack trace pointing at the handler, got %q", stack)
+	}
+	if accessLog["status"] != float64(500) || accessLog["request_id"] != "req-123" {
+		t.Errorf("Unexpected access log: %v", accessLog)
+	}
+}
+
+func TestRecoverAfterWrite(t *testing.T) {
+	var buf bytes.Buffer
+	s := newPanicServer(&buf)
+	srv := httptest.NewUnstartedServer(withGlobal(s, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic("halfway")
+	}))
+	// net/http reports "superfluous response.WriteHeader" to ErrorLog
+	var serverLog bytes.Buffer
+	srv.Config.ErrorLog = log.New(&serverLog, "", 0)
+	srv.Start()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	srv.Close() // waits for the handler, so the logs are complete
+
+	// The status line was already sent, so the only honest signal left
+	// is a broken connection - never a second WriteHeader.
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected original status 200, got %d", resp.StatusCode)
+	}
+	if err == nil {
+		t.Error("Expected truncated body to fail reading")
+	}
+	if s.panics.Load() != 1 {
+		t.Errorf("Expected panic count 1, got %d", s.panics.Load())
+	}
+	if strings.Contains(serverLog.String(), "superfluous") {
+		t.Errorf("Headers were written twice: %s", serverLog.String())
+	}
+}
+
+func TestRecoverPassesAbortHandler(t *testing.T) {
+	var buf bytes.Buffer
+	s := newPanicServer(&buf)
+	h := s.recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("Expected ErrAbortHandler to propagate, got %v", rec)
+		}
+		if s.panics.Load() != 0 {
+			t.Error("Deliberate aborts should not be counted as panics")
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestRecoverNoPanic(t *testing.T) {
+	var buf bytes.Buffer
+	s := newPanicServer(&buf)
+	h := s.recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusAccepted || s.panics.Load() != 0 || buf.Len() != 0 {
+		t.Errorf("Expected pass-through, got %d, %d panics, log %q", w.Code, s.panics.Load(), buf.String())
+	}
+}
+
+// TestRecoverKeepsOuterHeaders checks the 500 still carries CORS headers
+// and no compression meant for the body that was never sent.
+func TestRecoverKeepsOuterHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	s := newPanicServer(&buf)
+	h := withGlobal(s, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("x"), compressMinSize/2))
+		panic("boom")
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Expected Allow-Origin to survive the panic, got %q", got)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Expected an uncompressed problem, got Content-Encoding %q", got)
+	}
+	if strings.Contains(w.Body.String(), "xxx") {
+		t.Error("Buffered body of the panicking handler leaked into the 500")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// UserStore is the persistence boundary for the users API.
+// Handlers only talk to this interface, so the backing storage
+// (memory, SQLite, ...) can be swapped without touching them.
+// Implementations must be safe for concurrent use.
+//
+// Every user carries a Version that starts at 1 and increases on each
+// update. Update and Delete only succeed when the caller passes the current
+// version, so two clients editing the same user can't overwrite each other.
+type UserStore interface {
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id int) (User, error)
+	Create(ctx context.Context, user User) (User, error)
+	// Update replaces the user if user.Version is still current and
+	// returns it with the new version.
+	Update(ctx context.Context, user User) (User, error)
+	// Delete removes the user if version is still current.
+	Delete(ctx context.Context, id, version int) error
+	// ListAfter returns up to limit users with IDs above afterID, ordered
+	// by ID, so a large table can be walked one page at a time.
+	ListAfter(ctx context.Context, afterID, limit int) ([]User, error)
+	// Begin starts a transaction for bulk creates.
+	Begin(ctx context.Context) (UserTx, error)
+}
+
+// UserTx creates users that other callers only see, and that are only
+// kept, once Commit succeeds. A failed Create (e.g. ErrEmailTaken)
+// doesn't end the transaction: the caller decides whether to carry on or
+// roll back. Rollback after Commit does nothing, so it can be deferred.
+type UserTx interface {
+	Create(ctx context.Context, user User) (User, error)
+	Commit() error
+	Rollback() error
+}
+
+// Sentinel errors returned by every UserStore implementation.
+// Check them with errors.Is.
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrEmailTaken      = errors.New("email already in use")
+	ErrVersionConflict = errors.New("user was modified by another request")
+)
+
+// MemoryUserStore keeps users in a map guarded by a RWMutex.
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	users  map[int]User
+	nextID int
+}
+
+// NewMemoryUserStore returns a store seeded with the given users.
+// New IDs continue after the highest seeded ID; seeds without a
+// version start at version 1.
+func NewMemoryUserStore(seed ...User) *MemoryUserStore {
+	s := &MemoryUserStore{
+		users:  make(map[int]User, len(seed)),
+		nextID: 1,
+	}
+	for _, u := range seed {
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		s.users[u.ID] = u
+		if u.ID >= s.nextID {
+			s.nextID = u.ID + 1
+		}
+	}
+	return s
+}
+
+// List returns all users ordered by ID.
+func (s *MemoryUserStore) List(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// Get returns the user with the given ID.
+func (s *MemoryUserStore) Get(ctx context.Context, id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// Create assigns the next ID and stores the user.
+func (s *MemoryUserStore) Create(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emailTaken(user.Email, 0) {
+		return User{}, ErrEmailTaken
+	}
+	user.ID = s.nextID
+	user.Version = 1
+	s.nextID++
+	s.users[user.ID] = user
+	return user, nil
+}
+
+// Update replaces the stored user that has user.ID, provided user.Version
+// matches the stored version.
+func (s *MemoryUserStore) Update(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.users[user.ID]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if current.Version != user.Version {
+		return User{}, ErrVersionConflict
+	}
+	if s.emailTaken(user.Email, user.ID) {
+		return User{}, ErrEmailTaken
+	}
+	user.Version++
+	s.users[user.ID] = user
+	return user, nil
+}
+
+// Delete removes the user with the given ID and version.
+func (s *MemoryUserStore) Delete(ctx context.Context, id, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if current.Version != version {
+		return ErrVersionConflict
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// ListAfter returns up to limit users with IDs above afterID.
+func (s *MemoryUserStore) ListAfter(ctx context.Context, afterID, limit int) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := []User{}
+	for id, u := range s.users {
+		if id > afterID {
+			page = append(page, u)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	return page, nil
+}
+
+// Begin starts a transaction. Creates are staged and only take the lock
+// briefly, so a long import doesn't block other requests.
+func (s *MemoryUserStore) Begin(ctx context.Context) (UserTx, error) {
+	return &memoryUserTx{s: s}, nil
+}
+
+// memoryUserTx stages users until Commit. IDs are reserved as users are
+// staged, so a rolled back transaction leaves a gap, like AUTOINCREMENT.
+type memoryUserTx struct {
+	s       *MemoryUserStore
+	pending []User
+	done    bool
+}
+
+func (tx *memoryUserTx) Create(ctx context.Context, user User) (User, error) {
+	if tx.done {
+		return User{}, sql.ErrTxDone
+	}
+	tx.s.mu.Lock()
+	defer tx.s.mu.Unlock()
+
+	if tx.s.emailTaken(user.Email, 0) || tx.staged(user.Email) {
+		return User{}, ErrEmailTaken
+	}
+	user.ID = tx.s.nextID
+	user.Version = 1
+	tx.s.nextID++
+	tx.pending = append(tx.pending, user)
+	return user, nil
+}
+
+// Commit stores every staged user, or none if one of their emails was
+// taken by another request in the meantime.
+func (tx *memoryUserTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	tx.s.mu.Lock()
+	defer tx.s.mu.Unlock()
+
+	for _, u := range tx.pending {
+		if tx.s.emailTaken(u.Email, 0) {
+			return ErrEmailTaken
+		}
+	}
+	for _, u := range tx.pending {
+		tx.s.users[u.ID] = u
+	}
+	return nil
+}
+
+func (tx *memoryUserTx) Rollback() error {
+	tx.done = true
+	tx.pending = nil
+	return nil
+}
+
+func (tx *memoryUserTx) staged(email string) bool {
+	for _, u := range tx.pending {
+		if u.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// emailTaken mirrors the UNIQUE constraint on users.email in the SQL schema.
+// The caller must hold s.mu.
+func (s *MemoryUserStore) emailTaken(email string, exceptID int) bool {
+	for id, u := range s.users {
+		if id != exceptID && u.Email == email {
+			return true
+		}
+	}
+	return false
+}
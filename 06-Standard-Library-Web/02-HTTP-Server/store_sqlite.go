@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// usersSchema is the users table from 05-Database, so both lessons
+// can share the same database file. The version column is added by
+// migrateVersion for tables created by 05-Database itself.
+const usersSchema = `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		email TEXT NOT NULL UNIQUE,
+		version INTEGER NOT NULL DEFAULT 1
+	)`
+
+// SQLUserStore stores users in SQLite through database/sql.
+type SQLUserStore struct {
+	db *sql.DB
+}
+
+// NewSQLUserStore creates the users table if needed and returns a store
+// backed by db. The caller owns db and is responsible for closing it.
+func NewSQLUserStore(ctx context.Context, db *sql.DB) (*SQLUserStore, error) {
+	if _, err := db.ExecContext(ctx, usersSchema); err != nil {
+		return nil, fmt.Errorf("create users table: %w", err)
+	}
+	if err := migrateVersion(ctx, db); err != nil {
+		return nil, fmt.Errorf("add version column: %w", err)
+	}
+	return &SQLUserStore{db: db}, nil
+}
+
+// migrateVersion adds the version column to a users table that was
+// created without it.
+func migrateVersion(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info('users')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		if column == "version" {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.ExecContext(ctx, "ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1")
+	return err
+}
+
+// List returns all users ordered by ID.
+func (s *SQLUserStore) List(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, email, version FROM users ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Version); err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	return users, nil
+}
+
+// Get returns the user with the given ID.
+func (s *SQLUserStore) Get(ctx context.Context, id int) (User, error) {
+	var u User
+	err := s.db.QueryRowContext(ctx, "SELECT id, name, email, version FROM users WHERE id = ?", id).
+		Scan(&u.ID, &u.Name, &u.Email, &u.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("get user %d: %w", id, err)
+	}
+	return u, nil
+}
+
+// Create inserts the user and returns it with its generated ID.
+func (s *SQLUserStore) Create(ctx context.Context, user User) (User, error) {
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO users (name, email, version) VALUES (?, ?, 1)", user.Name, user.Email)
+	if err != nil {
+		return User{}, sqlError("create user", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, fmt.Errorf("create user: %w", err)
+	}
+	user.ID = int(id)
+	user.Version = 1
+	return user, nil
+}
+
+// Update replaces the stored user that has user.ID, provided user.Version
+// matches. The version check and the write happen in one statement, so
+// there is no window for another request to slip in between.
+func (s *SQLUserStore) Update(ctx context.Context, user User) (User, error) {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE users SET name = ?, email = ?, version = version + 1 WHERE id = ? AND version = ?",
+		user.Name, user.Email, user.ID, user.Version)
+	if err != nil {
+		return User{}, sqlError("update user", err)
+	}
+	if err := s.expectOneRow(ctx, result, user.ID); err != nil {
+		return User{}, err
+	}
+	user.Version++
+	return user, nil
+}
+
+// Delete removes the user with the given ID and version.
+func (s *SQLUserStore) Delete(ctx context.Context, id, version int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = ? AND version = ?", id, version)
+	if err != nil {
+		return fmt.Errorf("delete user %d: %w", id, err)
+	}
+	return s.expectOneRow(ctx, result, id)
+}
+
+// Ping checks that the database answers, for the readiness probe.
+func (s *SQLUserStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// ListAfter returns up to limit users with IDs above afterID. Each page
+// is a separate query, so no connection is held between pages.
+func (s *SQLUserStore) ListAfter(ctx context.Context, afterID, limit int) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, name, email, version FROM users WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Version); err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	return users, nil
+}
+
+// Begin starts a database transaction. SQLite rolls back only the failing
+// statement on a constraint error, so the transaction stays usable.
+func (s *SQLUserStore) Begin(ctx context.Context) (UserTx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	return sqlUserTx{tx}, nil
+}
+
+type sqlUserTx struct {
+	tx *sql.Tx
+}
+
+func (t sqlUserTx) Create(ctx context.Context, user User) (User, error) {
+	result, err := t.tx.ExecContext(ctx,
+		"INSERT INTO users (name, email, version) VALUES (?, ?, 1)", user.Name, user.Email)
+	if err != nil {
+		return User{}, sqlError("create user", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, fmt.Errorf("create user: %w", err)
+	}
+	user.ID = int(id)
+	user.Version = 1
+	return user, nil
+}
+
+func (t sqlUserTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t sqlUserTx) Rollback() error {
+	if err := t.tx.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
+
+// expectOneRow explains why a conditional write touched no rows:
+// either the user is gone or its version moved on.
+func (s *SQLUserStore) expectOneRow(ctx context.Context, result sql.Result, id int) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	return ErrVersionConflict
+}
+
+// sqlError maps driver errors onto the store's sentinel errors.
+func sqlError(op string, err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrEmailTaken
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// storeFactories lists every UserStore implementation. Each test below
+// runs against all of them so the backends stay interchangeable.
+var storeFactories = map[string]func(t *testing.T) UserStore{
+	"memory": func(t *testing.T) UserStore {
+		return NewMemoryUserStore()
+	},
+	"sqlite": func(t *testing.T) UserStore {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every connection to ":memory:" is a separate database,
+		// so pin the pool to a single connection.
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+
+		store, err := NewSQLUserStore(context.Background(), db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	},
+}
+
+func forEachStore(t *testing.T, test func(t *testing.T, store UserStore)) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+func TestUserStoreCreateGet(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+
+		alice, err := store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		bob, err := store.Create(ctx, User{Name: "Bob", Email: "bob@example.com"})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if alice.ID == 0 || bob.ID <= alice.ID {
+			t.Errorf("Expected increasing IDs, got %d and %d", alice.ID, bob.ID)
+		}
+
+		got, err := store.Get(ctx, bob.ID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if got != bob {
+			t.Errorf("Expected %+v, got %+v", bob, got)
+		}
+
+		if _, err := store.Get(ctx, 999); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+	})
+}
+
+func TestUserStoreList(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+
+		users, err := store.List(ctx)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if users == nil || len(users) != 0 {
+			t.Errorf("Expected empty non-nil list, got %#v", users)
+		}
+
+		for i := 0; i < 3; i++ {
+			email := fmt.Sprintf("user%d@example.com", i)
+			if _, err := store.Create(ctx, User{Name: "User", Email: email}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+
+		users, err = store.List(ctx)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(users) != 3 {
+			t.Fatalf("Expected 3 users, got %d", len(users))
+		}
+		for i := 1; i < len(users); i++ {
+			if users[i-1].ID >= users[i].ID {
+				t.Errorf("List not ordered by ID: %+v", users)
+			}
+		}
+	})
+}
+
+func TestUserStoreUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		alice, _ := store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"})
+		bob, _ := store.Create(ctx, User{Name: "Bob", Email: "bob@example.com"})
+
+		alice.Name = "Alicia"
+		updated, err := store.Update(ctx, alice)
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if updated.Version != alice.Version+1 {
+			t.Errorf("Expected version %d, got %d", alice.Version+1, updated.Version)
+		}
+		if got, _ := store.Get(ctx, alice.ID); got != updated {
+			t.Errorf("Expected %+v, got %+v", updated, got)
+		}
+
+		bob.Email = alice.Email
+		if _, err := store.Update(ctx, bob); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("Expected ErrEmailTaken, got %v", err)
+		}
+
+		if _, err := store.Update(ctx, User{ID: 999, Name: "Ghost", Email: "ghost@example.com"}); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+	})
+}
+
+func TestUserStoreDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		alice, _ := store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"})
+
+		if err := store.Delete(ctx, alice.ID, alice.Version); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.Get(ctx, alice.ID); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound after delete, got %v", err)
+		}
+		if err := store.Delete(ctx, alice.ID, alice.Version); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound on second delete, got %v", err)
+		}
+	})
+}
+
+func TestUserStoreVersionConflict(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		alice, _ := store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"})
+		if alice.Version != 1 {
+			t.Errorf("Expected new user at version 1, got %d", alice.Version)
+		}
+
+		first := alice
+		first.Name = "First"
+		if _, err := store.Update(ctx, first); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		// alice still carries version 1, which is now stale
+		second := alice
+		second.Name = "Second"
+		if _, err := store.Update(ctx, second); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("Expected ErrVersionConflict on update, got %v", err)
+		}
+		if err := store.Delete(ctx, alice.ID, alice.Version); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("Expected ErrVersionConflict on delete, got %v", err)
+		}
+		if got, _ := store.Get(ctx, alice.ID); got.Name != "First" {
+			t.Errorf("Expected the first write to survive, got %+v", got)
+		}
+	})
+}
+
+// TestUserStoreConcurrentUpdate checks that exactly one of several writers
+// holding the same version wins. Run with -race.
+func TestUserStoreConcurrentUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		alice, _ := store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"})
+		const writers = 10
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		wins := 0
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				user := alice
+				user.Name = fmt.Sprintf("Writer %d", i)
+				_, err := store.Update(ctx, user)
+				switch {
+				case err == nil:
+					mu.Lock()
+					wins++
+					mu.Unlock()
+				case !errors.Is(err, ErrVersionConflict):
+					t.Errorf("Update: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if wins != 1 {
+			t.Errorf("Expected exactly one winning update, got %d", wins)
+		}
+	})
+}
+
+// TestSQLUserStoreMigratesVersion opens a table created with the
+// 05-Database schema, which has no version column.
+func TestSQLUserStoreMigratesVersion(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		email TEXT NOT NULL UNIQUE
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (name, email) VALUES ('Alice', 'alice@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLUserStore(ctx, db)
+	if err != nil {
+		t.Fatalf("NewSQLUserStore: %v", err)
+	}
+	alice, err := store.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if alice.Version != 1 {
+		t.Errorf("Expected existing rows at version 1, got %d", alice.Version)
+	}
+
+	// Opening the store again must not try to add the column twice
+	if _, err := NewSQLUserStore(ctx, db); err != nil {
+		t.Errorf("Second NewSQLUserStore: %v", err)
+	}
+}
+
+func TestUserStoreDuplicateEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		if _, err := store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if _, err := store.Create(ctx, User{Name: "Alice 2", Email: "alice@example.com"}); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("Expected ErrEmailTaken, got %v", err)
+		}
+	})
+}
+
+func TestUserStoreListAfter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		for i := 0; i < 5; i++ {
+			if _, err := store.Create(ctx, User{Name: "User", Email: fmt.Sprintf("user%d@example.com", i)}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+
+		var ids []int
+		after := 0
+		for {
+			page, err := store.ListAfter(ctx, after, 2)
+			if err != nil {
+				t.Fatalf("ListAfter: %v", err)
+			}
+			if len(page) > 2 {
+				t.Fatalf("Expected at most 2 users, got %d", len(page))
+			}
+			for _, u := range page {
+				ids = append(ids, u.ID)
+			}
+			if len(page) < 2 {
+				break
+			}
+			after = page[len(page)-1].ID
+		}
+		if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+			t.Errorf("Expected every user once in ID order, got %v", ids)
+		}
+	})
+}
+
+func TestUserStoreTx(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		store.Create(ctx, User{Name: "Alice", Email: "alice@example.com"})
+
+		tx, err := store.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		if _, err := tx.Create(ctx, User{Name: "Bob", Email: "bob@example.com"}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		// A taken email fails that create only, not the transaction
+		if _, err := tx.Create(ctx, User{Name: "Alice 2", Email: "alice@example.com"}); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("Expected ErrEmailTaken, got %v", err)
+		}
+		if _, err := tx.Create(ctx, User{Name: "Bob 2", Email: "bob@example.com"}); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("Expected ErrEmailTaken for an email taken in the same transaction, got %v", err)
+		}
+		carol, err := tx.Create(ctx, User{Name: "Carol", Email: "carol@example.com"})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Errorf("Expected Rollback after Commit to be a no-op, got %v", err)
+		}
+		if got, err := store.Get(ctx, carol.ID); err != nil || got.Email != carol.Email {
+			t.Errorf("Expected committed user %+v, got %+v %v", carol, got, err)
+		}
+
+		tx, err = store.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		dave, err := tx.Create(ctx, User{Name: "Dave", Email: "dave@example.com"})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+		if _, err := store.Get(ctx, dave.ID); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected rolled back user to be gone, got %v", err)
+		}
+		if n := countUsers(t, store); n != 3 {
+			t.Errorf("Expected 3 users, got %d", n)
+		}
+	})
+}
+
+// TestUserStoreConcurrentCreate is meant to be run with -race.
+func TestUserStoreConcurrentCreate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store UserStore) {
+		ctx := context.Background()
+		const workers = 20
+
+		var wg sync.WaitGroup
+		ids := make(chan int, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				user, err := store.Create(ctx, User{Name: "User", Email: fmt.Sprintf("u%d@example.com", i)})
+				if err != nil {
+					t.Errorf("Create: %v", err)
+					return
+				}
+				ids <- user.ID
+				store.List(ctx)
+			}(i)
+		}
+		wg.Wait()
+		close(ids)
+
+		seen := make(map[int]bool)
+		for id := range ids {
+			if seen[id] {
+				t.Errorf("Duplicate ID %d", id)
+			}
+			seen[id] = true
+		}
+		if len(seen) != workers {
+			t.Errorf("Expected %d users, got %d", workers, len(seen))
+		}
+	})
+}
+
+// TestConcurrentCreateHandler drives the HTTP handler from many goroutines.
+func TestConcurrentCreateHandler(t *testing.T) {
+	s, store := newTestServer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name":"User","email":"c%d@example.com"}`, i)
+			if w := serve(s, "POST", "/users", body); w.Code != 201 {
+				t.Errorf("Expected 201, got %d", w.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	users, _ := store.List(context.Background())
+	if len(users) != len(seedUsers)+20 {
+		t.Errorf("Expected %d users, got %d", len(seedUsers)+20, len(users))
+	}
+}
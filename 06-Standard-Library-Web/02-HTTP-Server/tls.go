@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// certReloadInterval is how often certificate files are checked for
+	// changes. Renewal tools (certbot, cert-manager) replace them in place.
+	certReloadInterval = 10 * time.Second
+	// devCertValidity is the lifetime of a generated localhost certificate.
+	devCertValidity = 90 * 24 * time.Hour
+	// devCertRenewBefore regenerates a cached certificate this close to expiry.
+	devCertRenewBefore = 7 * 24 * time.Hour
+)
+
+// devCertHosts are the names a generated development certificate covers.
+var devCertHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// tlsSettings says whether and how to serve HTTPS.
+type tlsSettings struct {
+	Enabled bool
+	// CertFile and KeyFile are PEM files. When both are empty a
+	// self-signed localhost certificate is generated in DevCertDir.
+	CertFile, KeyFile string
+	DevCertDir        string
+	// ClientCAFile enables mutual TLS: protected routes then require a
+	// client certificate signed by one of these CAs.
+	ClientCAFile string
+}
+
+// tlsSettingsFromEnv reads TLS ("on" to enable), TLS_CERT_FILE,
+// TLS_KEY_FILE, TLS_CLIENT_CA and TLS_DEV_CERT_DIR. Setting a certificate
+// or client CA enables TLS as well.
+func tlsSettingsFromEnv() (tlsSettings, error) {
+	cfg := tlsSettings{
+		Enabled:      os.Getenv("TLS") == "on",
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA"),
+		DevCertDir:   os.Getenv("TLS_DEV_CERT_DIR"),
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return cfg, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.CertFile != "" || cfg.ClientCAFile != "" {
+		cfg.Enabled = true
+	}
+	if cfg.DevCertDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		cfg.DevCertDir = filepath.Join(dir, "go-learning-lab", "http-server")
+	}
+	return cfg, nil
+}
+
+// certReloader serves the certificate from CertFile/KeyFile and picks up
+// replacements without a restart. Connections already open keep the
+// certificate they were established with.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte // contents the current cert was loaded from
+	keyPEM  []byte
+}
+
+// newCertReloader loads the key pair once, failing if it is invalid.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads both files and swaps the certificate if they changed.
+// On error the previous certificate stays in use.
+func (r *certReloader) reload() (changed bool, err error) {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	same := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	// A renewal tool may have written the cert but not yet the key
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("load %s: %w", r.certFile, err)
+	}
+
+	r.mu.Lock()
+	r.cert, r.certPEM, r.keyPEM = &cert, certPEM, keyPEM
+	r.mu.Unlock()
+	return true, nil
+}
+
+// watch polls the files every interval until ctx is done. Comparing
+// contents rather than modification times also catches replacements
+// within the file system's timestamp resolution.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := r.reload()
+			if err != nil {
+				log.Printf("Certificate reload failed, keeping the current one: %v", err)
+			} else if changed {
+				log.Printf("Reloaded certificate from %s", r.certFile)
+			}
+		}
+	}
+}
+
+// GetCertificate is the tls.Config hook; it runs on every handshake.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// newTLSConfig serves certificates from r and offers HTTP/2 via ALPN.
+// With clientCAs set, client certificates are verified when presented;
+// requireClientCert decides which routes insist on one, so public routes
+// such as /health keep working for clients without a certificate.
+func newTLSConfig(r *certReloader, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAs != nil {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		cfg.ClientCAs = clientCAs
+	}
+	return cfg
+}
+
+// loadCertPool reads PEM certificates from file into a new pool.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", file)
+	}
+	return pool, nil
+}
+
+// setupTLS prepares srv for HTTPS according to cfg and keeps the
+// certificate fresh until ctx is done.
+func (s *server) setupTLS(ctx context.Context, srv *http.Server, cfg tlsSettings) error {
+	certFile, keyFile := cfg.CertFile, cfg.KeyFile
+	if certFile == "" {
+		var err error
+		certFile, keyFile, err = devCertificate(cfg.DevCertDir, time.Now())
+		if err != nil {
+			return fmt.Errorf("development certificate: %w", err)
+		}
+		log.Printf("Using self-signed development certificate %s", certFile)
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	go reloader.watch(ctx, certReloadInterval)
+
+	var clientCAs *x509.CertPool
+	if cfg.ClientCAFile != "" {
+		if clientCAs, err = loadCertPool(cfg.ClientCAFile); err != nil {
+			return err
+		}
+		s.mtls = true
+	}
+	srv.TLSConfig = newTLSConfig(reloader, clientCAs)
+	return nil
+}
+
+// devCertificate returns cert.pem and key.pem in dir, generating a
+// self-signed ECDSA certificate for localhost when none is cached or the
+// cached one is about to expire.
+func devCertificate(dir string, now time.Time) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if devCertUsable(certFile, keyFile, now) {
+		return certFile, keyFile, nil
+	}
+
+	certPEM, keyPEM, err := selfSignedCert(devCertHosts, now, devCertValidity)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	// Key first: a reader that sees the new cert must also find its key
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// devCertUsable reports whether a cached key pair loads and stays valid
+// for a while longer.
+func devCertUsable(certFile, keyFile string, now time.Time) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return now.After(cert.NotBefore) && now.Add(devCertRenewBefore).Before(cert.NotAfter) &&
+		cert.VerifyHostname("localhost") == nil
+}
+
+// selfSignedCert creates a P-256 certificate for hosts (DNS names or IP
+// addresses) valid from now for validity, PEM-encoded with its key.
+func selfSignedCert(hosts []string, now time.Time, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Go Learning Lab"}, CommonName: hosts[0]},
+		// Backdated a little so clients with a slow clock accept it
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// Middleware: Client certificates
+// requireClientCert rejects requests without a verified client
+// certificate when mutual TLS is configured, and does nothing otherwise.
+// The TLS handshake has already checked the chain against the client CAs.
+func (s *server) requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.mtls && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			writeError(w, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertSubject returns the common name of a verified client
+// certificate, or "" if the request has none.
+func clientCertSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTLSServer serves s.handler over TLS on an ephemeral port and
+// returns the base URL.
+func startTLSServer(t *testing.T, s *server, cfg tlsSettings) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{Handler: s.handler()}
+	if err := s.setupTLS(ctx, srv, cfg); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(ctx, srv, ln, lifecycleConfig{DrainTimeout: time.Second})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, s.ready.Load)
+	return "https://" + ln.Addr().String()
+}
+
+// tlsClient trusts the PEM certificate in caFile and presents clientCert,
+// if any, over HTTP/2.
+func tlsClient(t *testing.T, caFile string, clientCert ...tls.Certificate) *http.Client {
+	t.Helper()
+	roots, err := loadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: clientCert},
+		ForceAttemptHTTP2: true,
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+// testCA is a throwaway certificate authority for client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM certificate, for TLS_CLIENT_CA
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(dir, "client-ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue returns a client certificate for name signed by the CA.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	now := time.Now()
+	certPEM, keyPEM, err := selfSignedCert(devCertHosts, now, devCertValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Generated pair does not load: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(pair.Certificate[0])
+
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected an ECDSA key, got %T", cert.PublicKey)
+	}
+	for _, host := range devCertHosts {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("Certificate does not cover %s: %v", host, err)
+		}
+	}
+	if !cert.NotAfter.Equal(now.Add(devCertValidity).Truncate(time.Second)) {
+		t.Errorf("Unexpected expiry %s", cert.NotAfter)
+	}
+}
+
+func TestDevCertificateCached(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "certs")
+	now := time.Now()
+
+	certFile, _, err := devCertificate(dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := os.ReadFile(certFile)
+
+	if _, _, err := devCertificate(dir, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := os.ReadFile(certFile); string(cached) != string(first) {
+		t.Error("Valid cached certificate was regenerated")
+	}
+
+	// Close to expiry it is replaced
+	if _, _, err := devCertificate(dir, now.Add(devCertValidity-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if renewed, _ := os.ReadFile(certFile); string(renewed) == string(first) {
+		t.Error("Expiring certificate was not regenerated")
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "key.pem")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected key.pem with mode 0600, got %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestTLSServesHTTP2(t *testing.T) {
+	s, _ := newTestServer()
+	dir := t.TempDir()
+	url := startTLSServer(t, s, tlsSettings{Enabled: true, DevCertDir: dir})
+	client := tlsClient(t, filepath.Join(dir, "cert.pem"))
+
+	resp, err := client.Get(strings.Replace(url, "127.0.0.1", "localhost", 1) + "/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair := func(host string) {
+		certPEM, keyPEM, err := selfSignedCert([]string{host}, time.Now(), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(keyFile, keyPEM, 0o600)
+		os.WriteFile(certFile, certPEM, 0o644)
+	}
+	servedName := func(r *certReloader) string {
+		cert, _ := r.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+
+	writePair("old.test")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := r.reload(); changed || err != nil {
+		t.Errorf("Unchanged files reported as change: %v, %v", changed, err)
+	}
+
+	writePair("new.test")
+	if changed, err := r.reload(); !changed || err != nil {
+		t.Fatalf("Expected reload, got %v, %v", changed, err)
+	}
+	if got := servedName(r); got != "new.test" {
+		t.Errorf("Expected new.test after reload, got %s", got)
+	}
+
+	// A broken replacement keeps the last good certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0o644)
+	if _, err := r.reload(); err == nil {
+		t.Error("Expected an error for a broken certificate")
+	}
+	if got := servedName(r); got != "new.test" {
+		t.Errorf("Expected new.test to stay in use, got %s", got)
+	}
+}
+
+func TestCertReloadWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := devCertificate(dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watch(ctx, 5*time.Millisecond)
+
+	certPEM, keyPEM, _ := selfSignedCert([]string{"rotated.test"}, time.Now(), time.Hour)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+	os.WriteFile(certFile, certPEM, 0o644)
+
+	waitFor(t, func() bool {
+		cert, _ := r.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName == "rotated.test"
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	s, _ := newTestServer()
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	url := startTLSServer(t, s, tlsSettings{Enabled: true, DevCertDir: dir, ClientCAFile: ca.file})
+	url = strings.Replace(url, "127.0.0.1", "localhost", 1)
+	token := bearer(t, s, "user")
+
+	get := func(client *http.Client, path string) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", url+path, nil)
+		req.Header.Set("Authorization", token)
+		return client.Do(req)
+	}
+
+	anonymous := tlsClient(t, filepath.Join(dir, "cert.pem"))
+	resp, err := get(anonymous, "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Public route without client certificate: expected 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = get(anonymous, "/protected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p problem
+	json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || p.Detail != "client certificate required" {
+		t.Errorf("Protected route without client certificate: got %d %q", resp.StatusCode, p.Detail)
+	}
+
+	trusted := tlsClient(t, filepath.Join(dir, "cert.pem"), ca.issue(t, "ops-laptop"))
+	resp, err = get(trusted, "/protected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body["client_certificate"] != "ops-laptop" {
+		t.Errorf("Expected 200 for ops-laptop, got %d: %v", resp.StatusCode, body)
+	}
+
+	// The handshake itself fails for certificates from another CA
+	stranger := newTestCA(t, t.TempDir())
+	untrusted := tlsClient(t, filepath.Join(dir, "cert.pem"), stranger.issue(t, "intruder"))
+	if resp, err := get(untrusted, "/health"); err == nil {
+		resp.Body.Close()
+		t.Error("Expected the handshake to reject an unknown client CA")
+	}
+}
+
+func TestRequireClientCertWithoutMTLS(t *testing.T) {
+	s, _ := newTestServer()
+	w := serveAs(s, bearer(t, s, "user"), "GET", "/protected", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected plain HTTP to work without mTLS, got %d", w.Code)
+	}
+}
+
+func TestTLSSettingsFromEnv(t *testing.T) {
+	t.Setenv("TLS", "")
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CLIENT_CA", "")
+	t.Setenv("TLS_DEV_CERT_DIR", "/tmp/certs")
+
+	if cfg, err := tlsSettingsFromEnv(); err != nil || cfg.Enabled {
+		t.Errorf("Expected TLS off by default, got %+v, %v", cfg, err)
+	}
+
+	t.Setenv("TLS_CERT_FILE", "cert.pem")
+	if _, err := tlsSettingsFromEnv(); err == nil {
+		t.Error("Expected an error for a certificate without a key")
+	}
+
+	t.Setenv("TLS_KEY_FILE", "key.pem")
+	cfg, err := tlsSettingsFromEnv()
+	if err != nil || !cfg.Enabled || cfg.DevCertDir != "/tmp/certs" {
+		t.Errorf("Expected TLS on with the given files, got %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Errors returned by tokenAuth.Verify. Check them with errors.Is.
+var (
+	ErrTokenMalformed = errors.New("token is malformed")
+	ErrTokenAlgorithm = errors.New("token algorithm is not HS256")
+	ErrTokenSignature = errors.New("token signature is invalid")
+	ErrTokenExpired   = errors.New("token has expired")
+	ErrTokenIssuer    = errors.New("token issuer is not trusted")
+	ErrTokenAudience  = errors.New("token audience does not match")
+)
+
+// Principal is the authenticated caller, stored in the request context.
+type Principal struct {
+	Subject string
+	Roles   []string
+}
+
+// HasRole reports whether p was granted role.
+func (p Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// claims is the JWT payload (RFC 7519 registered claims plus roles).
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// audience accepts both forms RFC 7519 allows: "api" and ["api", "web"].
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// tokenHeader is the JOSE header. Only HS256 is accepted.
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// tokenAuth issues and verifies HS256 JSON Web Tokens using only
+// crypto/hmac and crypto/sha256.
+type tokenAuth struct {
+	secret   []byte
+	issuer   string
+	audience string
+	ttl      time.Duration
+	now      func() time.Time // replaced in tests
+}
+
+// newTokenAuth returns a tokenAuth. secret should be at least 32 random bytes.
+func newTokenAuth(secret []byte, issuer, audience string, ttl time.Duration) *tokenAuth {
+	return &tokenAuth{
+		secret:   secret,
+		issuer:   issuer,
+		audience: audience,
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+var b64 = base64.RawURLEncoding
+
+// Issue returns a signed token for p and its expiry time.
+func (a *tokenAuth) Issue(p Principal) (string, time.Time, error) {
+	now := a.now()
+	exp := now.Add(a.ttl)
+
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(claims{
+		Issuer:    a.issuer,
+		Subject:   p.Subject,
+		Audience:  audience{a.audience},
+		ExpiresAt: exp.Unix(),
+		IssuedAt:  now.Unix(),
+		Roles:     p.Roles,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	return signingInput + "." + b64.EncodeToString(a.sign(signingInput)), exp, nil
+}
+
+// Verify checks the token's algorithm, signature, expiry, issuer and
+// audience, in that order, and returns the principal it was issued for.
+func (a *tokenAuth) Verify(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, ErrTokenMalformed
+	}
+
+	// The header is checked before the signature so "alg":"none" and
+	// algorithm-confusion tokens are rejected outright.
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, err
+	}
+	if header.Alg != "HS256" {
+		return Principal{}, fmt.Errorf("%w: got %q", ErrTokenAlgorithm, header.Alg)
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, ErrTokenMalformed
+	}
+	if !hmac.Equal(sig, a.sign(parts[0]+"."+parts[1])) {
+		return Principal{}, ErrTokenSignature
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return Principal{}, err
+	}
+	if c.ExpiresAt == 0 || !a.now().Before(time.Unix(c.ExpiresAt, 0)) {
+		return Principal{}, ErrTokenExpired
+	}
+	if c.Issuer != a.issuer {
+		return Principal{}, ErrTokenIssuer
+	}
+	if !slices.Contains(c.Audience, a.audience) {
+		return Principal{}, ErrTokenAudience
+	}
+
+	return Principal{Subject: c.Subject, Roles: c.Roles}, nil
+}
+
+func (a *tokenAuth) sign(signingInput string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+func decodeSegment(seg string, dst any) error {
+	b, err := b64.DecodeString(seg)
+	if err != nil {
+		return ErrTokenMalformed
+	}
+	if err := json.Unmarshal(b, dst); err != nil {
+		return ErrTokenMalformed
+	}
+	return nil
+}
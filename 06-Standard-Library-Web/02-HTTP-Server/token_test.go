@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedClock returns a tokenAuth whose clock can be moved by the test.
+func fixedClock(a *tokenAuth, now *time.Time) *tokenAuth {
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+// forge builds a token from raw header and claims, signed with sign.
+func forge(t *testing.T, header, payload any, sign func(string) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(p)
+	return input + "." + b64.EncodeToString(sign(input))
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	a := newTestAuth()
+	token, exp, err := a.Issue(Principal{Subject: "alice", Roles: []string{"user"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(exp) <= 0 {
+		t.Errorf("Expected expiry in the future, got %v", exp)
+	}
+
+	p, err := a.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if p.Subject != "alice" || !p.HasRole("user") || p.HasRole("admin") {
+		t.Errorf("Unexpected principal: %+v", p)
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := fixedClock(newTestAuth(), &now)
+	valid, _, _ := a.Issue(Principal{Subject: "alice", Roles: []string{"user"}})
+	parts := strings.Split(valid, ".")
+
+	goodClaims := claims{
+		Issuer: a.issuer, Subject: "alice", Audience: audience{a.audience},
+		ExpiresAt: now.Add(time.Hour).Unix(), Roles: []string{"admin"},
+	}
+	hs256 := tokenHeader{Alg: "HS256", Typ: "JWT"}
+
+	withClaims := func(modify func(c *claims)) string {
+		c := goodClaims
+		modify(&c)
+		return forge(t, hs256, c, a.sign)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"empty", "", ErrTokenMalformed},
+		{"two segments", parts[0] + "." + parts[1], ErrTokenMalformed},
+		{"bad base64", parts[0] + ".!!!." + parts[2], ErrTokenSignature},
+		{
+			// Payload swapped for one granting admin, original signature kept
+			"tampered payload",
+			parts[0] + "." + strings.Split(withClaims(func(*claims) {}), ".")[1] + "." + parts[2],
+			ErrTokenSignature,
+		},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + b64.EncodeToString([]byte("nope")), ErrTokenSignature},
+		{"wrong secret", forge(t, hs256, goodClaims, func(s string) []byte {
+			return newTokenAuth([]byte("another-secret-another-secret-xx"), "", "", 0).sign(s)
+		}), ErrTokenSignature},
+		{"alg none", forge(t, tokenHeader{Alg: "none"}, goodClaims, func(string) []byte { return nil }), ErrTokenAlgorithm},
+		{"alg HS512", forge(t, tokenHeader{Alg: "HS512", Typ: "JWT"}, goodClaims, func(s string) []byte {
+			mac := hmac.New(sha512.New, a.secret)
+			mac.Write([]byte(s))
+			return mac.Sum(nil)
+		}), ErrTokenAlgorithm},
+		{"alg RS256", forge(t, tokenHeader{Alg: "RS256"}, goodClaims, a.sign), ErrTokenAlgorithm},
+		{"expired", withClaims(func(c *claims) { c.ExpiresAt = now.Add(-time.Second).Unix() }), ErrTokenExpired},
+		{"expires now", withClaims(func(c *claims) { c.ExpiresAt = now.Unix() }), ErrTokenExpired},
+		{"no expiry", withClaims(func(c *claims) { c.ExpiresAt = 0 }), ErrTokenExpired},
+		{"wrong issuer", withClaims(func(c *claims) { c.Issuer = "evil" }), ErrTokenIssuer},
+		{"wrong audience", withClaims(func(c *claims) { c.Audience = audience{"other"} }), ErrTokenAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.Verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestTokenExpiresWithClock(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := fixedClock(newTestAuth(), &now)
+	token, _, _ := a.Issue(Principal{Subject: "alice"})
+
+	now = now.Add(59 * time.Minute)
+	if _, err := a.Verify(token); err != nil {
+		t.Errorf("Expected token valid before expiry, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := a.Verify(token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestTokenAudienceArray(t *testing.T) {
+	a := newTestAuth()
+	payload := map[string]any{
+		"iss": a.issuer, "sub": "alice", "aud": []string{"other", a.audience},
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	token := forge(t, tokenHeader{Alg: "HS256"}, payload, a.sign)
+
+	if _, err := a.Verify(token); err != nil {
+		t.Errorf("Expected audience list to be accepted, got %v", err)
+	}
+}
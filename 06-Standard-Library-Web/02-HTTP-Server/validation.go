@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxBodyBytes caps request bodies; larger bodies get 413.
+const maxBodyBytes = 1 << 20 // 1 MiB
+
+// maxNameLength is the longest name accepted for a user.
+const maxNameLength = 100
+
+// ValidationError is the custom error type from
+// 04-Error-Handling-Testing/01-Error-Handling, with JSON tags so it can be
+// listed in problem documents.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("validation error on field '%s': %s", e.Field, e.Message)
+}
+
+// ValidationErrors collects every failing field instead of stopping at the
+// first one.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ve := range e {
+		msgs[i] = ve.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateEmail validates an email address (simple version).
+// Same rules as 04-Error-Handling-Testing/04-Table-Driven-Tests.
+func ValidateEmail(email string) bool {
+	if !strings.Contains(email, "@") {
+		return false
+	}
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 {
+		return false
+	}
+	if len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return false
+	}
+	return strings.Contains(parts[1], ".")
+}
+
+// validateName checks a user name and appends any problem to errs.
+func validateName(errs ValidationErrors, name string) ValidationErrors {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return append(errs, ValidationError{"name", "is required"})
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return append(errs, ValidationError{"name", fmt.Sprintf("must be at most %d characters", maxNameLength)})
+	}
+	return errs
+}
+
+// validateEmailField checks an email and appends any problem to errs.
+func validateEmailField(errs ValidationErrors, email string) ValidationErrors {
+	switch {
+	case email == "":
+		return append(errs, ValidationError{"email", "is required"})
+	case !ValidateEmail(email):
+		return append(errs, ValidationError{"email", "must be a valid email address"})
+	}
+	return errs
+}
+
+// validateUser checks a full user for create and replace.
+func validateUser(u User) error {
+	var errs ValidationErrors
+	errs = validateName(errs, u.Name)
+	errs = validateEmailField(errs, u.Email)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate checks only the fields present in a PATCH.
+func (p userPatch) validate() error {
+	var errs ValidationErrors
+	if p.Name != nil {
+		errs = validateName(errs, *p.Name)
+	}
+	if p.Email != nil {
+		errs = validateEmailField(errs, *p.Email)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// decodeJSON strictly decodes the request body into dst. Unknown fields,
+// trailing data and bodies over maxBodyBytes are rejected. On failure it
+// writes a problem response and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil && dec.More() {
+		err = errors.New("body must contain a single JSON object")
+	}
+	if err == nil {
+		return true
+	}
+
+	var (
+		maxBytesErr *http.MaxBytesError
+		syntaxErr   *json.SyntaxError
+		typeErr     *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body must not exceed %d bytes", maxBytesErr.Limit))
+	case errors.Is(err, io.EOF):
+		writeError(w, http.StatusBadRequest, "request body must not be empty")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		writeError(w, http.StatusBadRequest, "malformed JSON: "+err.Error())
+	case errors.As(err, &typeErr) && typeErr.Field == "":
+		writeError(w, http.StatusBadRequest, "request body must be a JSON object")
+	case errors.As(err, &typeErr):
+		writeValidationErrors(w, http.StatusBadRequest, "request body has the wrong shape", ValidationErrors{
+			{typeErr.Field, "must be a " + typeErr.Type.String()},
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeValidationErrors(w, http.StatusBadRequest, "request body has unknown fields", ValidationErrors{
+			{field, "unknown field"},
+		})
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+	return false
+}
+
+// writeInvalid sends the field errors from validateUser or validate as a 422.
+func writeInvalid(w http.ResponseWriter, err error) {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "the user has invalid fields", errs)
+		return
+	}
+	writeError(w, http.StatusUnprocessableEntity, err.Error())
+}
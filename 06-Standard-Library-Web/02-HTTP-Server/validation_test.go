@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeProblem checks w is an RFC 7807 response and returns its body.
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) problem {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Expected application/problem+json, got %q (%s)", ct, w.Body)
+	}
+	var p problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("Failed to decode problem: %v", err)
+	}
+	if p.Status != w.Code {
+		t.Errorf("Problem status %d does not match response %d", p.Status, w.Code)
+	}
+	if p.Type == "" || p.Title == "" {
+		t.Errorf("Problem missing type or title: %+v", p)
+	}
+	return p
+}
+
+func fields(errs []ValidationError) string {
+	names := make([]string, len(errs))
+	for i, e := range errs {
+		names[i] = e.Field
+	}
+	return strings.Join(names, ",")
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"user@example.com", true},
+		{"a@b.co", true},
+		{"", false},
+		{"userexample.com", false},
+		{"user@", false},
+		{"@example.com", false},
+		{"user@example", false},
+		{"a@b@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			if got := ValidateEmail(tt.email); got != tt.want {
+				t.Errorf("ValidateEmail(%q) = %v, want %v", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		fields string
+	}{
+		{"valid", `{"name":"Carol","email":"carol@example.com"}`, http.StatusCreated, ""},
+		{"empty object", `{}`, http.StatusUnprocessableEntity, "name,email"},
+		{"blank name bad email", `{"name":"  ","email":"carol"}`, http.StatusUnprocessableEntity, "name,email"},
+		{"long name", fmt.Sprintf(`{"name":%q,"email":"c@example.com"}`, strings.Repeat("x", 101)), http.StatusUnprocessableEntity, "name"},
+		{"unknown field", `{"name":"Carol","email":"carol@example.com","admin":true}`, http.StatusBadRequest, "admin"},
+		{"wrong type", `{"name":42,"email":"carol@example.com"}`, http.StatusBadRequest, "name"},
+		{"not an object", `["Carol"]`, http.StatusBadRequest, ""},
+		{"malformed", `{"name":`, http.StatusBadRequest, ""},
+		{"empty body", ``, http.StatusBadRequest, ""},
+		{"trailing data", `{"name":"Carol","email":"carol@example.com"} {}`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+			w := serve(s, "POST", "/users", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.status == http.StatusCreated {
+				return
+			}
+			p := decodeProblem(t, w)
+			if got := fields(p.Errors); got != tt.fields {
+				t.Errorf("Expected errors for [%s], got [%s]", tt.fields, got)
+			}
+		})
+	}
+}
+
+func TestCreateUserBodyTooLarge(t *testing.T) {
+	s, _ := newTestServer()
+	body := `{"name":"` + strings.Repeat("x", maxBodyBytes) + `","email":"big@example.com"}`
+	w := serve(s, "POST", "/users", body)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status 413, got %d", w.Code)
+	}
+	decodeProblem(t, w)
+}
+
+func TestReplaceAndPatchValidation(t *testing.T) {
+	s, store := newTestServer()
+
+	w := serve(s, "PUT", "/users/1", `{"name":"","email":"nope"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected PUT status 422, got %d", w.Code)
+	}
+	if got := fields(decodeProblem(t, w).Errors); got != "name,email" {
+		t.Errorf("Expected PUT errors for name,email, got %s", got)
+	}
+
+	// PATCH only validates the fields it sends
+	w = serve(s, "PATCH", "/users/1", `{"email":"nope"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected PATCH status 422, got %d", w.Code)
+	}
+	if got := fields(decodeProblem(t, w).Errors); got != "email" {
+		t.Errorf("Expected PATCH errors for email, got %s", got)
+	}
+
+	if got := mustGet(t, store, 1); got.Email != "alice@example.com" {
+		t.Errorf("Invalid update was applied: %+v", got)
+	}
+}
+
+func TestRouterErrorsAreProblems(t *testing.T) {
+	s, _ := newTestServer()
+
+	w := serve(s, "GET", "/nowhere", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", w.Code)
+	}
+	decodeProblem(t, w)
+
+	w = serve(s, "PUT", "/users", "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405, got %d", w.Code)
+	}
+	if w.Header().Get("Allow") == "" {
+		t.Error("Expected Allow header on 405")
+	}
+	if p := decodeProblem(t, w); !strings.Contains(p.Detail, "GET") {
+		t.Errorf("Expected allowed methods in detail, got %q", p.Detail)
+	}
+
+	w = serve(s, "GET", "/protected", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d", w.Code)
+	}
+	decodeProblem(t, w)
+}
@@ -0,0 +1,303 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Close codes from RFC 6455 section 7.4 and the IANA registry.
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001 // server shutting down, page closed
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005 // received a close frame without a code; never sent
+	CloseAbnormal           = 1006 // connection dropped without a close frame; never sent
+	CloseInvalidPayload     = 1007 // e.g. invalid UTF-8 in a text message
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+	CloseTryAgainLater      = 1013
+)
+
+// closeTimeout is how long Close waits for the peer's close frame before
+// dropping the connection.
+const closeTimeout = 5 * time.Second
+
+// ErrCloseSent is returned by writes after a close frame has been sent.
+var ErrCloseSent = errors.New("websocket: close frame already sent")
+
+// CloseError is returned by ReadMessage once the connection has been
+// closed with a close frame, by the peer or because the peer broke the
+// protocol. Code is CloseNoStatus when the peer's frame had no code.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// CloseStatus returns the close code carried by err, or CloseAbnormal if
+// the connection ended without a close handshake.
+func CloseStatus(err error) int {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return CloseAbnormal
+}
+
+// Conn is an open WebSocket connection. One goroutine may call
+// ReadMessage while others write: writes are serialized internally, so
+// the pongs ReadMessage sends never interleave with a message.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // client frames are masked, server frames are not
+
+	// Read side, owned by the goroutine calling ReadMessage
+	readLimit   int64
+	pongHandler func(data []byte)
+	readErr     error
+
+	writeMu   sync.Mutex
+	closeSent bool
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, br: br, client: client, readLimit: DefaultReadLimit}
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts, after
+// reassembling fragments. A larger message closes the connection with
+// CloseMessageTooBig. The default is DefaultReadLimit, which 0 or less
+// restores.
+func (c *Conn) SetReadLimit(n int64) {
+	if n <= 0 {
+		n = DefaultReadLimit
+	}
+	c.readLimit = n
+}
+
+// SetPongHandler sets a function called by ReadMessage for each pong,
+// typically to extend the read deadline. It must be set before reading.
+func (c *Conn) SetPongHandler(h func(data []byte)) { c.pongHandler = h }
+
+// SetReadDeadline and SetWriteDeadline set deadlines on the underlying
+// connection.
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// RemoteAddr returns the peer's network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// ReadMessage returns the next text or binary message, joining fragments.
+// Pings are answered and pongs passed to the pong handler along the way.
+// After a close frame, in either direction, it returns a *CloseError;
+// every error is final and returned again by later calls.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	var typ Opcode
+	var msg []byte
+	for {
+		f, err := ReadFrame(c.br, c.frameLimit(len(msg)))
+		if errors.Is(err, ErrFrameTooLarge) {
+			return c.fail(CloseMessageTooBig, "message too large")
+		}
+		if err != nil {
+			c.closeConn()
+			c.readErr = err
+			return 0, nil, err
+		}
+		if reason := c.check(f); reason != "" {
+			return c.fail(CloseProtocolError, reason)
+		}
+
+		switch f.Opcode {
+		case OpPing:
+			if err := c.writeFrame(Frame{Fin: true, Opcode: OpPong, Payload: f.Payload}); err != nil && !errors.Is(err, ErrCloseSent) {
+				c.readErr = err
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			if c.pongHandler != nil {
+				c.pongHandler(f.Payload)
+			}
+			continue
+		case OpClose:
+			return c.handleClose(f.Payload)
+		case OpContinuation:
+			if typ == 0 {
+				return c.fail(CloseProtocolError, "continuation frame without a message")
+			}
+		default:
+			if typ != 0 {
+				return c.fail(CloseProtocolError, "new message before the last one finished")
+			}
+			typ = f.Opcode
+		}
+
+		if int64(len(msg)+len(f.Payload)) > c.readLimit {
+			return c.fail(CloseMessageTooBig, "message too large")
+		}
+		msg = append(msg, f.Payload...)
+		if f.Fin {
+			if typ == OpText && !utf8.Valid(msg) {
+				return c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+			}
+			return typ, msg, nil
+		}
+	}
+}
+
+// frameLimit is the largest frame ReadFrame may accept with n bytes of
+// the message already read; control frames always fit.
+func (c *Conn) frameLimit(n int) int64 {
+	return max(c.readLimit-int64(n), maxControlPayload)
+}
+
+// check returns why f breaks the protocol, or "" if it doesn't.
+func (c *Conn) check(f Frame) string {
+	switch {
+	case f.Rsv != 0:
+		return "reserved bits set without an extension"
+	case !f.Opcode.valid():
+		return "unknown " + f.Opcode.String()
+	case c.client && f.Masked:
+		return "server frames must not be masked"
+	case !c.client && !f.Masked:
+		return "client frames must be masked"
+	case f.Opcode.IsControl() && !f.Fin:
+		return "fragmented " + f.Opcode.String() + " frame"
+	case f.Opcode.IsControl() && len(f.Payload) > maxControlPayload:
+		return f.Opcode.String() + " frame too long"
+	}
+	return ""
+}
+
+// handleClose answers the peer's close frame with the same code, unless
+// this side started the handshake, and closes the connection.
+func (c *Conn) handleClose(payload []byte) (Opcode, []byte, error) {
+	code, reason := CloseNoStatus, ""
+	if len(payload) > 0 {
+		if len(payload) < 2 {
+			return c.fail(CloseProtocolError, "close frame too short")
+		}
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !validCloseCode(code) || !utf8.ValidString(reason) {
+			return c.fail(CloseProtocolError, "invalid close frame")
+		}
+	}
+
+	c.writeFrame(Frame{Fin: true, Opcode: OpClose, Payload: payload[:min(len(payload), 2)]})
+	c.closeConn()
+	c.readErr = &CloseError{Code: code, Reason: reason}
+	return 0, nil, c.readErr
+}
+
+// fail closes the connection because of a protocol error, telling the
+// peer why first.
+func (c *Conn) fail(code int, reason string) (Opcode, []byte, error) {
+	c.writeFrame(Frame{Fin: true, Opcode: OpClose, Payload: closePayload(code, reason)})
+	c.closeConn()
+	c.readErr = &CloseError{Code: code, Reason: reason}
+	return 0, nil, c.readErr
+}
+
+// WriteMessage sends data as a single text or binary frame. Text must be
+// valid UTF-8.
+func (c *Conn) WriteMessage(typ Opcode, data []byte) error {
+	if typ != OpText && typ != OpBinary {
+		return fmt.Errorf("websocket: cannot send a %s message", typ)
+	}
+	return c.writeFrame(Frame{Fin: true, Opcode: typ, Payload: data})
+}
+
+// Ping sends a ping; the peer answers with a pong carrying the same data.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: ping payload too long")
+	}
+	return c.writeFrame(Frame{Fin: true, Opcode: OpPing, Payload: data})
+}
+
+// Close starts the closing handshake. The connection is closed once
+// ReadMessage reads the peer's close frame, or after closeTimeout if the
+// peer never answers (or nobody is reading). Calling it again is a no-op.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		return errors.New("websocket: close reason too long")
+	}
+	err := c.writeFrame(Frame{Fin: true, Opcode: OpClose, Payload: closePayload(code, reason)})
+	switch {
+	case errors.Is(err, ErrCloseSent):
+		return nil
+	case err != nil:
+		c.closeConn()
+		return err
+	}
+	time.AfterFunc(closeTimeout, c.closeConn)
+	return nil
+}
+
+// writeFrame masks client frames with a fresh key and writes f in a
+// single Write call. Nothing is sent after a close frame.
+func (c *Conn) writeFrame(f Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if f.Opcode == OpClose {
+		c.closeSent = true
+	}
+	if c.client {
+		f.Masked = true
+		rand.Read(f.MaskKey[:])
+	}
+	return WriteFrame(c.conn, f)
+}
+
+func (c *Conn) closeConn() {
+	c.closeOnce.Do(func() { c.conn.Close() })
+}
+
+// closePayload encodes a close frame body. CloseNoStatus and
+// CloseAbnormal only exist locally, so they are sent as an empty body.
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatus || code == CloseAbnormal {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(b, reason...)
+}
+
+// validCloseCode reports whether code may appear in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999: // registered and private use
+		return true
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer upgrades every request and echoes messages back until the
+// connection closes. Its read errors are sent on errs.
+func echoServer(t *testing.T, readLimit int64) (url string, errs <-chan error) {
+	t.Helper()
+	ch := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, nil)
+		if err != nil {
+			var he *HandshakeError
+			if errors.As(err, &he) {
+				http.Error(w, he.Message, he.Status)
+			}
+			return
+		}
+		conn.SetReadLimit(readLimit)
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				ch <- err
+				return
+			}
+			conn.WriteMessage(typ, msg)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http"), ch
+}
+
+func dial(t *testing.T, url string) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, _, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func TestAcceptKey(t *testing.T) {
+	// From RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %q", got)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	url, _ := echoServer(t, 1<<20)
+	conn := dial(t, url)
+	conn.SetReadLimit(1 << 20)
+
+	messages := []struct {
+		typ  Opcode
+		data []byte
+	}{
+		{OpText, []byte("hello")},
+		{OpBinary, []byte{0, 1, 2, 255}},
+		{OpText, bytes.Repeat([]byte("x"), 70000)}, // 64-bit length
+	}
+	for _, m := range messages {
+		if err := conn.WriteMessage(m.typ, m.data); err != nil {
+			t.Fatal(err)
+		}
+		typ, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != m.typ || !bytes.Equal(got, m.data) {
+			t.Errorf("Expected %v message of %d bytes, got %v of %d", m.typ, len(m.data), typ, len(got))
+		}
+	}
+}
+
+func TestFragmentedMessageWithPing(t *testing.T) {
+	url, _ := echoServer(t, 0)
+	conn := dial(t, url)
+
+	var pongs []string
+	conn.SetPongHandler(func(data []byte) { pongs = append(pongs, string(data)) })
+
+	// A ping between fragments is answered without breaking the message
+	conn.writeFrame(Frame{Opcode: OpText, Payload: []byte("Hel")})
+	conn.writeFrame(Frame{Fin: true, Opcode: OpPing, Payload: []byte("are you there")})
+	conn.writeFrame(Frame{Opcode: OpContinuation, Payload: []byte("lo, ")})
+	conn.writeFrame(Frame{Fin: true, Opcode: OpContinuation, Payload: []byte("world")})
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "Hello, world" {
+		t.Errorf("Expected reassembled message, got %q", msg)
+	}
+	if len(pongs) != 1 || pongs[0] != "are you there" {
+		t.Errorf("Expected one pong echoing the ping, got %q", pongs)
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	url, serverErrs := echoServer(t, 0)
+	conn := dial(t, url)
+
+	if err := conn.Close(CloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(OpText, []byte("late")); !errors.Is(err, ErrCloseSent) {
+		t.Errorf("Expected ErrCloseSent after Close, got %v", err)
+	}
+
+	// The server sees our code and echoes it back
+	_, _, err := conn.ReadMessage()
+	if CloseStatus(err) != CloseGoingAway {
+		t.Errorf("Expected echoed code %d, got %v", CloseGoingAway, err)
+	}
+	var ce *CloseError
+	if err := <-serverErrs; !errors.As(err, &ce) || ce.Code != CloseGoingAway || ce.Reason != "bye" {
+		t.Errorf("Expected server to read code %d with reason, got %v", CloseGoingAway, err)
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		send   func(c *Conn)
+		status int
+	}{
+		{"unmasked client frame", 0, func(c *Conn) {
+			WriteFrame(c.conn, Frame{Fin: true, Opcode: OpText, Payload: []byte("hi")})
+		}, CloseProtocolError},
+		{"reserved bits", 0, func(c *Conn) {
+			c.writeFrame(Frame{Fin: true, Rsv: 4, Opcode: OpText, Payload: []byte("hi")})
+		}, CloseProtocolError},
+		{"unknown opcode", 0, func(c *Conn) {
+			c.writeFrame(Frame{Fin: true, Opcode: 0x3})
+		}, CloseProtocolError},
+		{"fragmented ping", 0, func(c *Conn) {
+			c.writeFrame(Frame{Opcode: OpPing})
+		}, CloseProtocolError},
+		{"stray continuation", 0, func(c *Conn) {
+			c.writeFrame(Frame{Fin: true, Opcode: OpContinuation, Payload: []byte("hi")})
+		}, CloseProtocolError},
+		{"interleaved messages", 0, func(c *Conn) {
+			c.writeFrame(Frame{Opcode: OpText, Payload: []byte("a")})
+			c.writeFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte("b")})
+		}, CloseProtocolError},
+		{"invalid close code", 0, func(c *Conn) {
+			c.writeFrame(Frame{Fin: true, Opcode: OpClose, Payload: []byte{0x03, 0xED}}) // 1005
+		}, CloseProtocolError},
+		{"invalid UTF-8", 0, func(c *Conn) {
+			c.writeFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte{0xff, 0xfe}})
+		}, CloseInvalidPayload},
+		{"message over the limit", 10, func(c *Conn) {
+			c.writeFrame(Frame{Opcode: OpBinary, Payload: make([]byte, 8)})
+			c.writeFrame(Frame{Fin: true, Opcode: OpContinuation, Payload: make([]byte, 8)})
+		}, CloseMessageTooBig},
+		{"message over the default limit", 0, func(c *Conn) {
+			c.writeFrame(Frame{Opcode: OpBinary, Payload: make([]byte, DefaultReadLimit)})
+			c.writeFrame(Frame{Fin: true, Opcode: OpContinuation, Payload: []byte{0}})
+		}, CloseMessageTooBig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, serverErrs := echoServer(t, tt.limit)
+			conn := dial(t, url)
+			tt.send(conn)
+
+			if err := <-serverErrs; CloseStatus(err) != tt.status {
+				t.Errorf("Expected server to fail with %d, got %v", tt.status, err)
+			}
+			if _, _, err := conn.ReadMessage(); CloseStatus(err) != tt.status {
+				t.Errorf("Expected close frame with %d, got %v", tt.status, err)
+			}
+		})
+	}
+}
+
+func TestUpgradeRejections(t *testing.T) {
+	url, _ := echoServer(t, 0)
+	httpURL := "http" + strings.TrimPrefix(url, "ws")
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+	}{
+		{"plain request", nil, http.StatusUpgradeRequired},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"bad key", map[string]string{"Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", httpURL, nil)
+		if tt.header != nil {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	_, resp, err := Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("Expected handshake error")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the 404 response with the error, got %v", resp)
+	}
+}
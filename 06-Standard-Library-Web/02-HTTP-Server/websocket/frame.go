@@ -0,0 +1,213 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) with only
+// the standard library: the opening handshake on both sides, frame
+// encoding, masking, fragmented messages, ping/pong and the close
+// handshake. Extensions such as permessage-deflate are not supported.
+//
+// A server upgrades an HTTP request and then reads and writes messages:
+//
+//	conn, err := websocket.Upgrade(w, r, nil)
+//	if err != nil {
+//		return // the handshake error is in err; nothing was written
+//	}
+//	for {
+//		typ, msg, err := conn.ReadMessage()
+//		if err != nil {
+//			return
+//		}
+//		conn.WriteMessage(typ, msg)
+//	}
+//
+// Dial opens a client connection with the same framing code, which is how
+// the tests exercise the server side.
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Opcode is the type of a frame.
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// IsControl reports whether o is a close, ping or pong opcode. Control
+// frames can be sent between the fragments of a message.
+func (o Opcode) IsControl() bool { return o&0x8 != 0 }
+
+func (o Opcode) valid() bool {
+	switch o {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+		return true
+	}
+	return false
+}
+
+func (o Opcode) String() string {
+	switch o {
+	case OpContinuation:
+		return "continuation"
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	}
+	return fmt.Sprintf("opcode(%#x)", byte(o))
+}
+
+// maxControlPayload is the largest payload a control frame may carry.
+const maxControlPayload = 125
+
+// DefaultReadLimit is the largest payload ReadFrame, and the largest
+// message a Conn, accepts unless given another limit.
+const DefaultReadLimit = 64 << 10
+
+// ErrFrameTooLarge is returned by ReadFrame when a payload is longer than
+// the limit it was given.
+var ErrFrameTooLarge = errors.New("websocket: frame payload too large")
+
+// Frame is one WebSocket frame:
+//
+//	 0               1               2               3
+//	+-+-+-+-+-------+-+-------------+-------------------------------+
+//	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+//	|I|S|S|S|  (4)  |A|     (7)     |            (16/64)            |
+//	|N|V|V|V|       |S|             |                               |
+//	+-+-+-+-+-------+-+-------------+-------------------------------+
+//	|    Masking key (if MASK set)  |          Payload data ...     |
+//	+-------------------------------+-------------------------------+
+//
+// Payload is always the unmasked data; masking only happens on the wire.
+type Frame struct {
+	Fin     bool
+	Rsv     byte // RSV1-3 as the low three bits; must be 0 without extensions
+	Opcode  Opcode
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+// ReadFrame reads one frame from r and unmasks its payload. Payloads
+// longer than limit bytes are not read; ReadFrame returns
+// ErrFrameTooLarge instead. A limit of 0 or less means DefaultReadLimit:
+// the length comes from the peer, so it is never trusted unchecked.
+func ReadFrame(r io.Reader, limit int64) (Frame, error) {
+	if limit <= 0 {
+		limit = DefaultReadLimit
+	}
+	var f Frame
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return f, err
+	}
+	f.Fin = head[0]&0x80 != 0
+	f.Rsv = head[0] >> 4 & 0x7
+	f.Opcode = Opcode(head[0] & 0x0F)
+	f.Masked = head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, errors.New("websocket: invalid payload length")
+		}
+	}
+	if length > uint64(limit) {
+		return f, ErrFrameTooLarge
+	}
+
+	if f.Masked {
+		if _, err := io.ReadFull(r, f.MaskKey[:]); err != nil {
+			return f, unexpectedEOF(err)
+		}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, unexpectedEOF(err)
+	}
+	if f.Masked {
+		maskBytes(f.MaskKey, f.Payload)
+	}
+	return f, nil
+}
+
+// WriteFrame writes f to w using the shortest length encoding, masking
+// the payload with f.MaskKey when f.Masked is set. f.Payload is not
+// modified.
+func WriteFrame(w io.Writer, f Frame) error {
+	length := len(f.Payload)
+	buf := make([]byte, 0, 14+length)
+
+	b0 := f.Rsv<<4 | byte(f.Opcode)&0x0F
+	if f.Fin {
+		b0 |= 0x80
+	}
+	var b1 byte
+	if f.Masked {
+		b1 = 0x80
+	}
+	switch {
+	case length <= 125:
+		buf = append(buf, b0, b1|byte(length))
+	case length <= 0xFFFF:
+		buf = append(buf, b0, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b0, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if f.Masked {
+		buf = append(buf, f.MaskKey[:]...)
+		start := len(buf)
+		buf = append(buf, f.Payload...)
+		maskBytes(f.MaskKey, buf[start:])
+	} else {
+		buf = append(buf, f.Payload...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// maskBytes XORs b with the repeating four-byte key. Masking and
+// unmasking are the same operation.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// unexpectedEOF reports a frame cut short as io.ErrUnexpectedEOF; a plain
+// io.EOF only means the peer went away between frames.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
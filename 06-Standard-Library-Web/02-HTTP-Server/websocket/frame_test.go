@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Examples from RFC 6455 section 5.7.
+func TestReadFrameRFCExamples(t *testing.T) {
+	tests := []struct {
+		name   string
+		wire   []byte
+		fin    bool
+		op     Opcode
+		masked bool
+		want   string
+	}{
+		{"unmasked text", []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}, true, OpText, false, "Hello"},
+		{"masked text", []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, true, OpText, true, "Hello"},
+		{"first fragment", []byte{0x01, 0x03, 0x48, 0x65, 0x6c}, false, OpText, false, "Hel"},
+		{"last fragment", []byte{0x80, 0x02, 0x6c, 0x6f}, true, OpContinuation, false, "lo"},
+		{"ping", []byte{0x89, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}, true, OpPing, false, "Hello"},
+	}
+
+	for _, tt := range tests {
+		f, err := ReadFrame(bytes.NewReader(tt.wire), 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if f.Fin != tt.fin || f.Opcode != tt.op || f.Masked != tt.masked || string(f.Payload) != tt.want {
+			t.Errorf("%s: got fin=%v op=%v masked=%v payload=%q", tt.name, f.Fin, f.Opcode, f.Masked, f.Payload)
+		}
+	}
+}
+
+func TestWriteFrameMatchesRFC(t *testing.T) {
+	var buf bytes.Buffer
+	f := Frame{Fin: true, Opcode: OpText, Masked: true, MaskKey: [4]byte{0x37, 0xfa, 0x21, 0x3d}, Payload: []byte("Hello")}
+	if err := WriteFrame(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Expected % x, got % x", want, buf.Bytes())
+	}
+	if string(f.Payload) != "Hello" {
+		t.Error("WriteFrame must not mask the caller's payload in place")
+	}
+}
+
+func TestFrameLengthEncodings(t *testing.T) {
+	// 7-bit, 16-bit and 64-bit lengths and the boundaries between them
+	tests := []struct {
+		length   int
+		overhead int
+	}{
+		{0, 2}, {125, 2}, {126, 4}, {65535, 4}, {65536, 10},
+	}
+
+	for _, tt := range tests {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{'x'}, tt.length)
+			var buf bytes.Buffer
+			WriteFrame(&buf, Frame{Fin: true, Opcode: OpBinary, Masked: masked, MaskKey: [4]byte{1, 2, 3, 4}, Payload: payload})
+
+			overhead := tt.overhead
+			if masked {
+				overhead += 4
+			}
+			if buf.Len() != tt.length+overhead {
+				t.Errorf("length %d masked=%v: expected %d bytes on the wire, got %d", tt.length, masked, tt.length+overhead, buf.Len())
+			}
+			f, err := ReadFrame(&buf, 0)
+			if err != nil || !bytes.Equal(f.Payload, payload) {
+				t.Errorf("length %d masked=%v: round trip failed: %v", tt.length, masked, err)
+			}
+		}
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 1000)})
+
+	if _, err := ReadFrame(&buf, 999); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+// TestReadFrameDefaultLimit checks a huge declared length is refused
+// before anything is allocated for it.
+func TestReadFrameDefaultLimit(t *testing.T) {
+	wire := []byte{0x82, 127, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00}
+	if _, err := ReadFrame(bytes.NewReader(wire), 0); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge for a 64 GiB frame, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, DefaultReadLimit)})
+	if _, err := ReadFrame(&buf, 0); err != nil {
+		t.Errorf("Expected a frame of DefaultReadLimit bytes to be read, got %v", err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	wire := []byte{0x81, 0x05, 0x48, 0x65}
+	if _, err := ReadFrame(bytes.NewReader(wire), 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(nil), 0); err != io.EOF {
+		t.Errorf("Expected io.EOF between frames, got %v", err)
+	}
+}
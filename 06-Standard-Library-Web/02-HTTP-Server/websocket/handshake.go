@@ -0,0 +1,248 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// acceptGUID is mixed into Sec-WebSocket-Accept so that only a server
+// that understands WebSockets can produce it.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptKey returns the Sec-WebSocket-Accept value for a client key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// HandshakeError is returned by Upgrade when a request is not a valid
+// opening handshake. Nothing has been written: the caller sends Status
+// to the client in whatever error format it uses. Headers the response
+// should carry, such as Sec-WebSocket-Version, are already set.
+type HandshakeError struct {
+	Status  int
+	Message string
+}
+
+func (e *HandshakeError) Error() string {
+	return "websocket: " + e.Message
+}
+
+// Upgrade completes the opening handshake for r and takes over its
+// connection. checkOrigin decides whether a browser page on another
+// origin may connect; nil allows requests without an Origin header and
+// those whose Origin host matches r.Host.
+//
+// Headers already set on w (request IDs, rate limit state) are sent with
+// the 101 response. The returned Conn has no deadlines: the server's
+// ReadTimeout and WriteTimeout no longer apply once the connection is
+// upgraded.
+func Upgrade(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool) (*Conn, error) {
+	if r.ProtoMajor != 1 {
+		// RFC 8441 (WebSockets over HTTP/2) is not implemented
+		return nil, &HandshakeError{http.StatusHTTPVersionNotSupported, "WebSockets need HTTP/1.1"}
+	}
+	if r.Method != http.MethodGet {
+		return nil, &HandshakeError{http.StatusMethodNotAllowed, "the handshake must be a GET request"}
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		return nil, &HandshakeError{http.StatusUpgradeRequired, "not a WebSocket handshake; send Upgrade: websocket"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, &HandshakeError{http.StatusUpgradeRequired, "unsupported Sec-WebSocket-Version; use 13"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, &HandshakeError{http.StatusBadRequest, "Sec-WebSocket-Key must be 16 bytes in base64"}
+	}
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, &HandshakeError{http.StatusForbidden, "origin not allowed"}
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, &HandshakeError{http.StatusInternalServerError, "cannot take over the connection: " + err.Error()}
+	}
+	// Clear the deadlines set from the server's timeouts
+	conn.SetDeadline(time.Time{})
+
+	h := w.Header().Clone()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The reader may already hold frames the client sent right after
+	// its request, so it is kept rather than reading conn directly
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// sameOrigin allows requests without an Origin header (non-browser
+// clients) and browser pages served from the same host.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// headerHasToken reports whether a comma-separated header contains token,
+// e.g. "keep-alive, Upgrade" contains "upgrade".
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Dialer opens client connections. The zero value is ready to use.
+type Dialer struct {
+	// TLSConfig is used for wss:// URLs; nil means the defaults.
+	TLSConfig *tls.Config
+}
+
+// Dial opens a connection with the zero Dialer.
+func Dial(ctx context.Context, rawURL string, header http.Header) (*Conn, *http.Response, error) {
+	var d Dialer
+	return d.Dial(ctx, rawURL, header)
+}
+
+// Dial connects to a ws:// or wss:// URL and performs the opening
+// handshake, sending header with the request. ctx bounds the handshake
+// only. If the server refuses the upgrade, the error comes with its
+// response, whose body has been read into memory.
+func (d *Dialer) Dial(ctx context.Context, rawURL string, header http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		u.Scheme, port = "http", "80"
+	case "wss":
+		u.Scheme, port = "https", "443"
+	default:
+		return nil, nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, resp, br, err := d.handshake(ctx, conn, u, header)
+	if err != nil {
+		conn.Close()
+		return nil, resp, err
+	}
+	return newConn(conn, br, true), resp, nil
+}
+
+// handshake sends the upgrade request over conn, wrapped in TLS for wss
+// URLs, and checks the response. It returns the connection to use from
+// then on.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, u *url.URL, header http.Header) (net.Conn, *http.Response, *bufio.Reader, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancelling ctx interrupts a handshake that is blocked on I/O
+	raw := conn
+	stop := context.AfterFunc(ctx, func() { raw.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if u.Scheme == "https" {
+		cfg := d.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		// The upgrade is an HTTP/1.1 mechanism
+		cfg.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(conn, cfg)
+		conn = tc
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return conn, nil, nil, err
+		}
+	}
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return conn, nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return conn, nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return conn, resp, nil, fmt.Errorf("websocket: handshake refused: %s", resp.Status)
+	}
+	if !headerHasToken(resp.Header, "Upgrade", "websocket") || !headerHasToken(resp.Header, "Connection", "upgrade") {
+		return conn, resp, nil, errors.New("websocket: response is missing the upgrade headers")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return conn, resp, nil, errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+
+	if !stop() {
+		return conn, resp, nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, resp, br, nil
+}
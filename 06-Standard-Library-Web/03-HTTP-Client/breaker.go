@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen matches the error BreakerTransport returns instead of
+// sending a request:
+//
+//	if errors.Is(err, ErrCircuitOpen) { ... }
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned for a request a breaker refused to send.
+type CircuitOpenError struct {
+	Host  string
+	State State
+	// RetryAt is when an open breaker lets a probe through; zero while
+	// half-open.
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.State == StateHalfOpen {
+		return fmt.Sprintf("circuit breaker for %s is half-open and probing", e.Host)
+	}
+	return fmt.Sprintf("circuit breaker for %s is open until %s", e.Host, e.RetryAt.Format(time.RFC3339))
+}
+
+// Is makes errors.Is(err, ErrCircuitOpen) work.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// State is a breaker's state.
+type State int
+
+const (
+	// StateClosed sends every request and counts how they go.
+	StateClosed State = iota
+	// StateOpen fails every request fast until OpenTimeout passes.
+	StateOpen
+	// StateHalfOpen lets HalfOpenRequests probes through; they decide
+	// whether the breaker closes or opens again.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Counts are the outcomes in a breaker's sliding window.
+type Counts struct {
+	Requests int
+	Failures int
+}
+
+// FailureRate returns Failures/Requests, or 0 with no requests.
+func (c Counts) FailureRate() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return float64(c.Failures) / float64(c.Requests)
+}
+
+// BreakerPolicy says when a breaker trips and how it resets. Zero fields
+// take the defaults in brackets.
+type BreakerPolicy struct {
+	// Window is how far back outcomes are counted [10s].
+	Window time.Duration
+	// MinRequests is how many outcomes the window needs before the
+	// breaker can trip, so one early failure doesn't open it [10].
+	MinRequests int
+	// FailureRate trips the breaker once reached [0.5].
+	FailureRate float64
+	// ShouldTrip, if set, replaces the MinRequests and FailureRate test.
+	ShouldTrip func(Counts) bool
+
+	// OpenTimeout is how long the breaker stays open [30s].
+	OpenTimeout time.Duration
+	// HalfOpenRequests is how many probes must all succeed to close the
+	// breaker again; one failure reopens it [1].
+	HalfOpenRequests int
+
+	// IsFailure says whether an attempt counts against the downstream
+	// [a transport error or a 5xx].
+	IsFailure func(resp *http.Response, err error) bool
+}
+
+func (p BreakerPolicy) withDefaults() BreakerPolicy {
+	if p.Window <= 0 {
+		p.Window = 10 * time.Second
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = 10
+	}
+	if p.FailureRate <= 0 {
+		p.FailureRate = 0.5
+	}
+	if p.ShouldTrip == nil {
+		minRequests, rate := p.MinRequests, p.FailureRate
+		p.ShouldTrip = func(c Counts) bool {
+			return c.Requests >= minRequests && c.FailureRate() >= rate
+		}
+	}
+	if p.OpenTimeout <= 0 {
+		p.OpenTimeout = 30 * time.Second
+	}
+	if p.HalfOpenRequests <= 0 {
+		p.HalfOpenRequests = 1
+	}
+	if p.IsFailure == nil {
+		p.IsFailure = func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode >= 500
+		}
+	}
+	return p
+}
+
+// BreakerTransport is an http.RoundTripper with a circuit breaker per
+// host, so one failing API doesn't stop calls to the others:
+//
+//	client := &http.Client{Transport: NewBreakerTransport(nil, BreakerPolicy{})}
+//
+// A closed breaker sends requests and counts failures in a sliding
+// window. When the policy trips, the breaker opens and fails requests at
+// once with a *CircuitOpenError instead of letting them wait on a
+// downstream that is down. After OpenTimeout it goes half-open and lets a
+// few probes through: if they succeed it closes, if not it opens again.
+type BreakerTransport struct {
+	// Base sends requests; http.DefaultTransport if nil.
+	Base http.RoundTripper
+	// OnStateChange, if set, is called after a breaker changes state, e.g.
+	// to log it or update a metric. It must not block.
+	OnStateChange func(host string, from, to State)
+
+	policy BreakerPolicy
+	clock  clock // replaced in tests
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// NewBreakerTransport returns a BreakerTransport over base.
+func NewBreakerTransport(base http.RoundTripper, policy BreakerPolicy) *BreakerTransport {
+	return &BreakerTransport{
+		Base:     base,
+		policy:   policy.withDefaults(),
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// State returns the state of host's breaker; hosts not seen yet are
+// closed. host is a URL's Host, e.g. "api.example.com:8443".
+func (t *BreakerTransport) State(host string) State {
+	t.mu.Lock()
+	b, ok := t.breakers[host]
+	t.mu.Unlock()
+	if !ok {
+		return StateClosed
+	}
+	return b.currentState()
+}
+
+// RoundTrip sends req unless its host's breaker refuses it. A request the
+// caller cancelled doesn't count either way.
+func (t *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.breaker(req.URL.Host)
+	gen, err := b.allow()
+	if err != nil {
+		// A RoundTripper must close the body, even when it sends nothing
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		b.record(gen, outcomeIgnored)
+	case t.policy.IsFailure(resp, err):
+		b.record(gen, outcomeFailure)
+	default:
+		b.record(gen, outcomeSuccess)
+	}
+	return resp, err
+}
+
+func (t *BreakerTransport) breaker(host string) *breaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		clk := t.clock
+		if clk == nil {
+			clk = realClock{}
+		}
+		b = &breaker{
+			host:   host,
+			policy: t.policy,
+			clock:  clk,
+			window: newWindow(t.policy.Window),
+			notify: t.stateChanged,
+		}
+		t.breakers[host] = b
+	}
+	return b
+}
+
+func (t *BreakerTransport) stateChanged(host string, from, to State) {
+	if t.OnStateChange != nil {
+		t.OnStateChange(host, from, to)
+	}
+}
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+// breaker is one host's state machine. gen changes with every state
+// change, so a request that started before one doesn't count after it.
+type breaker struct {
+	host   string
+	policy BreakerPolicy
+	clock  clock
+	notify func(host string, from, to State)
+
+	mu        sync.Mutex
+	state     State
+	gen       uint64
+	window    *window
+	openedAt  time.Time
+	probes    int // half-open requests in flight
+	successes int // half-open requests that succeeded
+}
+
+func (b *breaker) currentState() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow returns the generation to record the request under, or a
+// *CircuitOpenError if it mustn't be sent.
+func (b *breaker) allow() (uint64, error) {
+	b.mu.Lock()
+	now := b.clock.Now()
+	var from State
+	changed := false
+	if b.state == StateOpen && !now.Before(b.openedAt.Add(b.policy.OpenTimeout)) {
+		from, changed = b.setState(StateHalfOpen, now), true
+	}
+
+	var err error
+	switch b.state {
+	case StateOpen:
+		err = &CircuitOpenError{Host: b.host, State: StateOpen, RetryAt: b.openedAt.Add(b.policy.OpenTimeout)}
+	case StateHalfOpen:
+		if b.probes+b.successes >= b.policy.HalfOpenRequests {
+			err = &CircuitOpenError{Host: b.host, State: StateHalfOpen}
+		} else {
+			b.probes++
+		}
+	}
+	gen, to := b.gen, b.state
+	b.mu.Unlock()
+
+	if changed {
+		b.stateChanged(from, to)
+	}
+	return gen, err
+}
+
+// record counts the outcome of a request allowed under gen.
+func (b *breaker) record(gen uint64, o outcome) {
+	b.mu.Lock()
+	if gen != b.gen {
+		b.mu.Unlock()
+		return
+	}
+	now := b.clock.Now()
+	from := b.state
+
+	switch b.state {
+	case StateClosed:
+		if o == outcomeIgnored {
+			break
+		}
+		b.window.add(now, o == outcomeFailure)
+		if o == outcomeFailure && b.policy.ShouldTrip(b.window.counts(now)) {
+			b.setState(StateOpen, now)
+		}
+	case StateHalfOpen:
+		b.probes--
+		switch o {
+		case outcomeFailure:
+			b.setState(StateOpen, now)
+		case outcomeSuccess:
+			b.successes++
+			if b.successes >= b.policy.HalfOpenRequests {
+				b.setState(StateClosed, now)
+			}
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	if from != to {
+		b.stateChanged(from, to)
+	}
+}
+
+// setState moves to state and returns the old one. b.mu must be held.
+func (b *breaker) setState(state State, now time.Time) State {
+	from := b.state
+	b.state = state
+	b.gen++
+	b.probes, b.successes = 0, 0
+	switch state {
+	case StateOpen:
+		b.openedAt = now
+	case StateClosed:
+		b.window = newWindow(b.policy.Window)
+	}
+	return from
+}
+
+// stateChanged is called outside b.mu, so the callback may call State.
+func (b *breaker) stateChanged(from, to State) {
+	b.notify(b.host, from, to)
+}
+
+// windowBuckets is how many slices a window is counted in. Outcomes drop
+// out a slice at a time, so the window slides in Window/windowBuckets
+// steps.
+const windowBuckets = 10
+
+// window counts outcomes over the last Window, in fixed buckets reused
+// round-robin.
+type window struct {
+	width   time.Duration
+	buckets [windowBuckets]bucket
+}
+
+type bucket struct {
+	epoch    int64 // which width-long slice of time the counts are for
+	requests int
+	failures int
+}
+
+func newWindow(size time.Duration) *window {
+	width := size / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &window{width: width}
+}
+
+func (w *window) add(now time.Time, failed bool) {
+	epoch := now.UnixNano() / int64(w.width)
+	b := &w.buckets[epoch%windowBuckets]
+	if b.epoch != epoch {
+		*b = bucket{epoch: epoch}
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+}
+
+func (w *window) counts(now time.Time) Counts {
+	epoch := now.UnixNano() / int64(w.width)
+	var c Counts
+	for _, b := range w.buckets {
+		if epoch-b.epoch < windowBuckets {
+			c.Requests += b.requests
+			c.Failures += b.failures
+		}
+	}
+	return c
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// switchServer answers with whatever status is set, counting requests.
+type switchServer struct {
+	*httptest.Server
+	status atomic.Int32
+	hits   atomic.Int32
+}
+
+func newSwitchServer(t *testing.T) *switchServer {
+	t.Helper()
+	s := &switchServer{}
+	s.status.Store(http.StatusOK)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+		w.WriteHeader(int(s.status.Load()))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *switchServer) host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// stateLog collects OnStateChange calls.
+type stateLog struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (l *stateLog) record(host string, from, to State) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, from.String()+"->"+to.String())
+}
+
+func (l *stateLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.changes, " ")
+}
+
+func newTestBreaker(base http.RoundTripper, policy BreakerPolicy) (*BreakerTransport, *fakeClock, *stateLog) {
+	clk := newFakeClock()
+	log := &stateLog{}
+	bt := NewBreakerTransport(base, policy)
+	bt.clock = clk
+	bt.OnStateChange = log.record
+	return bt, clk, log
+}
+
+// get sends a GET through rt and returns the status, or the error.
+func get(t *testing.T, rt http.RoundTripper, url string) (int, error) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+var testPolicy = BreakerPolicy{
+	Window:      10 * time.Second,
+	MinRequests: 4,
+	FailureRate: 0.5,
+	OpenTimeout: 5 * time.Second,
+}
+
+func TestBreakerTrips(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, _, log := newTestBreaker(server.Client().Transport, testPolicy)
+
+	// 2 of 3 failing: too few requests to judge
+	get(t, bt, server.URL)
+	server.status.Store(http.StatusInternalServerError)
+	get(t, bt, server.URL)
+	get(t, bt, server.URL)
+	if s := bt.State(server.host()); s != StateClosed {
+		t.Fatalf("Expected closed below MinRequests, got %v", s)
+	}
+
+	// 3 of 4 failing trips it
+	get(t, bt, server.URL)
+	if s := bt.State(server.host()); s != StateOpen {
+		t.Fatalf("Expected open, got %v", s)
+	}
+	if log.String() != "closed->open" {
+		t.Errorf("Expected one change to open, got %q", log)
+	}
+
+	hits := server.hits.Load()
+	_, err := get(t, bt, server.URL)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Host != server.host() || openErr.State != StateOpen {
+		t.Errorf("Unexpected error: %#v", err)
+	}
+	if server.hits.Load() != hits {
+		t.Error("An open breaker must not send the request")
+	}
+}
+
+func TestBreakerBelowFailureRate(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, _, _ := newTestBreaker(server.Client().Transport, testPolicy)
+
+	for i := 0; i < 20; i++ {
+		status := http.StatusOK
+		if i%3 == 2 {
+			status = http.StatusServiceUnavailable
+		}
+		server.status.Store(int32(status))
+		get(t, bt, server.URL)
+	}
+	if s := bt.State(server.host()); s != StateClosed {
+		t.Errorf("Expected a 1-in-3 failure rate to stay closed, got %v", s)
+	}
+}
+
+func TestBreakerSlidingWindow(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, clk, _ := newTestBreaker(server.Client().Transport, testPolicy)
+
+	server.status.Store(http.StatusInternalServerError)
+	for i := 0; i < 3; i++ {
+		get(t, bt, server.URL)
+	}
+	// The old failures slide out of the window
+	clk.Advance(11 * time.Second)
+	get(t, bt, server.URL)
+	if s := bt.State(server.host()); s != StateClosed {
+		t.Errorf("Expected old failures to be forgotten, got %v", s)
+	}
+
+	for i := 0; i < 3; i++ {
+		get(t, bt, server.URL)
+	}
+	if s := bt.State(server.host()); s != StateOpen {
+		t.Errorf("Expected 4 fresh failures to trip it, got %v", s)
+	}
+}
+
+// trip opens bt's breaker for server.
+func trip(t *testing.T, bt *BreakerTransport, server *switchServer) {
+	t.Helper()
+	server.status.Store(http.StatusInternalServerError)
+	for i := 0; i < testPolicy.MinRequests; i++ {
+		get(t, bt, server.URL)
+	}
+	if s := bt.State(server.host()); s != StateOpen {
+		t.Fatalf("Expected open, got %v", s)
+	}
+}
+
+func TestBreakerHalfOpenCloses(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, clk, log := newTestBreaker(server.Client().Transport, testPolicy)
+	trip(t, bt, server)
+
+	clk.Advance(4 * time.Second)
+	if _, err := get(t, bt, server.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected still open before OpenTimeout, got %v", err)
+	}
+
+	clk.Advance(time.Second)
+	server.status.Store(http.StatusOK)
+	if status, err := get(t, bt, server.URL); err != nil || status != http.StatusOK {
+		t.Fatalf("Expected the probe to go through, got %d %v", status, err)
+	}
+	if s := bt.State(server.host()); s != StateClosed {
+		t.Errorf("Expected a good probe to close it, got %v", s)
+	}
+	if log.String() != "closed->open open->half-open half-open->closed" {
+		t.Errorf("Unexpected changes: %q", log)
+	}
+
+	// Closing starts a fresh window
+	server.status.Store(http.StatusInternalServerError)
+	get(t, bt, server.URL)
+	if s := bt.State(server.host()); s != StateClosed {
+		t.Errorf("Expected one failure after closing not to trip it, got %v", s)
+	}
+}
+
+func TestBreakerHalfOpenReopens(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, clk, log := newTestBreaker(server.Client().Transport, testPolicy)
+	trip(t, bt, server)
+
+	clk.Advance(testPolicy.OpenTimeout)
+	if status, _ := get(t, bt, server.URL); status != http.StatusInternalServerError {
+		t.Fatalf("Expected the probe to reach the server, got %d", status)
+	}
+	if s := bt.State(server.host()); s != StateOpen {
+		t.Errorf("Expected a failed probe to reopen it, got %v", s)
+	}
+	if log.String() != "closed->open open->half-open half-open->open" {
+		t.Errorf("Unexpected changes: %q", log)
+	}
+
+	// The open timeout starts again
+	_, err := get(t, bt, server.URL)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || !openErr.RetryAt.Equal(clk.Now().Add(testPolicy.OpenTimeout)) {
+		t.Errorf("Expected a fresh RetryAt, got %v", err)
+	}
+}
+
+// blockingTransport holds every request until release is closed.
+type blockingTransport struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.started <- struct{}{}
+	<-t.release
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestBreakerHalfOpenLimitsProbes(t *testing.T) {
+	base := &blockingTransport{started: make(chan struct{}, 10), release: make(chan struct{})}
+	policy := testPolicy
+	policy.HalfOpenRequests = 2
+	bt, clk, _ := newTestBreaker(base, policy)
+
+	// Trip it by hand: the blocking base can't fail
+	b := bt.breaker("api.test")
+	for i := 0; i < policy.MinRequests; i++ {
+		b.record(b.gen, outcomeFailure)
+	}
+	clk.Advance(policy.OpenTimeout)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(t, bt, "http://api.test/")
+		}()
+		<-base.started
+	}
+	_, err := get(t, bt, "http://api.test/")
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.State != StateHalfOpen {
+		t.Errorf("Expected a third probe to be refused while half-open, got %v", err)
+	}
+
+	close(base.release)
+	wg.Wait()
+	if s := bt.State("api.test"); s != StateClosed {
+		t.Errorf("Expected two good probes to close it, got %v", s)
+	}
+}
+
+func TestBreakerPerHost(t *testing.T) {
+	down := newSwitchServer(t)
+	up := newSwitchServer(t)
+	bt, _, _ := newTestBreaker(http.DefaultTransport, testPolicy)
+	trip(t, bt, down)
+
+	if status, err := get(t, bt, up.URL); err != nil || status != http.StatusOK {
+		t.Errorf("Expected the other host to be unaffected, got %d %v", status, err)
+	}
+	if s := bt.State(up.host()); s != StateClosed {
+		t.Errorf("Expected the other host closed, got %v", s)
+	}
+}
+
+func TestBreakerNetworkErrors(t *testing.T) {
+	base := &errTransport{failures: 100}
+	bt, _, _ := newTestBreaker(base, testPolicy)
+
+	for i := 0; i < testPolicy.MinRequests; i++ {
+		if _, err := get(t, bt, "http://api.test/"); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Request %d: tripped too early", i)
+		}
+	}
+	if _, err := get(t, bt, "http://api.test/"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected network errors to trip it, got %v", err)
+	}
+}
+
+func TestBreakerIgnoresCancelledRequests(t *testing.T) {
+	bt, _, _ := newTestBreaker(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}), testPolicy)
+
+	for i := 0; i < 2*testPolicy.MinRequests; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://api.test/", nil)
+		bt.RoundTrip(req)
+	}
+	if s := bt.State("api.test"); s != StateClosed {
+		t.Errorf("Expected cancelled requests not to count, got %v", s)
+	}
+}
+
+func TestBreakerIgnoresStaleOutcomes(t *testing.T) {
+	bt, clk, _ := newTestBreaker(http.DefaultTransport, testPolicy)
+	b := bt.breaker("api.test")
+
+	// A slow request started while closed finishes after a trip and a
+	// half-open probe: its failure must not reopen the breaker
+	stale, _ := b.allow()
+	for i := 0; i < testPolicy.MinRequests; i++ {
+		b.record(b.gen, outcomeFailure)
+	}
+	clk.Advance(testPolicy.OpenTimeout)
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.record(stale, outcomeFailure)
+	b.record(probe, outcomeSuccess)
+	if s := b.currentState(); s != StateClosed {
+		t.Errorf("Expected the stale failure to be ignored, got %v", s)
+	}
+}
+
+func TestBreakerCustomPolicy(t *testing.T) {
+	server := newSwitchServer(t)
+	policy := BreakerPolicy{
+		// Trip on any two failures in the window
+		ShouldTrip: func(c Counts) bool { return c.Failures >= 2 },
+		// Treat 429 as a failure too
+		IsFailure: func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		},
+	}
+	bt, _, _ := newTestBreaker(server.Client().Transport, policy)
+
+	server.status.Store(http.StatusTooManyRequests)
+	get(t, bt, server.URL)
+	get(t, bt, server.URL)
+	if s := bt.State(server.host()); s != StateOpen {
+		t.Errorf("Expected the custom policy to trip on two 429s, got %v", s)
+	}
+}
+
+func TestBreakerClosesRefusedBody(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, _, _ := newTestBreaker(server.Client().Transport, testPolicy)
+	trip(t, bt, server)
+
+	body := &closeRecorder{Reader: strings.NewReader("payload")}
+	req, _ := http.NewRequest(http.MethodPut, server.URL, body)
+	if _, err := bt.RoundTrip(req); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if !body.closed {
+		t.Error("Expected the refused request's body to be closed")
+	}
+}
+
+func TestRetryTransportStopsAtOpenBreaker(t *testing.T) {
+	server := newSwitchServer(t)
+	bt, _, _ := newTestBreaker(server.Client().Transport, testPolicy)
+	trip(t, bt, server)
+	rt, clk := newTestRetryTransport(bt)
+
+	_, err := (&http.Client{Transport: rt}).Get(server.URL)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen through the client, got %v", err)
+	}
+	if len(clk.Sleeps()) != 0 {
+		t.Errorf("Expected no retries against an open breaker, got %v", clk.Sleeps())
+	}
+}
+
+func TestStateString(t *testing.T) {
+	for s, want := range map[State]string{StateClosed: "closed", StateOpen: "open", StateHalfOpen: "half-open", 7: "State(7)"} {
+		if got := fmt.Sprint(s); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XCacheHeader is set on every response CacheTransport returns for a
+// cacheable request, to one of the XCache values.
+const XCacheHeader = "X-Cache"
+
+// X-Cache values.
+const (
+	// XCacheHit is a fresh response served from the cache.
+	XCacheHit = "HIT"
+	// XCacheMiss is a response from the server.
+	XCacheMiss = "MISS"
+	// XCacheRevalidated is a cached response the server confirmed with a
+	// 304 Not Modified.
+	XCacheRevalidated = "REVALIDATED"
+	// XCacheStale is a stale cached response served because the server
+	// failed and stale-if-error allowed it.
+	XCacheStale = "STALE"
+)
+
+const (
+	// DefaultMaxEntryBytes is the largest body CacheTransport stores.
+	DefaultMaxEntryBytes = 10 << 20
+	// DefaultMemoryCacheBytes sizes the MemoryCache NewCacheTransport
+	// uses when it is given no store.
+	DefaultMemoryCacheBytes = 64 << 20
+)
+
+// CacheStore holds encoded responses for CacheTransport. A cache is only
+// an optimisation, so stores report failures as misses and drop writes
+// they can't make. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+// CacheTransport is an http.RoundTripper that caches GET responses the
+// way RFC 7234 describes for a private cache:
+//
+//	client := &http.Client{Transport: NewCacheTransport(nil, NewMemoryCache(64 << 20))}
+//
+// A response is stored if it is a GET with a cacheable status, has no
+// "no-store" and can either be fresh (max-age, Expires or Last-Modified)
+// or revalidated (ETag or Last-Modified). A fresh stored response is
+// served without a request. A stale one, or one marked "no-cache", is
+// revalidated with If-None-Match and If-Modified-Since, and a 304 serves
+// the stored body. If the server fails and the response allows it with
+// "stale-if-error", the stale response is served instead of the error.
+//
+// Requests with their own conditional or Range headers, and requests
+// marked "no-store", bypass the cache. A successful POST, PUT, PATCH or
+// DELETE drops the stored response for its URL.
+type CacheTransport struct {
+	// Base sends requests; http.DefaultTransport if nil.
+	Base  http.RoundTripper
+	Store CacheStore
+	// MaxEntryBytes caps the bodies that are stored; DefaultMaxEntryBytes
+	// if zero.
+	MaxEntryBytes int64
+
+	clock clock // replaced in tests
+}
+
+// NewCacheTransport returns a CacheTransport over base that keeps
+// responses in store, or in a new MemoryCache if store is nil.
+func NewCacheTransport(base http.RoundTripper, store CacheStore) *CacheTransport {
+	if store == nil {
+		store = NewMemoryCache(DefaultMemoryCacheBytes)
+	}
+	return &CacheTransport{Base: base, Store: store, MaxEntryBytes: DefaultMaxEntryBytes}
+}
+
+// RoundTrip serves req from the cache, revalidates it or sends it.
+func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		resp, err := t.base().RoundTrip(req)
+		if err == nil && invalidates(req.Method) && resp.StatusCode < 400 {
+			t.Store.Delete(cacheKey(req))
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") || bypassesCache(req) {
+		return t.base().RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	entry, ok := t.load(key, req)
+	if !ok {
+		return t.fetch(req, key, reqCC)
+	}
+
+	now := t.now()
+	if entry.fresh(now, reqCC) {
+		return entry.response(req, now, XCacheHit), nil
+	}
+
+	// Stale, or it has to be checked: ask the server whether it changed
+	condReq := req.Clone(req.Context())
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		condReq.Header.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		condReq.Header.Set("If-Modified-Since", lm)
+	}
+	requestTime := t.now()
+	resp, err := t.base().RoundTrip(condReq)
+	responseTime := t.now()
+
+	if (err != nil || isServerError(resp.StatusCode)) && entry.staleIfError(responseTime, reqCC) {
+		if resp != nil {
+			discard(resp)
+		}
+		return entry.response(req, responseTime, XCacheStale), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		return t.store(req, resp, key, reqCC, requestTime, responseTime), nil
+	}
+
+	discard(resp)
+	entry.revalidated(resp.Header, requestTime, responseTime)
+	if data, err := json.Marshal(entry); err == nil {
+		t.Store.Set(key, data)
+	}
+	return entry.response(req, responseTime, XCacheRevalidated), nil
+}
+
+// fetch sends req with nothing cached for it.
+func (t *CacheTransport) fetch(req *http.Request, key string, reqCC cacheControl) (*http.Response, error) {
+	requestTime := t.now()
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.store(req, resp, key, reqCC, requestTime, t.now()), nil
+}
+
+// store arranges for resp to be stored, if it may be, once the caller
+// has read all of its body. A body the caller doesn't finish isn't
+// stored.
+func (t *CacheTransport) store(req *http.Request, resp *http.Response, key string, reqCC cacheControl, requestTime, responseTime time.Time) *http.Response {
+	resp.Header.Set(XCacheHeader, XCacheMiss)
+	if !storable(resp, reqCC) {
+		if parseCacheControl(resp.Header).has("no-store") {
+			t.Store.Delete(key)
+		}
+		return resp
+	}
+
+	entry := &cacheEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         varyHeaders(req, resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	entry.Header.Del(XCacheHeader)
+
+	maxBytes := t.MaxEntryBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxEntryBytes
+	}
+	resp.Body = &teeBody{
+		ReadCloser: resp.Body,
+		limit:      maxBytes,
+		done: func(body []byte) {
+			entry.Body = body
+			if data, err := json.Marshal(entry); err == nil {
+				t.Store.Set(key, data)
+			}
+		},
+	}
+	return resp
+}
+
+// load returns the stored entry for key if it was stored for a request
+// with the same values for the headers it varies on.
+func (t *CacheTransport) load(key string, req *http.Request) (*cacheEntry, bool) {
+	data, ok := t.Store.Get(key)
+	if !ok {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Store.Delete(key)
+		return nil, false
+	}
+	for name, values := range entry.Vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return nil, false
+		}
+	}
+	return &entry, true
+}
+
+func (t *CacheTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *CacheTransport) now() time.Time {
+	if t.clock != nil {
+		return t.clock.Now()
+	}
+	return time.Now()
+}
+
+func cacheKey(req *http.Request) string {
+	return req.URL.String()
+}
+
+// bypassesCache reports whether req asks for something the cache can't
+// answer: a conditional request expects the caller's own 304s, and a
+// range request expects a 206.
+func bypassesCache(req *http.Request) bool {
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+		if req.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func invalidates(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isServerError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// heuristicStatuses can be stored without explicit freshness (RFC 7231
+// section 6.1).
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// storable reports whether resp may be stored and is worth storing.
+func storable(resp *http.Response, reqCC cacheControl) bool {
+	cc := parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || cc.has("no-store") || !heuristicStatuses[resp.StatusCode] {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	h := resp.Header
+	return cc.has("max-age") || h.Get("Expires") != "" || h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// varyHeaders returns the request headers the response varies on.
+func varyHeaders(req *http.Request, respHeader http.Header) http.Header {
+	vary := http.Header{}
+	for _, v := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+	return vary
+}
+
+// cacheEntry is a stored response, kept as JSON.
+type cacheEntry struct {
+	StatusCode   int         `json:"status"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+	Vary         http.Header `json:"vary,omitempty"`
+	RequestTime  time.Time   `json:"requestTime"`
+	ResponseTime time.Time   `json:"responseTime"`
+}
+
+// fresh reports whether e can be served without asking the server.
+func (e *cacheEntry) fresh(now time.Time, reqCC cacheControl) bool {
+	if reqCC.has("no-cache") || parseCacheControl(e.Header).has("no-cache") {
+		return false
+	}
+	age := e.age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < e.lifetime()
+}
+
+// lifetime is how long e is fresh for (RFC 7234 section 4.2.1).
+func (e *cacheEntry) lifetime() time.Duration {
+	if maxAge, ok := parseCacheControl(e.Header).seconds("max-age"); ok {
+		return maxAge
+	}
+	date := e.date()
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// An invalid Expires means already expired
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && date.After(lm) {
+		// The usual heuristic: a tenth of the time since it last changed
+		return date.Sub(lm) / 10
+	}
+	return 0
+}
+
+// age is how old e is now (RFC 7234 section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	corrected := e.ResponseTime.Sub(e.RequestTime)
+	if secs, err := strconv.Atoi(e.Header.Get("Age")); err == nil && secs > 0 {
+		corrected += time.Duration(secs) * time.Second
+	}
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// date is the response's Date, or when it arrived if it had none.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// staleIfError reports whether e may stand in for a failed request
+// (RFC 5861). must-revalidate forbids it.
+func (e *cacheEntry) staleIfError(now time.Time, reqCC cacheControl) bool {
+	cc := parseCacheControl(e.Header)
+	if cc.has("must-revalidate") {
+		return false
+	}
+	limit, ok := reqCC.seconds("stale-if-error")
+	if !ok {
+		limit, ok = cc.seconds("stale-if-error")
+	}
+	return ok && e.age(now)-e.lifetime() <= limit
+}
+
+// revalidated updates e from a 304's headers.
+func (e *cacheEntry) revalidated(header http.Header, requestTime, responseTime time.Time) {
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.RequestTime, e.ResponseTime = requestTime, responseTime
+}
+
+// response builds the response served for req from e.
+func (e *cacheEntry) response(req *http.Request, now time.Time, xcache string) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	header.Set(XCacheHeader, xcache)
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// teeBody copies what the caller reads, and hands it to done at EOF
+// unless it grew past limit.
+type teeBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func([]byte)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+// cacheControl is a parsed Cache-Control header: directive to value.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns a delta-seconds directive such as max-age.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs < 0 {
+		return 0, true
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// discard drains a little of resp's body, so the connection can be
+// reused, and closes it.
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// origin is a test server whose headers, body and status the test sets.
+// It answers If-None-Match and If-Modified-Since itself, and dates its
+// responses by clock.
+type origin struct {
+	*httptest.Server
+	clock *fakeClock
+
+	mu      sync.Mutex
+	header  http.Header
+	body    string
+	status  int
+	hits    int
+	lastReq http.Header
+}
+
+func newOrigin(t *testing.T, header http.Header, body string) *origin {
+	t.Helper()
+	o := &origin{header: header, body: body, status: http.StatusOK}
+	o.Server = httptest.NewServer(http.HandlerFunc(o.serve))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *origin) serve(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.hits++
+	o.lastReq = r.Header.Clone()
+	if o.clock != nil {
+		w.Header().Set("Date", o.clock.Now().UTC().Format(http.TimeFormat))
+	}
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	if o.status != http.StatusOK {
+		w.WriteHeader(o.status)
+		return
+	}
+	if etag := o.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if lm := o.header.Get("Last-Modified"); lm != "" && r.Header.Get("If-Modified-Since") == lm {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	io.WriteString(w, o.body)
+}
+
+func (o *origin) set(f func(o *origin)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f(o)
+}
+
+func (o *origin) Hits() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.hits
+}
+
+func (o *origin) LastRequest() http.Header {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lastReq
+}
+
+// newTestCache returns a CacheTransport over o, with both on a fake
+// clock that starts at the real time, so tests can build headers from
+// time.Now.
+func newTestCache(o *origin) (*CacheTransport, *fakeClock) {
+	clk := newFakeClock()
+	clk.now = time.Now()
+	o.clock = clk
+	ct := NewCacheTransport(o.Client().Transport, NewMemoryCache(1<<20))
+	ct.clock = clk
+	return ct, clk
+}
+
+// fetchThrough sends a GET through rt, reads the whole body and returns
+// the response and body.
+func fetchThrough(t *testing.T, rt http.RoundTripper, url string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// expectCache checks a response's X-Cache value and body.
+func expectCache(t *testing.T, resp *http.Response, body, wantXCache, wantBody string) {
+	t.Helper()
+	if got := resp.Header.Get(XCacheHeader); got != wantXCache {
+		t.Errorf("Expected X-Cache %s, got %q", wantXCache, got)
+	}
+	if body != wantBody {
+		t.Errorf("Expected body %q, got %q", wantBody, body)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}}, "reference data")
+	ct, clk := newTestCache(o)
+
+	resp, body := fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheMiss, "reference data")
+
+	clk.Advance(30 * time.Second)
+	resp, body = fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheHit, "reference data")
+	if o.Hits() != 1 {
+		t.Errorf("Expected one request to the origin, got %d", o.Hits())
+	}
+	if age := resp.Header.Get("Age"); age != "30" {
+		t.Errorf("Expected Age 30, got %q", age)
+	}
+
+	// Expired and no validator: fetched again
+	clk.Advance(31 * time.Second)
+	resp, body = fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheMiss, "reference data")
+	if o.Hits() != 2 {
+		t.Errorf("Expected a second request once stale, got %d", o.Hits())
+	}
+}
+
+func TestCacheRevalidatesETag(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=10"}, "Etag": {`"v1"`}}, "version 1")
+	ct, clk := newTestCache(o)
+
+	fetchThrough(t, ct, o.URL, nil)
+	clk.Advance(time.Minute)
+	resp, body := fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheRevalidated, "version 1")
+	if inm := o.LastRequest().Get("If-None-Match"); inm != `"v1"` {
+		t.Errorf("Expected If-None-Match \"v1\", got %q", inm)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the caller to see 200, got %d", resp.StatusCode)
+	}
+
+	// The 304 made it fresh again
+	resp, _ = fetchThrough(t, ct, o.URL, nil)
+	if resp.Header.Get(XCacheHeader) != XCacheHit || o.Hits() != 2 {
+		t.Errorf("Expected a hit after revalidating, got %s with %d hits", resp.Header.Get(XCacheHeader), o.Hits())
+	}
+
+	// A changed resource replaces the entry
+	o.set(func(o *origin) {
+		o.header.Set("ETag", `"v2"`)
+		o.body = "version 2"
+	})
+	clk.Advance(time.Minute)
+	resp, body = fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheMiss, "version 2")
+	resp, body = fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheHit, "version 2")
+}
+
+func TestCacheRevalidatesLastModified(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=0"}, "Last-Modified": {lastModified}}, "data")
+	ct, _ := newTestCache(o)
+
+	fetchThrough(t, ct, o.URL, nil)
+	resp, body := fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheRevalidated, "data")
+	if ims := o.LastRequest().Get("If-Modified-Since"); ims != lastModified {
+		t.Errorf("Expected If-Modified-Since %q, got %q", lastModified, ims)
+	}
+}
+
+func TestCacheHeuristicFreshness(t *testing.T) {
+	now := time.Now().UTC()
+	o := newOrigin(t, http.Header{
+		"Date":          {now.Format(http.TimeFormat)},
+		"Last-Modified": {now.Add(-100 * time.Minute).Format(http.TimeFormat)},
+	}, "data")
+	ct, clk := newTestCache(o)
+
+	fetchThrough(t, ct, o.URL, nil)
+	clk.Advance(9 * time.Minute)
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheHit {
+		t.Errorf("Expected a hit within a tenth of the age, got %s", resp.Header.Get(XCacheHeader))
+	}
+	clk.Advance(2 * time.Minute)
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheRevalidated {
+		t.Errorf("Expected revalidation after it, got %s", resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	now := time.Now().UTC()
+	o := newOrigin(t, http.Header{
+		"Date":    {now.Format(http.TimeFormat)},
+		"Expires": {now.Add(time.Minute).Format(http.TimeFormat)},
+	}, "data")
+	ct, clk := newTestCache(o)
+
+	fetchThrough(t, ct, o.URL, nil)
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheHit {
+		t.Errorf("Expected a hit before Expires, got %s", resp.Header.Get(XCacheHeader))
+	}
+	clk.Advance(2 * time.Minute)
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheMiss {
+		t.Errorf("Expected a miss after Expires, got %s", resp.Header.Get(XCacheHeader))
+	}
+
+	o.set(func(o *origin) { o.header.Set("Expires", "0") })
+	fetchThrough(t, ct, o.URL, nil)
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheMiss {
+		t.Errorf("Expected an invalid Expires to mean expired, got %s", resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheNoStore(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}}, "data")
+	ct, _ := newTestCache(o)
+
+	// Asked not to store by the request...
+	fetchThrough(t, ct, o.URL, http.Header{"Cache-Control": {"no-store"}})
+	fetchThrough(t, ct, o.URL, nil)
+	// ...then stored, then told not to by the response
+	o.set(func(o *origin) { o.header.Set("Cache-Control", "no-store, max-age=60") })
+	ct.clock.(*fakeClock).Advance(time.Hour)
+	fetchThrough(t, ct, o.URL, nil)
+	fetchThrough(t, ct, o.URL, nil)
+
+	if o.Hits() != 4 {
+		t.Errorf("Expected every request but one to reach the origin, got %d of 4", o.Hits())
+	}
+	if n := ct.Store.(*MemoryCache).Len(); n != 0 {
+		t.Errorf("Expected no-store to drop the entry, %d left", n)
+	}
+}
+
+func TestCacheNoCache(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"no-cache, max-age=60"}, "Etag": {`"a"`}}, "data")
+	ct, _ := newTestCache(o)
+
+	fetchThrough(t, ct, o.URL, nil)
+	resp, body := fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheRevalidated, "data")
+
+	// A request can ask for revalidation too
+	o.set(func(o *origin) { o.header.Set("Cache-Control", "max-age=60") })
+	fetchThrough(t, ct, o.URL, nil)
+	resp, _ = fetchThrough(t, ct, o.URL, http.Header{"Cache-Control": {"no-cache"}})
+	if resp.Header.Get(XCacheHeader) != XCacheRevalidated {
+		t.Errorf("Expected request no-cache to revalidate, got %s", resp.Header.Get(XCacheHeader))
+	}
+	resp, _ = fetchThrough(t, ct, o.URL, http.Header{"Cache-Control": {"max-age=0"}})
+	if resp.Header.Get(XCacheHeader) != XCacheRevalidated {
+		t.Errorf("Expected request max-age=0 to revalidate, got %s", resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		reqCC        string
+		want         string
+	}{
+		{"allowed", "max-age=10, stale-if-error=300", "", XCacheStale},
+		{"too stale", "max-age=10, stale-if-error=30", "", XCacheMiss},
+		{"allowed by the request", "max-age=10", "stale-if-error=300", XCacheStale},
+		{"not allowed", "max-age=10", "", XCacheMiss},
+		{"must-revalidate", "max-age=10, must-revalidate, stale-if-error=300", "", XCacheMiss},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOrigin(t, http.Header{"Cache-Control": {tt.cacheControl}}, "good")
+			ct, clk := newTestCache(o)
+			fetchThrough(t, ct, o.URL, nil)
+
+			clk.Advance(time.Minute)
+			o.set(func(o *origin) { o.status = http.StatusServiceUnavailable })
+			var header http.Header
+			if tt.reqCC != "" {
+				header = http.Header{"Cache-Control": {tt.reqCC}}
+			}
+			resp, body := fetchThrough(t, ct, o.URL, header)
+			if got := resp.Header.Get(XCacheHeader); got != tt.want {
+				t.Errorf("Expected X-Cache %s, got %q", tt.want, got)
+			}
+			if tt.want == XCacheStale && (body != "good" || resp.StatusCode != http.StatusOK) {
+				t.Errorf("Expected the stale 200, got %d %q", resp.StatusCode, body)
+			}
+			if tt.want != XCacheStale && resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("Expected the 503, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCacheStaleIfErrorOnNetworkError(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=10, stale-if-error=300"}}, "good")
+	ct, clk := newTestCache(o)
+	fetchThrough(t, ct, o.URL, nil)
+
+	o.Close()
+	clk.Advance(time.Minute)
+	resp, body := fetchThrough(t, ct, o.URL, nil)
+	expectCache(t, resp, body, XCacheStale, "good")
+}
+
+func TestCacheVary(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}, "data")
+	ct, _ := newTestCache(o)
+	en := http.Header{"Accept-Language": {"en"}}
+
+	fetchThrough(t, ct, o.URL, en)
+	if resp, _ := fetchThrough(t, ct, o.URL, en); resp.Header.Get(XCacheHeader) != XCacheHit {
+		t.Errorf("Expected a hit for the same language, got %s", resp.Header.Get(XCacheHeader))
+	}
+	if resp, _ := fetchThrough(t, ct, o.URL, http.Header{"Accept-Language": {"tr"}}); resp.Header.Get(XCacheHeader) != XCacheMiss {
+		t.Errorf("Expected a miss for another language, got %s", resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheInvalidatesOnUnsafeMethods(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}}, "data")
+	ct, _ := newTestCache(o)
+	fetchThrough(t, ct, o.URL, nil)
+
+	req, _ := http.NewRequest(http.MethodPut, o.URL, strings.NewReader("new"))
+	resp, err := ct.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheMiss {
+		t.Errorf("Expected the PUT to drop the entry, got %s", resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}}, "data")
+	ct, _ := newTestCache(o)
+	fetchThrough(t, ct, o.URL, nil)
+
+	// The caller's own conditional request gets the server's 304
+	resp, _ := fetchThrough(t, ct, o.URL, http.Header{"If-None-Match": {`"a"`}})
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get(XCacheHeader) != "" {
+		t.Errorf("Expected the server's 304, got %d %q", resp.StatusCode, resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheUnfinishedBodyNotStored(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("x", 64<<10))
+	ct, _ := newTestCache(o)
+
+	req, _ := http.NewRequest(http.MethodGet, o.URL, nil)
+	resp, err := ct.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 10))
+	resp.Body.Close()
+
+	if resp, _ := fetchThrough(t, ct, o.URL, nil); resp.Header.Get(XCacheHeader) != XCacheMiss {
+		t.Errorf("Expected a half-read body not to be stored, got %s", resp.Header.Get(XCacheHeader))
+	}
+}
+
+func TestCacheMaxEntryBytes(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("x", 100))
+	ct, _ := newTestCache(o)
+	ct.MaxEntryBytes = 99
+
+	fetchThrough(t, ct, o.URL, nil)
+	resp, body := fetchThrough(t, ct, o.URL, nil)
+	if resp.Header.Get(XCacheHeader) != XCacheMiss || len(body) != 100 {
+		t.Errorf("Expected an oversized body to pass through unstored, got %s with %d bytes", resp.Header.Get(XCacheHeader), len(body))
+	}
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"no freshness or validator", http.Header{}, http.StatusOK},
+		{"uncacheable status", http.Header{"Cache-Control": {"max-age=60"}}, http.StatusInternalServerError},
+		{"vary star", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOrigin(t, tt.header, "data")
+			o.status = tt.status
+			ct, _ := newTestCache(o)
+			fetchThrough(t, ct, o.URL, nil)
+			fetchThrough(t, ct, o.URL, nil)
+			if o.Hits() != 2 {
+				t.Errorf("Expected nothing stored, got %d origin hits", o.Hits())
+			}
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(http.Header{"Cache-Control": {`Max-Age=60, no-cache="Set-Cookie"`, "private"}})
+	if secs, ok := cc.seconds("max-age"); !ok || secs != time.Minute {
+		t.Errorf("Expected max-age 60s, got %v %v", secs, ok)
+	}
+	if !cc.has("no-cache") || !cc.has("private") || cc["no-cache"] != "Set-Cookie" {
+		t.Errorf("Unexpected directives: %v", cc)
+	}
+	if secs, ok := parseCacheControl(http.Header{"Cache-Control": {"max-age=soon"}}).seconds("max-age"); !ok || secs != 0 {
+		t.Errorf("Expected an invalid max-age to mean 0, got %v %v", secs, ok)
+	}
+}
+
+// forEachCacheStore runs fn against every CacheStore.
+func forEachCacheStore(t *testing.T, fn func(t *testing.T, store CacheStore)) {
+	t.Run("memory", func(t *testing.T) { fn(t, NewMemoryCache(1<<20)) })
+	t.Run("disk", func(t *testing.T) {
+		store, err := NewDiskCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(t, store)
+	})
+}
+
+func TestCacheStore(t *testing.T) {
+	forEachCacheStore(t, func(t *testing.T, store CacheStore) {
+		if _, ok := store.Get("https://example.com/a"); ok {
+			t.Error("Expected a miss in an empty store")
+		}
+		store.Set("https://example.com/a", []byte("one"))
+		store.Set("https://example.com/a?b=c", []byte("two"))
+		store.Set("https://example.com/a", []byte("three"))
+		if got, ok := store.Get("https://example.com/a"); !ok || string(got) != "three" {
+			t.Errorf("Expected the overwritten value, got %q %v", got, ok)
+		}
+		if got, ok := store.Get("https://example.com/a?b=c"); !ok || string(got) != "two" {
+			t.Errorf("Expected the second key's value, got %q %v", got, ok)
+		}
+		store.Delete("https://example.com/a")
+		store.Delete("https://example.com/missing")
+		if _, ok := store.Get("https://example.com/a"); ok {
+			t.Error("Expected a miss after Delete")
+		}
+	})
+}
+
+func TestCacheTransportWithEachStore(t *testing.T) {
+	forEachCacheStore(t, func(t *testing.T, store CacheStore) {
+		o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}}, "data")
+		ct, _ := newTestCache(o)
+		ct.Store = store
+		fetchThrough(t, ct, o.URL, nil)
+		resp, body := fetchThrough(t, ct, o.URL, nil)
+		expectCache(t, resp, body, XCacheHit, "data")
+	})
+}
+
+func TestMemoryCacheEvictsLRU(t *testing.T) {
+	// Each entry is a 1-byte key and a 9-byte value
+	c := NewMemoryCache(30)
+	value := bytes.Repeat([]byte("v"), 9)
+	c.Set("a", value)
+	c.Set("b", value)
+	c.Set("c", value)
+	c.Get("a") // a is now the most recently used
+	c.Set("d", value)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("Expected %s to be kept", key)
+		}
+	}
+
+	c.Set("huge", bytes.Repeat([]byte("v"), 100))
+	if _, ok := c.Get("huge"); ok || c.Len() != 3 {
+		t.Errorf("Expected a value bigger than the cache to be refused, have %d entries", c.Len())
+	}
+}
+
+func TestDiskCachePersists(t *testing.T) {
+	dir := t.TempDir()
+	first, _ := NewDiskCache(dir)
+	first.Set("https://example.com/posts", []byte("stored"))
+
+	second, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := second.Get("https://example.com/posts"); !ok || string(got) != "stored" {
+		t.Errorf("Expected the entry to survive a new DiskCache, got %q %v", got, ok)
+	}
+}
+
+func TestCacheConcurrentUse(t *testing.T) {
+	o := newOrigin(t, http.Header{"Cache-Control": {"max-age=60"}}, "data")
+	ct, _ := newTestCache(o)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("%s/%d", o.URL, i%4)
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			resp, err := ct.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MemoryCache is a CacheStore that keeps up to maxBytes of entries in
+// memory and evicts the least recently used first.
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	value []byte
+}
+
+// NewMemoryCache returns an empty MemoryCache holding up to maxBytes of
+// keys and values.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*memoryItem).value, true
+}
+
+// Set stores value under key, evicting old entries to make room. A value
+// bigger than the whole cache isn't stored.
+func (c *MemoryCache) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	size := itemSize(key, value)
+	if size > c.maxBytes {
+		return
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.order.Back().Value.(*memoryItem).key)
+	}
+	c.items[key] = c.order.PushFront(&memoryItem{key: key, value: value})
+	c.size += size
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// Len returns the number of entries.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// remove drops key, if present. c.mu must be held.
+func (c *MemoryCache) remove(key string) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	item := c.order.Remove(el).(*memoryItem)
+	delete(c.items, key)
+	c.size -= itemSize(item.key, item.value)
+}
+
+func itemSize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// DiskCache is a CacheStore that keeps one file per entry in a
+// directory, so entries outlive the process: a batch job run twice only
+// revalidates what the first run fetched. It doesn't limit its size.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns a DiskCache in dir, creating it if needed.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+// Get returns the entry for key; a file that can't be read is a miss.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Set writes value to a temporary file and renames it into place, so a
+// reader never sees half an entry.
+func (c *DiskCache) Set(key string, value []byte) {
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+func (c *DiskCache) Delete(key string) {
+	os.Remove(c.path(key))
+}
+
+// path names an entry's file after a hash of its key: URLs can be long
+// and hold characters a file name can't.
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
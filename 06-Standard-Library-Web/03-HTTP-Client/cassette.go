@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mode says whether a Recorder records or replays.
+type Mode int
+
+const (
+	// ModeReplay serves responses from the cassette and never touches the
+	// network.
+	ModeReplay Mode = iota
+	// ModeRecord sends requests and records them for Save.
+	ModeRecord
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeReplay:
+		return "replay"
+	case ModeRecord:
+		return "record"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Redacted replaces secret header and query values in a cassette.
+const Redacted = "REDACTED"
+
+// ErrNoInteraction matches the error a replaying Recorder returns for a
+// request the cassette has no answer for:
+//
+//	if errors.Is(err, ErrNoInteraction) { ... }
+var ErrNoInteraction = errors.New("no recorded interaction matches")
+
+// UnmatchedRequestError is returned for a request the cassette has no
+// unused interaction for.
+type UnmatchedRequestError struct {
+	Cassette string
+	Method   string
+	URL      string
+}
+
+func (e *UnmatchedRequestError) Error() string {
+	return fmt.Sprintf("cassette %s: %s %s: %v", e.Cassette, e.Method, e.URL, ErrNoInteraction)
+}
+
+// Is makes errors.Is(err, ErrNoInteraction) work.
+func (e *UnmatchedRequestError) Is(target error) bool {
+	return target == ErrNoInteraction
+}
+
+// Cassette is the JSON file a Recorder writes and reads.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded request and the response it got.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is a request as it is stored, after redaction.
+type RecordedRequest struct {
+	Method string       `json:"method"`
+	URL    string       `json:"url"`
+	Header http.Header  `json:"header,omitempty"`
+	Body   RecordedBody `json:"body,omitempty"`
+}
+
+// RecordedResponse is a response as it is stored, after redaction.
+type RecordedResponse struct {
+	StatusCode int          `json:"status"`
+	Header     http.Header  `json:"header,omitempty"`
+	Body       RecordedBody `json:"body,omitempty"`
+}
+
+// RecordedBody is a request or response body. Text is stored as a JSON
+// string so cassettes stay readable and diffable; anything else as
+// base64.
+type RecordedBody []byte
+
+func (b RecordedBody) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(struct {
+		Base64 []byte `json:"base64"`
+	}{b})
+}
+
+func (b *RecordedBody) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = RecordedBody(text)
+		return nil
+	}
+	var binary struct {
+		Base64 []byte `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &binary); err != nil {
+		return fmt.Errorf("body must be a string or {\"base64\": ...}: %w", err)
+	}
+	*b = binary.Base64
+	return nil
+}
+
+// Matcher reports whether a live request, redacted the same way as the
+// cassette, matches a recorded one.
+type Matcher func(live, recorded RecordedRequest) bool
+
+// MatchMethod matches on the HTTP method.
+func MatchMethod(live, recorded RecordedRequest) bool {
+	return live.Method == recorded.Method
+}
+
+// MatchURL matches on the whole URL, query included.
+func MatchURL(live, recorded RecordedRequest) bool {
+	return live.URL == recorded.URL
+}
+
+// MatchBody matches on the request body, byte for byte.
+func MatchBody(live, recorded RecordedRequest) bool {
+	return bytes.Equal(live.Body, recorded.Body)
+}
+
+// MatchHeaders returns a Matcher that matches on the named headers.
+func MatchHeaders(names ...string) Matcher {
+	return func(live, recorded RecordedRequest) bool {
+		for _, name := range names {
+			if strings.Join(live.Header.Values(name), ",") != strings.Join(recorded.Header.Values(name), ",") {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DefaultMatchers match on method and URL.
+var DefaultMatchers = []Matcher{MatchMethod, MatchURL}
+
+// DefaultRedactedHeaders are the headers a Recorder redacts unless told
+// otherwise.
+var DefaultRedactedHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key",
+}
+
+// Recorder is a VCR-style http.RoundTripper for tests. Recording, it
+// sends requests through Base and keeps each request and response for
+// Save to write to a cassette file. Replaying, it answers each request
+// with the first unused recorded interaction that matches it, so the
+// same request made twice gets the two responses in the order they were
+// recorded:
+//
+//	rec, err := NewRecorder("testdata/cassettes/posts.json", ModeReplay)
+//	client := &http.Client{Transport: rec}
+//
+// Secrets never reach the file: the values of RedactHeaders and
+// RedactQuery are replaced by Redacted before an interaction is kept, and
+// a live request is redacted the same way before it is matched.
+type Recorder struct {
+	// Base sends requests while recording; http.DefaultTransport if nil.
+	Base http.RoundTripper
+	// Matchers must all match for a recorded request to answer a live one.
+	Matchers []Matcher
+	// RedactHeaders are redacted in requests and responses.
+	RedactHeaders []string
+	// RedactQuery are query parameters redacted in request URLs.
+	RedactQuery []string
+
+	path string
+	mode Mode
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// NewRecorder returns a Recorder for the cassette at path. Replaying
+// reads the cassette, which must exist; recording starts an empty one.
+func NewRecorder(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{
+		Matchers:      DefaultMatchers,
+		RedactHeaders: DefaultRedactedHeaders,
+		path:          path,
+		mode:          mode,
+	}
+	switch mode {
+	case ModeRecord:
+	case ModeReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("load cassette: %w", err)
+		}
+		var c Cassette
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("load cassette %s: %w", path, err)
+		}
+		r.interactions = c.Interactions
+		r.used = make([]bool, len(c.Interactions))
+	default:
+		return nil, fmt.Errorf("unknown recorder mode %v", mode)
+	}
+	return r, nil
+}
+
+// Mode returns whether r records or replays.
+func (r *Recorder) Mode() Mode {
+	return r.mode
+}
+
+// RoundTrip records or replays req.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	live := r.recordRequest(req, body)
+	if r.mode == ModeReplay {
+		return r.replay(req, live)
+	}
+
+	sent := req.Clone(req.Context())
+	if body != nil {
+		sent.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := r.base().RoundTrip(sent)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("record %s %s: read response: %w", req.Method, req.URL.Redacted(), err)
+	}
+
+	recorded := RecordedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     r.redactHeader(resp.Header),
+		Body:       respBody,
+	}
+	r.mu.Lock()
+	r.interactions = append(r.interactions, Interaction{Request: live, Response: recorded})
+	r.mu.Unlock()
+
+	// The caller gets the real response, secrets and all
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, live RecordedRequest) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.interactions {
+		if r.used[i] || !r.matches(live, in.Request) {
+			continue
+		}
+		r.used[i] = true
+		rec := in.Response
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+			StatusCode:    rec.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        rec.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+			ContentLength: int64(len(rec.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, &UnmatchedRequestError{Cassette: r.path, Method: live.Method, URL: live.URL}
+}
+
+func (r *Recorder) matches(live, recorded RecordedRequest) bool {
+	for _, match := range r.Matchers {
+		if !match(live, recorded) {
+			return false
+		}
+	}
+	return true
+}
+
+// Save writes what was recorded to the cassette file, creating its
+// directory if needed. It does nothing when replaying.
+func (r *Recorder) Save() error {
+	if r.mode != ModeRecord {
+		return nil
+	}
+	r.mu.Lock()
+	c := Cassette{Interactions: append([]Interaction{}, r.interactions...)}
+	r.mu.Unlock()
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	// Write and rename, so a failed save doesn't truncate the old cassette
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// Unused returns the interactions replay hasn't served, e.g. so a test
+// can check it made every request it was recorded making.
+func (r *Recorder) Unused() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []Interaction
+	for i, in := range r.interactions {
+		if !r.used[i] {
+			unused = append(unused, in)
+		}
+	}
+	return unused
+}
+
+// recordRequest returns req as it is stored and matched.
+func (r *Recorder) recordRequest(req *http.Request, body []byte) RecordedRequest {
+	u := *req.URL
+	if len(r.RedactQuery) > 0 {
+		query := u.Query()
+		for _, name := range r.RedactQuery {
+			if query.Has(name) {
+				query.Set(name, Redacted)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return RecordedRequest{
+		Method: req.Method,
+		URL:    redactUserinfo(&u),
+		Header: r.redactHeader(req.Header),
+		Body:   body,
+	}
+}
+
+// redactHeader returns a copy of h with secret values replaced.
+func (r *Recorder) redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range r.RedactHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			redacted := make([]string, len(values))
+			for i := range redacted {
+				redacted[i] = Redacted
+			}
+			h[http.CanonicalHeaderKey(name)] = redacted
+		}
+	}
+	return h
+}
+
+func (r *Recorder) base() http.RoundTripper {
+	if r.Base != nil {
+		return r.Base
+	}
+	return http.DefaultTransport
+}
+
+// redactUserinfo returns u as a string with any password replaced.
+func redactUserinfo(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), Redacted)
+	}
+	return u.String()
+}
+
+// readRequestBody reads and closes req's body; nil if it has none.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// echoServer answers every request with its method, path and body, and
+// sets a session cookie.
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cr3t"})
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// send makes a request through rt and returns the status and body.
+func send(t *testing.T, rt http.RoundTripper, method, url, body string, header http.Header) (int, string, error) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, _ := http.NewRequest(method, url, r)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), err
+}
+
+// record records fn's requests to a new cassette and returns its path.
+func record(t *testing.T, configure func(*Recorder), fn func(rt http.RoundTripper)) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cassettes", "test.json")
+	rec, err := NewRecorder(path, ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(rec)
+	}
+	fn(rec)
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func replayer(t *testing.T, path string) *Recorder {
+	t.Helper()
+	rec, err := NewRecorder(path, ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestRecorderRecordAndReplay(t *testing.T) {
+	server := echoServer(t)
+	path := record(t, nil, func(rt http.RoundTripper) {
+		if _, body, err := send(t, rt, http.MethodPost, server.URL+"/posts", `{"title":"x"}`, nil); err != nil || body != `POST /posts {"title":"x"}` {
+			t.Fatalf("Expected the real response while recording, got %q %v", body, err)
+		}
+		send(t, rt, http.MethodGet, server.URL+"/posts/1", "", nil)
+	})
+	server.Close()
+
+	rec := replayer(t, path)
+	status, body, err := send(t, rec, http.MethodGet, server.URL+"/posts/1", "", nil)
+	if err != nil || status != http.StatusOK || body != "GET /posts/1 " {
+		t.Errorf("Expected the recorded GET, got %d %q %v", status, body, err)
+	}
+	_, body, err = send(t, rec, http.MethodPost, server.URL+"/posts", `{"title":"x"}`, nil)
+	if err != nil || body != `POST /posts {"title":"x"}` {
+		t.Errorf("Expected the recorded POST, got %q %v", body, err)
+	}
+	if unused := rec.Unused(); len(unused) != 0 {
+		t.Errorf("Expected every interaction used, %d left", len(unused))
+	}
+}
+
+func TestRecorderUnmatched(t *testing.T) {
+	server := echoServer(t)
+	path := record(t, nil, func(rt http.RoundTripper) {
+		send(t, rt, http.MethodGet, server.URL+"/posts/1", "", nil)
+	})
+	rec := replayer(t, path)
+
+	_, _, err := send(t, rec, http.MethodGet, server.URL+"/posts/2", "", nil)
+	var unmatched *UnmatchedRequestError
+	if !errors.Is(err, ErrNoInteraction) || !errors.As(err, &unmatched) {
+		t.Fatalf("Expected an *UnmatchedRequestError, got %v", err)
+	}
+	if unmatched.Method != http.MethodGet || !strings.HasSuffix(unmatched.URL, "/posts/2") || unmatched.Cassette != path {
+		t.Errorf("Unexpected error: %+v", unmatched)
+	}
+
+	// Through an http.Client the error comes back wrapped
+	_, err = (&http.Client{Transport: rec}).Get(server.URL + "/posts/3")
+	if !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("Expected ErrNoInteraction through a client, got %v", err)
+	}
+}
+
+func TestRecorderReplaysRepeatsInOrder(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		io.WriteString(w, strings.Repeat("x", count))
+	}))
+	defer server.Close()
+	path := record(t, nil, func(rt http.RoundTripper) {
+		send(t, rt, http.MethodGet, server.URL, "", nil)
+		send(t, rt, http.MethodGet, server.URL, "", nil)
+	})
+	rec := replayer(t, path)
+
+	for _, want := range []string{"x", "xx"} {
+		if _, body, err := send(t, rec, http.MethodGet, server.URL, "", nil); err != nil || body != want {
+			t.Errorf("Expected %q, got %q %v", want, body, err)
+		}
+	}
+	if _, _, err := send(t, rec, http.MethodGet, server.URL, "", nil); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("Expected the cassette to run out, got %v", err)
+	}
+}
+
+func TestRecorderMatchers(t *testing.T) {
+	server := echoServer(t)
+	path := record(t, nil, func(rt http.RoundTripper) {
+		send(t, rt, http.MethodPost, server.URL+"/posts", "first", http.Header{"Accept-Language": {"en"}})
+		send(t, rt, http.MethodPost, server.URL+"/posts", "second", http.Header{"Accept-Language": {"tr"}})
+	})
+
+	t.Run("body", func(t *testing.T) {
+		rec := replayer(t, path)
+		rec.Matchers = append(DefaultMatchers, MatchBody)
+		if _, body, err := send(t, rec, http.MethodPost, server.URL+"/posts", "second", nil); err != nil || body != "POST /posts second" {
+			t.Errorf("Expected the body to pick the second, got %q %v", body, err)
+		}
+		if _, _, err := send(t, rec, http.MethodPost, server.URL+"/posts", "third", nil); !errors.Is(err, ErrNoInteraction) {
+			t.Errorf("Expected an unknown body not to match, got %v", err)
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		rec := replayer(t, path)
+		rec.Matchers = append(DefaultMatchers, MatchHeaders("Accept-Language"))
+		if _, body, err := send(t, rec, http.MethodPost, server.URL+"/posts", "", http.Header{"Accept-Language": {"tr"}}); err != nil || body != "POST /posts second" {
+			t.Errorf("Expected the header to pick the second, got %q %v", body, err)
+		}
+	})
+
+	t.Run("method and URL", func(t *testing.T) {
+		rec := replayer(t, path)
+		if _, body, err := send(t, rec, http.MethodPost, server.URL+"/posts", "anything", nil); err != nil || body != "POST /posts first" {
+			t.Errorf("Expected the default matchers to ignore the body, got %q %v", body, err)
+		}
+		if _, _, err := send(t, rec, http.MethodPut, server.URL+"/posts", "", nil); !errors.Is(err, ErrNoInteraction) {
+			t.Errorf("Expected another method not to match, got %v", err)
+		}
+	})
+}
+
+func TestRecorderRedacts(t *testing.T) {
+	server := echoServer(t)
+	auth := http.Header{"Authorization": {"Bearer top-secret-token"}, "X-Request-Id": {"42"}}
+	path := record(t, func(rec *Recorder) {
+		rec.RedactQuery = []string{"api_key"}
+	}, func(rt http.RoundTripper) {
+		send(t, rt, http.MethodGet, server.URL+"/posts?api_key=key-123&page=2", "", auth)
+	})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"top-secret-token", "key-123", "s3cr3t"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected %q to be redacted from the cassette:\n%s", secret, data)
+		}
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	req := c.Interactions[0].Request
+	if req.Header.Get("Authorization") != Redacted || req.Header.Get("X-Request-Id") != "42" {
+		t.Errorf("Expected only Authorization redacted, got %v", req.Header)
+	}
+	if !strings.Contains(req.URL, "api_key="+Redacted) || !strings.Contains(req.URL, "page=2") {
+		t.Errorf("Expected only api_key redacted, got %s", req.URL)
+	}
+	if got := c.Interactions[0].Response.Header.Get("Set-Cookie"); got != Redacted {
+		t.Errorf("Expected Set-Cookie redacted, got %q", got)
+	}
+
+	// A live request with a different secret still matches
+	rec := replayer(t, path)
+	rec.RedactQuery = []string{"api_key"}
+	rec.Matchers = append(DefaultMatchers, MatchHeaders("Authorization"))
+	other := http.Header{"Authorization": {"Bearer another-token"}}
+	if _, _, err := send(t, rec, http.MethodGet, server.URL+"/posts?api_key=other&page=2", "", other); err != nil {
+		t.Errorf("Expected the redacted request to match, got %v", err)
+	}
+}
+
+func TestRecorderBinaryBody(t *testing.T) {
+	binary := string([]byte{0xff, 0x00, 0xfe})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, binary)
+	}))
+	defer server.Close()
+	path := record(t, nil, func(rt http.RoundTripper) {
+		send(t, rt, http.MethodGet, server.URL, "", nil)
+	})
+
+	if _, body, err := send(t, replayer(t, path), http.MethodGet, server.URL, "", nil); err != nil || body != binary {
+		t.Errorf("Expected the binary body back, got %q %v", body, err)
+	}
+}
+
+func TestRecorderReplayNeedsCassette(t *testing.T) {
+	if _, err := NewRecorder(filepath.Join(t.TempDir(), "missing.json"), ModeReplay); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing cassette error, got %v", err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	os.WriteFile(bad, []byte("{"), 0o644)
+	if _, err := NewRecorder(bad, ModeReplay); err == nil {
+		t.Error("Expected a malformed cassette to be rejected")
+	}
+}
+
+// fakeCassetteURL is the base URL the posts cassette is recorded under.
+// The fake API listens on a random port, so recording sends the requests
+// there and the cassette keeps this stable name instead.
+const fakeCassetteURL = "http://fake-posts.test"
+
+// TestPostsClientCassette runs PostsClient against a recorded session
+// with the offline fake API (fakeapi.go), not the real posts API. Set
+// RECORD_CASSETTES=1 to record it again from a fresh fake.
+func TestPostsClientCassette(t *testing.T) {
+	path := filepath.Join("testdata", "cassettes", "posts.json")
+	mode := ModeReplay
+	if os.Getenv("RECORD_CASSETTES") != "" {
+		mode = ModeRecord
+	}
+	rec, err := NewRecorder(path, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Matchers = append(DefaultMatchers, MatchBody)
+	if mode == ModeRecord {
+		server := newFakeServer()
+		defer server.Close()
+		target, _ := url.Parse(server.URL)
+		rec.Base = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.URL.Scheme, req.URL.Host, req.Host = target.Scheme, target.Host, ""
+			return http.DefaultTransport.RoundTrip(req)
+		})
+	}
+	t.Cleanup(func() {
+		if err := rec.Save(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	posts, err := NewPostsClient(fakeCassetteURL, &http.Client{Transport: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	post, err := posts.Get(ctx, 1)
+	if err != nil || post.ID != 1 || post.Title == "" {
+		t.Errorf("Expected post 1, got %+v %v", post, err)
+	}
+	list, err := posts.List(ctx, ListOptions{UserID: 1})
+	if err != nil || len(list) == 0 {
+		t.Fatalf("Expected user 1's posts, got %d %v", len(list), err)
+	}
+	for _, p := range list {
+		if p.UserID != 1 {
+			t.Errorf("Expected only user 1's posts, got %+v", p)
+		}
+	}
+	created, err := posts.Create(ctx, Post{UserID: 1, Title: "Recorded", Body: "From a cassette"})
+	if err != nil || created.ID == 0 || created.Title != "Recorded" {
+		t.Errorf("Expected the created post, got %+v %v", created, err)
+	}
+	if _, err := posts.Get(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if mode == ModeReplay && len(rec.Unused()) != 0 {
+		t.Errorf("Expected every recorded request to be made, %d unused", len(rec.Unused()))
+	}
+}
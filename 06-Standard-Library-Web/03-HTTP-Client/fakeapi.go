@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeAPI is an in-memory stand-in for jsonplaceholder's /posts, so the
+// lesson and its tests run without network access. Unlike the real API
+// it keeps what you create, update and delete.
+type fakeAPI struct {
+	mu     sync.Mutex
+	posts  map[int]Post
+	nextID int
+}
+
+// newFakeAPI returns a fakeAPI seeded with a few posts.
+func newFakeAPI() *fakeAPI {
+	api := &fakeAPI{posts: make(map[int]Post), nextID: 1}
+	for _, p := range []Post{
+		{UserID: 1, Title: "sunt aut facere repellat", Body: "quia et suscipit"},
+		{UserID: 1, Title: "qui est esse", Body: "est rerum tempore vitae"},
+		{UserID: 2, Title: "ea molestias quasi", Body: "et iusto sed quo iure"},
+	} {
+		p.ID = api.nextID
+		api.posts[p.ID] = p
+		api.nextID++
+	}
+	return api
+}
+
+// newFakeServer starts an httptest server for a new fakeAPI. The caller
+// must Close it.
+func newFakeServer() *httptest.Server {
+	return httptest.NewServer(newFakeAPI())
+}
+
+// ServeHTTP routes /posts and /posts/{id}. Patterns with methods and
+// wildcards need Go 1.22; this module targets 1.21, so it routes by hand.
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/posts")
+	switch {
+	case !ok:
+		writeAPIError(w, http.StatusNotFound, "no such resource")
+	case rest == "" || rest == "/":
+		switch r.Method {
+		case http.MethodGet:
+			api.list(w, r)
+		case http.MethodPost:
+			api.create(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed")
+		}
+	default:
+		id, err := strconv.Atoi(strings.TrimPrefix(rest, "/"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "no such resource")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			api.get(w, id)
+		case http.MethodPut:
+			api.update(w, r, id)
+		case http.MethodDelete:
+			api.delete(w, id)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed")
+		}
+	}
+}
+
+func (api *fakeAPI) list(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if v := r.URL.Query().Get("userId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "userId must be an integer")
+			return
+		}
+		userID = id
+	}
+
+	api.mu.Lock()
+	posts := []Post{}
+	for _, p := range api.posts {
+		if userID == 0 || p.UserID == userID {
+			posts = append(posts, p)
+		}
+	}
+	api.mu.Unlock()
+
+	sort.Slice(posts, func(i, j int) bool { return posts[i].ID < posts[j].ID })
+	writeAPIJSON(w, http.StatusOK, posts)
+}
+
+func (api *fakeAPI) get(w http.ResponseWriter, id int) {
+	api.mu.Lock()
+	post, ok := api.posts[id]
+	api.mu.Unlock()
+
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("post %d not found", id))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, post)
+}
+
+func (api *fakeAPI) create(w http.ResponseWriter, r *http.Request) {
+	post, ok := decodePost(w, r)
+	if !ok {
+		return
+	}
+
+	api.mu.Lock()
+	post.ID = api.nextID
+	api.nextID++
+	api.posts[post.ID] = post
+	api.mu.Unlock()
+
+	w.Header().Set("Location", postPath(post.ID))
+	writeAPIJSON(w, http.StatusCreated, post)
+}
+
+func (api *fakeAPI) update(w http.ResponseWriter, r *http.Request, id int) {
+	post, ok := decodePost(w, r)
+	if !ok {
+		return
+	}
+	post.ID = id
+
+	api.mu.Lock()
+	_, exists := api.posts[id]
+	if exists {
+		api.posts[id] = post
+	}
+	api.mu.Unlock()
+
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("post %d not found", id))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, post)
+}
+
+func (api *fakeAPI) delete(w http.ResponseWriter, id int) {
+	api.mu.Lock()
+	_, exists := api.posts[id]
+	delete(api.posts, id)
+	api.mu.Unlock()
+
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("post %d not found", id))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, struct{}{})
+}
+
+// decodePost reads a post and checks the fields jsonplaceholder requires.
+func decodePost(w http.ResponseWriter, r *http.Request) (Post, bool) {
+	var post Post
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&post); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "malformed JSON: "+err.Error())
+		return Post{}, false
+	}
+	if strings.TrimSpace(post.Title) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "title is required")
+		return Post{}, false
+	}
+	return post, true
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIJSON(w, status, ErrorBody{Error: msg})
+}
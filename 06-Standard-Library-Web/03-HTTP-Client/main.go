@@ -2,35 +2,50 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
 // This program demonstrates HTTP client in Go
 
-type Post struct {
-	ID    int    `json:"id"`
-	Title string `json:"title"`
-	Body  string `json:"body"`
-}
-
 func main() {
 	fmt.Println("=== HTTP Client ===")
 	fmt.Println()
 
+	// The examples run against an in-memory fake of jsonplaceholder, so
+	// they work offline. Set POSTS_API_URL to use a real server.
+	baseURL := os.Getenv("POSTS_API_URL")
+	if baseURL == "" {
+		fake := newFakeServer()
+		defer fake.Close()
+		baseURL = fake.URL
+		fmt.Printf("Using the offline fake API at %s\n", baseURL)
+		fmt.Printf("(POSTS_API_URL=%s go run . uses the real one)\n", DefaultBaseURL)
+		fmt.Println()
+	}
+
 	// 1. Basic GET request
 	fmt.Println("1. Basic GET Request:")
-	resp, err := http.Get("https://jsonplaceholder.typicode.com/posts/1")
+	resp, err := http.Get(baseURL + "/posts/1")
 	if err != nil {
 		fmt.Printf("   Error: %v\n", err)
 	} else {
-		defer resp.Body.Close()
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("   Status: %s\n", resp.Status)
-		fmt.Printf("   Response length: %d bytes\n", len(body))
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Printf("   Error reading body: %v\n", err)
+		} else {
+			fmt.Printf("   Status: %s\n", resp.Status)
+			fmt.Printf("   Response length: %d bytes\n", len(body))
+		}
 	}
 	fmt.Println()
 
@@ -39,12 +54,12 @@ func main() {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
-	
-	resp2, err := client.Get("https://jsonplaceholder.typicode.com/posts/1")
+
+	resp2, err := client.Get(baseURL + "/posts/1")
 	if err != nil {
 		fmt.Printf("   Error: %v\n", err)
 	} else {
-		defer resp2.Body.Close()
+		resp2.Body.Close()
 		fmt.Printf("   Status: %s\n", resp2.Status)
 	}
 	fmt.Println()
@@ -52,88 +67,116 @@ func main() {
 	// 3. POST request
 	fmt.Println("3. POST Request:")
 	post := Post{
-		Title: "Test Post",
-		Body:  "This is a test post",
+		UserID: 1,
+		Title:  "Test Post",
+		Body:   "This is a test post",
 	}
-	
-	jsonData, _ := json.Marshal(post)
-	resp3, err := http.Post("https://jsonplaceholder.typicode.com/posts", 
-		"application/json", bytes.NewBuffer(jsonData))
+
+	jsonData, err := json.Marshal(post)
 	if err != nil {
+		fmt.Printf("   Error encoding post: %v\n", err)
+	} else if resp3, err := client.Post(baseURL+"/posts", "application/json", bytes.NewReader(jsonData)); err != nil {
 		fmt.Printf("   Error: %v\n", err)
 	} else {
-		defer resp3.Body.Close()
+		resp3.Body.Close()
 		fmt.Printf("   Status: %s\n", resp3.Status)
 	}
 	fmt.Println()
 
-	// 4. Custom request with headers
+	// 4. Custom request with headers and a deadline
 	fmt.Println("4. Custom Request with Headers:")
-	req, _ := http.NewRequest("GET", "https://jsonplaceholder.typicode.com/posts/1", nil)
-	req.Header.Set("User-Agent", "Go-Learning-Lab/1.0")
-	req.Header.Set("Accept", "application/json")
-	
-	resp4, err := client.Do(req)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/posts/1", nil)
 	if err != nil {
 		fmt.Printf("   Error: %v\n", err)
 	} else {
-		defer resp4.Body.Close()
-		fmt.Printf("   Status: %s\n", resp4.Status)
+		req.Header.Set("User-Agent", "Go-Learning-Lab/1.0")
+		req.Header.Set("Accept", "application/json")
+
+		resp4, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("   Error: %v\n", err)
+		} else {
+			resp4.Body.Close()
+			fmt.Printf("   Status: %s\n", resp4.Status)
+		}
 	}
 	fmt.Println()
 
 	// 5. Reading response body
 	fmt.Println("5. Reading Response Body:")
-	resp5, err := http.Get("https://jsonplaceholder.typicode.com/posts/1")
-	if err == nil {
-		defer resp5.Body.Close()
-		body, _ := io.ReadAll(resp5.Body)
+	resp5, err := client.Get(baseURL + "/posts/1")
+	if err != nil {
+		fmt.Printf("   Error: %v\n", err)
+	} else {
 		var post Post
-		json.Unmarshal(body, &post)
-		fmt.Printf("   Post ID: %d\n", post.ID)
-		fmt.Printf("   Post Title: %s\n", post.Title)
+		err := json.NewDecoder(resp5.Body).Decode(&post)
+		resp5.Body.Close()
+		if err != nil {
+			fmt.Printf("   Error decoding post: %v\n", err)
+		} else {
+			fmt.Printf("   Post ID: %d\n", post.ID)
+			fmt.Printf("   Post Title: %s\n", post.Title)
+		}
 	}
 	fmt.Println()
 
-	// 6. Error handling
+	// 6. Error handling: a server that isn't there
 	fmt.Println("6. Error Handling:")
-	resp6, err := http.Get("https://invalid-url-that-does-not-exist.com")
-	if err != nil {
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	if resp6, err := client.Get(gone.URL); err != nil {
 		fmt.Printf("   Error (expected): %v\n", err)
 	} else {
-		defer resp6.Body.Close()
+		resp6.Body.Close()
 	}
 	fmt.Println()
 
 	// 7. Response status codes
 	fmt.Println("7. Response Status Codes:")
-	resp7, err := http.Get("https://jsonplaceholder.typicode.com/posts/1")
-	if err == nil {
-		defer resp7.Body.Close()
+	resp7, err := client.Get(baseURL + "/posts/1")
+	if err != nil {
+		fmt.Printf("   Error: %v\n", err)
+	} else {
+		resp7.Body.Close()
 		fmt.Printf("   Status Code: %d\n", resp7.StatusCode)
 		fmt.Printf("   Status: %s\n", resp7.Status)
-		
+
 		if resp7.StatusCode == http.StatusOK {
 			fmt.Println("   Request successful!")
 		}
 	}
 	fmt.Println()
 
-	// 8. Client configuration
-	fmt.Println("8. Client Configuration:")
+	// 8. A typed API client
+	fmt.Println("8. Typed API Client:")
+	posts, err := NewPostsClient(baseURL, client)
+	if err != nil {
+		fmt.Printf("   Error: %v\n", err)
+	} else {
+		demoPostsClient(ctx, posts)
+	}
+	fmt.Println()
+
+	// 9. Client configuration
+	fmt.Println("9. Client Configuration:")
 	customClient := &http.Client{
 		Timeout: 5 * time.Second,
 		Transport: &http.Transport{
-			MaxIdleConns:        10,
-			IdleConnTimeout:     30 * time.Second,
-			DisableCompression:  false,
+			MaxIdleConns:       10,
+			IdleConnTimeout:    30 * time.Second,
+			DisableCompression: false,
 		},
 	}
 	fmt.Printf("   Client timeout: %v\n", customClient.Timeout)
+	demoRetries()
+	demoBreaker()
+	demoCache()
 	fmt.Println()
 
-	// 9. Best practices
-	fmt.Println("9. Best Practices:")
+	// 10. Best practices
+	fmt.Println("10. Best Practices:")
 	fmt.Println("   - Always close response body (use defer)")
 	fmt.Println("   - Set timeouts on client")
 	fmt.Println("   - Check status codes")
@@ -142,3 +185,134 @@ func main() {
 	fmt.Println("   - Reuse clients (don't create new client per request)")
 }
 
+// demoPostsClient walks through PostsClient's methods and its typed errors.
+func demoPostsClient(ctx context.Context, posts *PostsClient) {
+	list, err := posts.List(ctx, ListOptions{UserID: 1})
+	if err != nil {
+		fmt.Printf("   List error: %v\n", err)
+		return
+	}
+	fmt.Printf("   User 1 has %d post(s)\n", len(list))
+
+	created, err := posts.Create(ctx, Post{UserID: 1, Title: "Hello", Body: "From PostsClient"})
+	if err != nil {
+		fmt.Printf("   Create error: %v\n", err)
+		return
+	}
+	fmt.Printf("   Created post %d: %q\n", created.ID, created.Title)
+
+	created.Title = "Hello again"
+	if updated, err := posts.Update(ctx, created); err != nil {
+		fmt.Printf("   Update error: %v\n", err)
+	} else {
+		fmt.Printf("   Updated post %d: %q\n", updated.ID, updated.Title)
+	}
+
+	if err := posts.Delete(ctx, created.ID); err != nil {
+		fmt.Printf("   Delete error: %v\n", err)
+	} else {
+		fmt.Printf("   Deleted post %d\n", created.ID)
+	}
+
+	// Non-2xx responses are *APIError values
+	_, err = posts.Get(ctx, 9999)
+	var apiErr *APIError
+	switch {
+	case errors.Is(err, ErrNotFound) && errors.As(err, &apiErr):
+		fmt.Printf("   Get 9999: %d, server said %q\n", apiErr.StatusCode, apiErr.Body.Error)
+	case err != nil:
+		fmt.Printf("   Get 9999 error: %v\n", err)
+	default:
+		fmt.Println("   Get 9999 unexpectedly succeeded")
+	}
+}
+
+// demoRetries sends a GET through a RetryTransport to a server that fails
+// twice before it answers.
+func demoRetries() {
+	var hits atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}))
+	defer flaky.Close()
+
+	retrying := NewRetryTransport(flaky.Client().Transport)
+	retrying.BaseDelay = 50 * time.Millisecond
+	retrying.OnRetry = func(req *http.Request, attempt int, wait time.Duration, resp *http.Response, err error) {
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+		}
+		fmt.Printf("   Retry %d after %s, waiting %v\n", attempt, reason, wait.Round(time.Millisecond))
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: retrying}
+
+	resp, err := client.Get(flaky.URL)
+	if err != nil {
+		fmt.Printf("   Error: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	fmt.Printf("   %s after %d attempts\n", resp.Status, hits.Load())
+}
+
+// demoBreaker trips a circuit breaker on a server that is down, so the
+// next call fails fast instead of reaching it.
+func demoBreaker() {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	breaker := NewBreakerTransport(down.Client().Transport, BreakerPolicy{MinRequests: 3})
+	breaker.OnStateChange = func(host string, from, to State) {
+		fmt.Printf("   Breaker for %s: %s -> %s\n", host, from, to)
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: breaker}
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(down.URL)
+		switch {
+		case errors.Is(err, ErrCircuitOpen):
+			fmt.Println("   Failed fast: circuit open")
+		case err != nil:
+			fmt.Printf("   Error: %v\n", err)
+		default:
+			resp.Body.Close()
+			fmt.Printf("   %s\n", resp.Status)
+		}
+	}
+}
+
+// demoCache fetches the same reference data three times through a
+// CacheTransport: only the first request reaches the server.
+func demoCache() {
+	var hits atomic.Int32
+	reference := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, `["TR","DE","US"]`)
+	}))
+	defer reference.Close()
+
+	cache := NewCacheTransport(reference.Client().Transport, NewMemoryCache(1<<20))
+	client := &http.Client{Timeout: 5 * time.Second, Transport: cache}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(reference.URL + "/countries")
+		if err != nil {
+			fmt.Printf("   Error: %v\n", err)
+			return
+		}
+		// The entry is stored once the body has been read to the end
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		fmt.Printf("   GET /countries: %s\n", resp.Header.Get(XCacheHeader))
+	}
+	fmt.Printf("   The server saw %d request(s)\n", hits.Load())
+}
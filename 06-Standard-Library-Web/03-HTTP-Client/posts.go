@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the public jsonplaceholder API.
+const DefaultBaseURL = "https://jsonplaceholder.typicode.com"
+
+// maxErrorBody caps how much of an error response is kept.
+const maxErrorBody = 4 << 10
+
+// Post is a jsonplaceholder post.
+type Post struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"userId,omitempty"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+}
+
+// ErrNotFound matches an *APIError with status 404:
+//
+//	if errors.Is(err, ErrNotFound) { ... }
+var ErrNotFound = errors.New("not found")
+
+// APIError is returned for every non-2xx response. Body holds the decoded
+// JSON error body, if the server sent one; Raw holds the first bytes of
+// the body as sent.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       ErrorBody
+	Raw        []byte
+}
+
+// ErrorBody is the JSON error body: {"error": "..."}.
+type ErrorBody struct {
+	Error string `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Body.Error != "" {
+		msg += ": " + e.Body.Error
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrNotFound) work for 404 responses.
+func (e *APIError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// PostsClient talks to a jsonplaceholder-style posts API. It is safe for
+// concurrent use; create one and reuse it.
+type PostsClient struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	// UserAgent is sent with every request.
+	UserAgent string
+}
+
+// NewPostsClient returns a client for the API at baseURL, e.g.
+// DefaultBaseURL or an httptest server's URL. A nil httpClient means a
+// client with a 10 second timeout: http.DefaultClient has none.
+func NewPostsClient(baseURL string, httpClient *http.Client) (*PostsClient, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("base URL %q must be http or https", baseURL)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &PostsClient{
+		baseURL:    u,
+		httpClient: httpClient,
+		UserAgent:  "Go-Learning-Lab/1.0",
+	}, nil
+}
+
+// ListOptions filters List. Zero values mean no filter.
+type ListOptions struct {
+	UserID int
+}
+
+// List returns the posts matching opts.
+func (c *PostsClient) List(ctx context.Context, opts ListOptions) ([]Post, error) {
+	query := url.Values{}
+	if opts.UserID != 0 {
+		query.Set("userId", strconv.Itoa(opts.UserID))
+	}
+	var posts []Post
+	if err := c.do(ctx, http.MethodGet, "/posts", query, nil, &posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// Get returns the post with id.
+func (c *PostsClient) Get(ctx context.Context, id int) (Post, error) {
+	var post Post
+	err := c.do(ctx, http.MethodGet, postPath(id), nil, nil, &post)
+	return post, err
+}
+
+// Create creates post and returns it with the ID the server assigned.
+func (c *PostsClient) Create(ctx context.Context, post Post) (Post, error) {
+	var created Post
+	err := c.do(ctx, http.MethodPost, "/posts", nil, post, &created)
+	return created, err
+}
+
+// Update replaces the post with post.ID.
+func (c *PostsClient) Update(ctx context.Context, post Post) (Post, error) {
+	var updated Post
+	err := c.do(ctx, http.MethodPut, postPath(post.ID), nil, post, &updated)
+	return updated, err
+}
+
+// Delete deletes the post with id.
+func (c *PostsClient) Delete(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, postPath(id), nil, nil, nil)
+}
+
+func postPath(id int) string {
+	return "/posts/" + strconv.Itoa(id)
+}
+
+// do sends one request. in, if not nil, is sent as JSON; a 2xx response
+// is decoded into out, if not nil. Other statuses become an *APIError.
+func (c *PostsClient) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(req, resp)
+	}
+	if out == nil {
+		// Drain so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: decode response: %w", method, u.Redacted(), err)
+	}
+	return nil
+}
+
+// newAPIError reads the start of an error response. A body that isn't a
+// JSON error object is kept in Raw only.
+func newAPIError(req *http.Request, resp *http.Response) *APIError {
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	e := &APIError{
+		Method:     req.Method,
+		URL:        req.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Raw:        raw,
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		json.Unmarshal(raw, &e.Body)
+	}
+	return e
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a PostsClient for a fresh fake API.
+func newTestClient(t *testing.T) *PostsClient {
+	t.Helper()
+	server := newFakeServer()
+	t.Cleanup(server.Close)
+
+	client, err := NewPostsClient(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestPostsClientCRUD(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	created, err := client.Create(ctx, Post{UserID: 7, Title: "Hello", Body: "World"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if created.ID == 0 || created.Title != "Hello" {
+		t.Errorf("Expected the created post with an ID, got %+v", created)
+	}
+
+	got, err := client.Get(ctx, created.ID)
+	if err != nil || got != created {
+		t.Errorf("Expected %+v, got %+v %v", created, got, err)
+	}
+
+	created.Title = "Hello again"
+	updated, err := client.Update(ctx, created)
+	if err != nil || updated.Title != "Hello again" {
+		t.Errorf("Expected the updated post, got %+v %v", updated, err)
+	}
+
+	if err := client.Delete(ctx, created.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := client.Get(ctx, created.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestPostsClientList(t *testing.T) {
+	client := newTestClient(t)
+
+	all, err := client.List(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, err := client.List(context.Background(), ListOptions{UserID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || len(mine) != 1 || mine[0].UserID != 2 {
+		t.Errorf("Expected 3 posts, 1 by user 2; got %d and %+v", len(all), mine)
+	}
+}
+
+func TestPostsClientAPIError(t *testing.T) {
+	client := newTestClient(t)
+
+	_, err := client.Create(context.Background(), Post{Body: "no title"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected an *APIError, got %T %v", err, err)
+	}
+	if apiErr.StatusCode != http.StatusUnprocessableEntity || apiErr.Method != http.MethodPost {
+		t.Errorf("Unexpected error: %+v", apiErr)
+	}
+	if apiErr.Body.Error != "title is required" {
+		t.Errorf("Expected the decoded error body, got %q", apiErr.Body.Error)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Error("A 422 must not match ErrNotFound")
+	}
+}
+
+func TestPostsClientNonJSONError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client, _ := NewPostsClient(server.URL, server.Client())
+
+	_, err := client.Get(context.Background(), 1)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 *APIError, got %v", err)
+	}
+	if apiErr.Body.Error != "" || string(apiErr.Raw) != "upstream unavailable\n" {
+		t.Errorf("Expected the raw body only, got %+v", apiErr)
+	}
+}
+
+func TestPostsClientMalformedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "one"}`))
+	}))
+	defer server.Close()
+	client, _ := NewPostsClient(server.URL, server.Client())
+
+	if _, err := client.Get(context.Background(), 1); err == nil {
+		t.Error("Expected a decode error")
+	}
+}
+
+func TestPostsClientSendsHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "tests/1.0" {
+			t.Errorf("Expected our User-Agent, got %q", ua)
+		}
+		if r.URL.Path != "/api/posts/3" {
+			t.Errorf("Expected the base path to be kept, got %q", r.URL.Path)
+		}
+		w.Write([]byte(`{"id":3}`))
+	}))
+	defer server.Close()
+
+	client, _ := NewPostsClient(server.URL+"/api/", server.Client())
+	client.UserAgent = "tests/1.0"
+	if _, err := client.Get(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostsClientContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	client, _ := NewPostsClient(server.URL, server.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNewPostsClientRejectsBadURL(t *testing.T) {
+	for _, baseURL := range []string{"ftp://example.com", "://nope"} {
+		if _, err := NewPostsClient(baseURL, nil); err == nil {
+			t.Errorf("%s: expected an error", baseURL)
+		}
+	}
+}
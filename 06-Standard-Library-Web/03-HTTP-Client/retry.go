@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultMaxRetries is how many times a request is retried unless
+	// WithRetryBudget says otherwise.
+	DefaultMaxRetries = 3
+	// DefaultBaseDelay is the backoff cap for the first retry; it
+	// doubles for each retry after that.
+	DefaultBaseDelay = 200 * time.Millisecond
+	// DefaultMaxDelay caps every wait, backoff and Retry-After alike.
+	DefaultMaxDelay = 30 * time.Second
+)
+
+// RetryTransport is an http.RoundTripper that retries idempotent requests
+// after network errors, 429s and 5xx responses:
+//
+//	client := &http.Client{Transport: NewRetryTransport(nil)}
+//
+// Waits use exponential backoff with full jitter: retry n waits a random
+// time between 0 and min(MaxDelay, BaseDelay*2^n), so clients that failed
+// together don't retry together. A Retry-After header replaces the
+// backoff; one asking for more than MaxDelay ends the retries, and the
+// caller gets that response.
+type RetryTransport struct {
+	// Base sends each attempt; http.DefaultTransport if nil.
+	Base       http.RoundTripper
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// OnRetry, if set, is called before each wait, e.g. to log it. resp
+	// is nil when the attempt failed with err.
+	OnRetry func(req *http.Request, attempt int, wait time.Duration, resp *http.Response, err error)
+
+	clock  clock             // replaced in tests
+	jitter func(int64) int64 // returns [0, n); replaced in tests
+}
+
+// NewRetryTransport returns a RetryTransport over base with the default
+// budget and delays.
+func NewRetryTransport(base http.RoundTripper) *RetryTransport {
+	return &RetryTransport{
+		Base:       base,
+		MaxRetries: DefaultMaxRetries,
+		BaseDelay:  DefaultBaseDelay,
+		MaxDelay:   DefaultMaxDelay,
+	}
+}
+
+// clock is the time source for waits and Retry-After dates.
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, or returns ctx.Err() if ctx is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget overrides MaxRetries for requests made with ctx; zero
+// turns retries off.
+func WithRetryBudget(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, retries)
+}
+
+// RoundTrip sends req, retrying while the budget lasts. Each retry sends
+// a clone of req with its body rebuilt by GetBody; a request with a body
+// but no GetBody is sent once, since its body can't be read twice.
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retries := t.MaxRetries
+	if n, ok := ctx.Value(retryBudgetKey{}).(int); ok {
+		retries = n
+	}
+	if !retryable(req) {
+		retries = 0
+	}
+
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base().RoundTrip(attemptReq)
+		if attempt >= retries || !shouldRetry(ctx, resp, err) {
+			return resp, err
+		}
+
+		wait := t.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp, t.now()); ok {
+				wait = after
+			}
+		}
+		if wait > t.maxDelay() || pastDeadline(ctx, t.now().Add(wait)) {
+			return resp, err
+		}
+
+		if t.OnRetry != nil {
+			t.OnRetry(req, attempt+1, wait, resp, err)
+		}
+		if resp != nil {
+			discard(resp)
+		}
+		if err := t.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		attemptReq, err = rewind(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether req may be sent more than once: its method
+// must be idempotent, or it must carry an Idempotency-Key, and its body
+// must be replayable.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+	default:
+		if req.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// shouldRetry reports whether an attempt failed in a way that may pass on
+// a later try. 501 and 505 never change, so they aren't retried, and
+// neither is ErrCircuitOpen.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		// The caller cancelled or ran out of time, or a breaker below us
+		// is open; either way, trying again soon won't help
+		return ctx.Err() == nil && !errors.Is(err, ErrCircuitOpen)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return resp.StatusCode >= 500
+}
+
+// rewind clones req with a fresh body for another attempt.
+func rewind(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+// backoff returns the full-jitter wait before retry attempt+1.
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	base := t.BaseDelay
+	if base <= 0 {
+		base = DefaultBaseDelay
+	}
+	limit := t.maxDelay()
+	ceiling := base
+	for i := 0; i < attempt && ceiling < limit; i++ {
+		ceiling *= 2
+	}
+	if ceiling > limit {
+		ceiling = limit
+	}
+
+	jitter := t.jitter
+	if jitter == nil {
+		jitter = rand.Int63n
+	}
+	return time.Duration(jitter(int64(ceiling) + 1))
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if wait := at.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// pastDeadline reports whether ctx expires before t: waiting that long
+// would only end in a deadline error instead of the last response.
+func pastDeadline(ctx context.Context, t time.Time) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && t.After(deadline)
+}
+
+func (t *RetryTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *RetryTransport) maxDelay() time.Duration {
+	if t.MaxDelay > 0 {
+		return t.MaxDelay
+	}
+	return DefaultMaxDelay
+}
+
+func (t *RetryTransport) now() time.Time {
+	if t.clock != nil {
+		return t.clock.Now()
+	}
+	return time.Now()
+}
+
+func (t *RetryTransport) sleep(ctx context.Context, d time.Duration) error {
+	if t.clock != nil {
+		return t.clock.Sleep(ctx, d)
+	}
+	return realClock{}.Sleep(ctx, d)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock records sleeps instead of waiting, moving Now forward by each.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// Advance moves Now forward by d without recording a sleep.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+// flakyServer fails its first failures requests with status, then
+// answers 200 with the request body echoed back.
+type flakyServer struct {
+	*httptest.Server
+	hits atomic.Int32
+}
+
+func newFlakyServer(t *testing.T, failures int, status int, header http.Header) *flakyServer {
+	t.Helper()
+	s := &flakyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if int(s.hits.Add(1)) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			http.Error(w, "try again", status)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestRetryTransport returns a RetryTransport on a fake clock whose
+// jitter always picks the longest wait.
+func newTestRetryTransport(base http.RoundTripper) (*RetryTransport, *fakeClock) {
+	clk := newFakeClock()
+	rt := NewRetryTransport(base)
+	rt.BaseDelay = 100 * time.Millisecond
+	rt.MaxDelay = time.Second
+	rt.clock = clk
+	rt.jitter = func(n int64) int64 { return n - 1 }
+	return rt, clk
+}
+
+func TestRetryTransportRecovers(t *testing.T) {
+	server := newFlakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	rt, clk := newTestRetryTransport(server.Client().Transport)
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || server.hits.Load() != 3 {
+		t.Errorf("Expected 200 after 3 attempts, got %d after %d", resp.StatusCode, server.hits.Load())
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+	if got := clk.Sleeps(); !equalDurations(got, want) {
+		t.Errorf("Expected backoff %v, got %v", want, got)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	server := newFlakyServer(t, 100, http.StatusBadGateway, nil)
+	rt, clk := newTestRetryTransport(server.Client().Transport)
+	rt.MaxRetries = 5
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway || server.hits.Load() != 6 {
+		t.Errorf("Expected the last 502 after 6 attempts, got %d after %d", resp.StatusCode, server.hits.Load())
+	}
+	if string(body) != "try again\n" {
+		t.Errorf("Expected the last response's body intact, got %q", body)
+	}
+	// 100, 200, 400, 800ms, then capped at MaxDelay
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}
+	if got := clk.Sleeps(); !equalDurations(got, want) {
+		t.Errorf("Expected backoff %v, got %v", want, got)
+	}
+}
+
+func TestRetryTransportFullJitter(t *testing.T) {
+	rt := NewRetryTransport(nil)
+	rt.BaseDelay = 100 * time.Millisecond
+	rt.MaxDelay = time.Second
+	for attempt := 0; attempt < 8; attempt++ {
+		ceiling := rt.BaseDelay << attempt
+		if ceiling > rt.MaxDelay {
+			ceiling = rt.MaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			if d := rt.backoff(attempt); d < 0 || d > ceiling {
+				t.Fatalf("attempt %d: %v is outside [0, %v]", attempt, d, ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryTransportStatuses(t *testing.T) {
+	tests := []struct {
+		status int
+		hits   int32
+	}{
+		{http.StatusTooManyRequests, 2},
+		{http.StatusInternalServerError, 2},
+		{http.StatusGatewayTimeout, 2},
+		{http.StatusNotImplemented, 1},
+		{http.StatusBadRequest, 1},
+		{http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		server := newFlakyServer(t, 1, tt.status, nil)
+		rt, _ := newTestRetryTransport(server.Client().Transport)
+		resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := server.hits.Load(); got != tt.hits {
+			t.Errorf("%d: expected %d attempt(s), got %d", tt.status, tt.hits, got)
+		}
+	}
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	clk := newFakeClock()
+	date := clk.Now().Add(700 * time.Millisecond).Truncate(time.Second).Add(time.Second)
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"seconds", "1", time.Second},
+		{"zero", "0", 0},
+		{"date", date.Format(http.TimeFormat), date.Sub(clk.Now())},
+		{"past date", clk.Now().Add(-time.Hour).Format(http.TimeFormat), 0},
+		{"garbage falls back to backoff", "soon", 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFlakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {tt.value}})
+			rt, clk := newTestRetryTransport(server.Client().Transport)
+			resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := clk.Sleeps(); !equalDurations(got, []time.Duration{tt.want}) {
+				t.Errorf("Expected to wait %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryTransportRetryAfterTooLong(t *testing.T) {
+	server := newFlakyServer(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"120"}})
+	rt, clk := newTestRetryTransport(server.Client().Transport)
+
+	resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || server.hits.Load() != 1 || len(clk.Sleeps()) != 0 {
+		t.Errorf("Expected the 503 straight back, got %d after %d attempt(s)", resp.StatusCode, server.hits.Load())
+	}
+}
+
+func TestRetryTransportRewindsBody(t *testing.T) {
+	server := newFlakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	rt, _ := newTestRetryTransport(server.Client().Transport)
+	client := &http.Client{Transport: rt}
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader(`{"title":"x"}`))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if server.hits.Load() != 3 || string(body) != `{"title":"x"}` {
+		t.Errorf("Expected the full body on attempt 3, got %q on attempt %d", body, server.hits.Load())
+	}
+}
+
+func TestRetryTransportNonIdempotent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		hits   int32
+	}{
+		{"plain POST", nil, 1},
+		{"POST with Idempotency-Key", http.Header{"Idempotency-Key": {"abc"}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil)
+			rt, _ := newTestRetryTransport(server.Client().Transport)
+
+			req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("payload"))
+			req.Header = tt.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			resp, err := (&http.Client{Transport: rt}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := server.hits.Load(); got != tt.hits {
+				t.Errorf("Expected %d attempt(s), got %d", tt.hits, got)
+			}
+		})
+	}
+}
+
+func TestRetryTransportBodyWithoutGetBody(t *testing.T) {
+	server := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	rt, _ := newTestRetryTransport(server.Client().Transport)
+
+	// A plain io.Reader gets no GetBody from NewRequest
+	req, _ := http.NewRequest(http.MethodPut, server.URL, io.MultiReader(strings.NewReader("once")))
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if server.hits.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", server.hits.Load())
+	}
+}
+
+func TestRetryTransportBudget(t *testing.T) {
+	for _, budget := range []int{0, 1, 5} {
+		server := newFlakyServer(t, 100, http.StatusServiceUnavailable, nil)
+		rt, _ := newTestRetryTransport(server.Client().Transport)
+
+		ctx := WithRetryBudget(context.Background(), budget)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := server.hits.Load(); got != int32(budget+1) {
+			t.Errorf("budget %d: expected %d attempt(s), got %d", budget, budget+1, got)
+		}
+	}
+}
+
+// errTransport fails its first failures round trips with a network error.
+type errTransport struct {
+	failures int
+	calls    int
+}
+
+func (t *errTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.calls <= t.failures {
+		return nil, errors.New("connection reset by peer")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestRetryTransportNetworkErrors(t *testing.T) {
+	base := &errTransport{failures: 2}
+	rt, _ := newTestRetryTransport(base)
+	var retries []int
+	rt.OnRetry = func(req *http.Request, attempt int, wait time.Duration, resp *http.Response, err error) {
+		if err == nil || resp != nil {
+			t.Errorf("Expected the network error in OnRetry, got %v %v", resp, err)
+		}
+		retries = append(retries, attempt)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected success on attempt 3, got %v %v", resp, err)
+	}
+	if base.calls != 3 || len(retries) != 2 || retries[1] != 2 {
+		t.Errorf("Expected 3 calls and retries [1 2], got %d and %v", base.calls, retries)
+	}
+
+	base = &errTransport{failures: 100}
+	rt, _ = newTestRetryTransport(base)
+	if _, err := rt.RoundTrip(req); err == nil || base.calls != DefaultMaxRetries+1 {
+		t.Errorf("Expected the last error after %d calls, got %v after %d", DefaultMaxRetries+1, err, base.calls)
+	}
+}
+
+func TestRetryTransportContext(t *testing.T) {
+	server := newFlakyServer(t, 100, http.StatusServiceUnavailable, nil)
+
+	t.Run("cancelled while waiting", func(t *testing.T) {
+		rt := NewRetryTransport(server.Client().Transport)
+		rt.BaseDelay = time.Hour
+		rt.MaxDelay = time.Hour
+		ctx, cancel := context.WithCancel(context.Background())
+		rt.OnRetry = func(*http.Request, int, time.Duration, *http.Response, error) { cancel() }
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if _, err := rt.RoundTrip(req); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("wait past the deadline", func(t *testing.T) {
+		rt, clk := newTestRetryTransport(server.Client().Transport)
+		// The deadline is real, so the clock has to start at the real time
+		clk.now = time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), clk.Now().Add(50*time.Millisecond))
+		defer cancel()
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Expected the 503 rather than a deadline error, got %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || len(clk.Sleeps()) != 0 {
+			t.Errorf("Expected no wait, got %d and %v", resp.StatusCode, clk.Sleeps())
+		}
+	})
+}
+
+func equalDurations(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HTTPGet returns a check that GETs url with client and passes on any
+// 2xx or 3xx status, e.g. for a downstream service's own /readyz. A nil
+// client means http.DefaultClient.
+func HTTPGet(client *http.Client, url string) func(context.Context) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// Drain a little so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// DiskSpace returns a check that fails when the filesystem holding path
+// has less than minFree bytes available to unprivileged users.
+func DiskSpace(path string, minFree uint64) func(context.Context) error {
+	return func(ctx context.Context) error {
+		free, err := freeBytes(path)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%s: %d bytes free, want at least %d", path, free, minFree)
+		}
+		return nil
+	}
+}
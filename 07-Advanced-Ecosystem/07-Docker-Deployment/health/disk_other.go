@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package health
+
+import "errors"
+
+// freeBytes needs syscall.Statfs; elsewhere DiskSpace checks fail
+// instead of passing without looking.
+func freeBytes(path string) (uint64, error) {
+	return 0, errors.New("disk space checks are not supported on this platform")
+}
@@ -0,0 +1,255 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source the tests move by hand.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func pass(context.Context) error { return nil }
+
+func TestEmptyCheckerPasses(t *testing.T) {
+	c := NewChecker()
+	if r := c.Live(context.Background()); r.Status != StatusOK || len(r.Checks) != 0 {
+		t.Errorf("Expected an empty passing report, got %+v", r)
+	}
+}
+
+func TestReadyRunsLivenessAndReadiness(t *testing.T) {
+	c := NewChecker()
+	c.AddLiveness(Check{Name: "loop", Check: pass})
+	c.AddReadiness(Check{Name: "database", Check: func(context.Context) error { return errors.New("connection refused") }})
+	c.AddReadiness(Check{Name: "cache", Check: pass})
+
+	live := c.Live(context.Background())
+	if live.Status != StatusOK || len(live.Checks) != 1 {
+		t.Errorf("Expected only the liveness check to run, got %+v", live)
+	}
+
+	ready := c.Ready(context.Background())
+	if ready.Status != StatusFail {
+		t.Errorf("Expected readiness to fail, got %s", ready.Status)
+	}
+	var names []string
+	for _, r := range ready.Checks {
+		names = append(names, r.Name+"="+string(r.Status))
+	}
+	if got := strings.Join(names, " "); got != "cache=ok database=fail loop=ok" {
+		t.Errorf("Expected sorted results, got %s", got)
+	}
+	if ready.Checks[1].Error != "connection refused" {
+		t.Errorf("Expected the check's error, got %q", ready.Checks[1].Error)
+	}
+}
+
+func TestResultsAreCachedForInterval(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	c := NewChecker()
+	c.now = clock.now
+	var runs atomic.Int32
+	c.AddReadiness(Check{Name: "database", Interval: 10 * time.Second, Check: func(context.Context) error {
+		runs.Add(1)
+		return nil
+	}})
+	c.AddReadiness(Check{Name: "draining", Check: func(context.Context) error {
+		runs.Add(100)
+		return nil
+	}})
+
+	c.Ready(context.Background())
+	clock.advance(9 * time.Second)
+	c.Ready(context.Background())
+	if n := runs.Load(); n != 201 {
+		t.Errorf("Expected the cached check to run once and the other twice, got %d", n)
+	}
+
+	clock.advance(time.Second)
+	c.Ready(context.Background())
+	if n := runs.Load(); n != 302 {
+		t.Errorf("Expected the expired check to run again, got %d", n)
+	}
+}
+
+func TestConcurrentProbesShareARun(t *testing.T) {
+	c := NewChecker()
+	var runs atomic.Int32
+	release := make(chan struct{})
+	c.AddReadiness(Check{Name: "slow", Check: func(context.Context) error {
+		runs.Add(1)
+		<-release
+		return nil
+	}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r := c.Ready(context.Background()); r.Status != StatusOK {
+				t.Errorf("Expected ok, got %+v", r)
+			}
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runs.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // let the other probes join
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("Expected one run, got %d", n)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	c := NewChecker()
+	c.AddReadiness(Check{Name: "hung", Timeout: 20 * time.Millisecond, Check: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	r := c.Ready(context.Background())
+	if r.Status != StatusFail || r.Checks[0].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected a deadline failure, got %+v", r)
+	}
+}
+
+func TestProbeDeadline(t *testing.T) {
+	c := NewChecker()
+	c.ProbeTimeout = 20 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	c.AddReadiness(Check{Name: "ignores-ctx", Timeout: time.Minute, Check: func(context.Context) error {
+		<-release
+		return nil
+	}})
+
+	start := time.Now()
+	r := c.Ready(context.Background())
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected the probe to give up at its deadline, took %v", time.Since(start))
+	}
+	if r.Status != StatusFail || !strings.Contains(r.Checks[0].Error, "probe deadline") {
+		t.Errorf("Expected a probe deadline failure, got %+v", r)
+	}
+}
+
+func TestPanickingCheckFails(t *testing.T) {
+	c := NewChecker()
+	c.AddLiveness(Check{Name: "buggy", Check: func(context.Context) error { panic("boom") }})
+
+	r := c.Live(context.Background())
+	if r.Status != StatusFail || !strings.Contains(r.Checks[0].Error, "boom") {
+		t.Errorf("Expected the panic as a failure, got %+v", r)
+	}
+}
+
+func TestDuplicateCheckPanics(t *testing.T) {
+	c := NewChecker()
+	c.AddLiveness(Check{Name: "db", Check: pass})
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic")
+		}
+	}()
+	c.AddReadiness(Check{Name: "db", Check: pass})
+}
+
+func TestHandler(t *testing.T) {
+	c := NewChecker()
+	healthy := true
+	c.AddReadiness(Check{Name: "database", Check: func(context.Context) error {
+		if !healthy {
+			return errors.New("down")
+		}
+		return nil
+	}})
+
+	tests := []struct {
+		target  string
+		healthy bool
+		status  int
+		checks  int
+	}{
+		{"/readyz", true, http.StatusOK, 0},
+		{"/readyz?verbose", true, http.StatusOK, 1},
+		{"/readyz", false, http.StatusServiceUnavailable, 0},
+		{"/readyz?verbose=1", false, http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		healthy = tt.healthy
+		w := httptest.NewRecorder()
+		c.ReadyHandler().ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+
+		var report Report
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status || len(report.Checks) != tt.checks {
+			t.Errorf("%s (healthy %v): expected %d with %d checks, got %d %+v",
+				tt.target, tt.healthy, tt.status, tt.checks, w.Code, report)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected JSON, got %q", ct)
+		}
+	}
+}
+
+func TestHTTPGet(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer ts.Close()
+
+	check := HTTPGet(ts.Client(), ts.URL)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected a 200 to pass, got %v", err)
+	}
+	status.Store(http.StatusServiceUnavailable)
+	if err := check(context.Background()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected a 503 to fail, got %v", err)
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeBytes(dir); err != nil {
+		t.Skipf("Disk space unavailable here: %v", err)
+	}
+
+	if err := DiskSpace(dir, 1)(context.Background()); err != nil {
+		t.Errorf("Expected at least a byte free, got %v", err)
+	}
+	if err := DiskSpace(dir, 1<<62)(context.Background()); err == nil {
+		t.Error("Expected 4 EiB to be more than is free")
+	}
+}
@@ -5,8 +5,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/codinsec/go-learning-lab/07-advanced-ecosystem/docker-deployment/health"
+	"github.com/codinsec/go-learning-lab/07-advanced-ecosystem/docker-deployment/metrics"
 )
 
+// minFreeDisk is the free space the container needs to stay ready.
+const minFreeDisk = 50 << 20 // 50 MiB
+
 // This program demonstrates Docker deployment for Go applications
 
 func main() {
@@ -16,9 +23,6 @@ func main() {
 		port = "8080"
 	}
 
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/health", healthHandler)
-
 	fmt.Printf("Server starting on port %s\n", port)
 	fmt.Println("=== Docker Deployment ===")
 	fmt.Println()
@@ -33,7 +37,14 @@ func main() {
 	fmt.Println("3. Docker Compose:")
 	fmt.Println("   See docker-compose.yml")
 	fmt.Println()
-	fmt.Println("4. Best Practices:")
+	fmt.Println("4. Metrics:")
+	fmt.Println("   curl http://localhost:" + port + "/metrics")
+	fmt.Println()
+	fmt.Println("5. Health Checks:")
+	fmt.Println("   curl http://localhost:" + port + "/livez")
+	fmt.Println("   curl http://localhost:" + port + "/readyz?verbose")
+	fmt.Println()
+	fmt.Println("6. Best Practices:")
 	fmt.Println("   - Use multi-stage builds")
 	fmt.Println("   - Use .dockerignore")
 	fmt.Println("   - Minimize image size")
@@ -41,16 +52,53 @@ func main() {
 	fmt.Println("   - Set proper working directory")
 	fmt.Println()
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, newMux()))
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Hello from Dockerized Go app!\n")
-	fmt.Fprintf(w, "Environment: %s\n", os.Getenv("ENV"))
+// newMux registers the app's routes, each instrumented with request
+// metrics, and serves them at /metrics in the Prometheus text format.
+// The metrics package is a copy of the one in
+// 06-Standard-Library-Web/02-HTTP-Server, so the Docker build context
+// stays this directory.
+func newMux() *http.ServeMux {
+	reg := metrics.NewRegistry()
+	metrics.RegisterRuntime(reg)
+	m := metrics.NewHTTPMetrics(reg)
+
+	checker := newChecker(os.Getenv("DOWNSTREAM_URL"))
+
+	mux := http.NewServeMux()
+	mux.Handle("/", m.Instrument("/", http.HandlerFunc(handler)))
+	mux.Handle("/livez", m.Instrument("/livez", checker.LiveHandler()))
+	mux.Handle("/readyz", m.Instrument("/readyz", checker.ReadyHandler()))
+	mux.Handle("/health", m.Instrument("/health", checker.LiveHandler()))
+	mux.Handle("/metrics", reg.Handler())
+	return mux
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "OK\n")
+// newChecker registers the app's readiness checks: free disk space in the
+// working directory and, when downstream is set, that service's health
+// URL. Like metrics, the health package is a copy of the one in
+// 02-HTTP-Server.
+func newChecker(downstream string) *health.Checker {
+	checker := health.NewChecker()
+	checker.AddReadiness(health.Check{
+		Name:     "disk",
+		Check:    health.DiskSpace(".", minFreeDisk),
+		Interval: 30 * time.Second,
+	})
+	if downstream != "" {
+		checker.AddReadiness(health.Check{
+			Name:     "downstream",
+			Check:    health.HTTPGet(&http.Client{}, downstream),
+			Timeout:  time.Second,
+			Interval: 10 * time.Second,
+		})
+	}
+	return checker
 }
 
+func handler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Hello from Dockerized Go app!\n")
+	fmt.Fprintf(w, "Environment: %s\n", os.Getenv("ENV"))
+}
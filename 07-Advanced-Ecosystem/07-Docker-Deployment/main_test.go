@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/codinsec/go-learning-lab/07-advanced-ecosystem/docker-deployment/health"
+	"github.com/codinsec/go-learning-lab/07-advanced-ecosystem/docker-deployment/metrics"
 )
 
 func TestHandler(t *testing.T) {
@@ -27,22 +34,113 @@ func TestHandler(t *testing.T) {
 }
 
 func TestHealthHandler(t *testing.T) {
-	req, err := http.NewRequest("GET", "/health", nil)
-	if err != nil {
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Health handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var report health.Report
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
 		t.Fatal(err)
 	}
+	if report.Status != health.StatusOK {
+		t.Errorf("Health handler returned unexpected status: got %v want %v", report.Status, health.StatusOK)
+	}
+}
+
+func TestReadyzChecksDownstream(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer downstream.Close()
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(healthHandler)
-	handler.ServeHTTP(rr, req)
+	newChecker(downstream.URL).ReadyHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/readyz?verbose", nil))
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("Readiness returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+
+	var report health.Report
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]health.Status{}
+	for _, r := range report.Checks {
+		results[r.Name] = r.Status
+	}
+	if results["downstream"] != health.StatusFail || results["disk"] != health.StatusOK {
+		t.Errorf("Unexpected check results: %+v", report.Checks)
+	}
+}
 
+func TestMetrics(t *testing.T) {
+	mux := newMux()
+	for _, path := range []string{"/", "/health", "/health"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
 	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("Health handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		t.Fatalf("Metrics handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	families, err := metrics.ParseText(rr.Body)
+	if err != nil {
+		t.Fatalf("Metrics output is not valid exposition format: %v", err)
 	}
 
-	expected := "OK\n"
-	if rr.Body.String() != expected {
-		t.Errorf("Health handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	requests, ok := families["http_requests_total"]
+	if !ok {
+		t.Fatal("Missing http_requests_total")
+	}
+	counts := map[string]float64{}
+	for _, s := range requests.Samples {
+		counts[s.Labels["route"]+" "+s.Labels["status"]] = s.Value
 	}
+	if counts["/health 200"] != 2 || counts["/ 200"] != 1 {
+		t.Errorf("Unexpected request counts: %v", counts)
+	}
+
+	for _, name := range []string{"http_request_duration_seconds", "http_requests_in_flight", "go_goroutines"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("Missing %s", name)
+		}
+	}
+}
+
+// TestMetricsCopyInSync fails when this lesson's copy of the metrics
+// package drifts from the original in 02-HTTP-Server.
+func TestMetricsCopyInSync(t *testing.T) {
+	checkCopyInSync(t, "metrics")
+}
+
+// TestHealthCopyInSync does the same for the health package.
+func TestHealthCopyInSync(t *testing.T) {
+	checkCopyInSync(t, "health")
 }
 
+func checkCopyInSync(t *testing.T, pkg string) {
+	original := filepath.Join("..", "..", "06-Standard-Library-Web", "02-HTTP-Server", pkg)
+	files, err := filepath.Glob(filepath.Join(original, "*.go"))
+	if err != nil || len(files) == 0 {
+		t.Skip("02-HTTP-Server is not available next to this lesson")
+	}
+
+	for _, file := range files {
+		want, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(pkg, filepath.Base(file)))
+		if err != nil {
+			t.Errorf("Missing copy of %s: %v", filepath.Base(file), err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s/%s differs from %s; copy it again", pkg, filepath.Base(file), file)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPMetrics records request metrics for handlers wrapped by Instrument:
+//
+//	http_requests_total{method,route,status}            counter
+//	http_request_duration_seconds{method,route,status}  histogram
+//	http_requests_in_flight{route}                      gauge
+//
+// route is the pattern a handler was registered under, never the raw
+// path, so /users/1 and /users/2 share one series.
+type HTTPMetrics struct {
+	requests *Counter
+	duration *Histogram
+	inFlight *Gauge
+}
+
+// NewHTTPMetrics registers the request metrics on r.
+func NewHTTPMetrics(r *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.NewCounter("http_requests_total",
+			"Total HTTP requests by method, route and status code.", "method", "route", "status"),
+		duration: r.NewHistogram("http_request_duration_seconds",
+			"HTTP request latency by method, route and status code.", DefBuckets, "method", "route", "status"),
+		inFlight: r.NewGauge("http_requests_in_flight",
+			"HTTP requests currently being served, by route.", "route"),
+	}
+}
+
+// Instrument wraps next and records every request under route.
+func (m *HTTPMetrics) Instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Inc(route)
+		rw := &responseWriter{ResponseWriter: w}
+
+		completed := false
+		defer func() {
+			m.inFlight.Dec(route)
+			status := rw.status
+			switch {
+			case status == 0 && !completed:
+				// Panicked before writing; recovery further out sends a 500
+				status = http.StatusInternalServerError
+			case status == 0:
+				status = http.StatusOK
+			}
+			labels := []string{method(r.Method), route, strconv.Itoa(status)}
+			m.requests.Inc(labels...)
+			m.duration.Observe(time.Since(start).Seconds(), labels...)
+		}()
+
+		next.ServeHTTP(rw, r)
+		completed = true
+	})
+}
+
+// method keeps the method label bounded: clients can send any token.
+func method(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return m
+	}
+	return "OTHER"
+}
+
+// responseWriter records the final status code. It passes Flush, Hijack
+// and Unwrap through so streaming and WebSocket handlers keep working.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	// 1xx responses are informational; the final status comes later
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
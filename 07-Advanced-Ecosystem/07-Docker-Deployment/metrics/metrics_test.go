@@ -0,0 +1,273 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scrape renders reg and parses the result back.
+func scrape(t *testing.T, reg *Registry) map[string]*Family {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	families, err := ParseText(&buf)
+	if err != nil {
+		t.Fatalf("ParseText: %v\n%s", err, buf.String())
+	}
+	return families
+}
+
+// find returns the value of the sample with exactly these labels.
+func find(t *testing.T, f *Family, name string, labels map[string]string) float64 {
+	t.Helper()
+	for _, s := range f.Samples {
+		if s.Name == name && fmt.Sprint(s.Labels) == fmt.Sprint(labels) {
+			return s.Value
+		}
+	}
+	t.Fatalf("No sample %s%v in %+v", name, labels, f.Samples)
+	return 0
+}
+
+func TestCounter(t *testing.T) {
+	reg := NewRegistry()
+	jobs := reg.NewCounter("jobs_total", "Jobs processed.", "queue", "result")
+	jobs.Inc("emails", "ok")
+	jobs.Inc("emails", "ok")
+	jobs.Add(2.5, "emails", "failed")
+
+	f := scrape(t, reg)["jobs_total"]
+	if f.Type != "counter" || f.Help != "Jobs processed." {
+		t.Errorf("Unexpected family header: %+v", f)
+	}
+	if got := find(t, f, "jobs_total", map[string]string{"queue": "emails", "result": "ok"}); got != 2 {
+		t.Errorf("Expected 2, got %v", got)
+	}
+	if got := find(t, f, "jobs_total", map[string]string{"queue": "emails", "result": "failed"}); got != 2.5 {
+		t.Errorf("Expected 2.5, got %v", got)
+	}
+	if got := jobs.Value("emails", "ok"); got != 2 {
+		t.Errorf("Value: expected 2, got %v", got)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	reg := NewRegistry()
+	temp := reg.NewGauge("temperature_celsius", "Current temperature.")
+	temp.Set(20)
+	temp.Inc()
+	temp.Add(-3.5)
+	temp.Dec()
+
+	f := scrape(t, reg)["temperature_celsius"]
+	if f.Type != "gauge" {
+		t.Errorf("Expected gauge, got %s", f.Type)
+	}
+	if got := find(t, f, "temperature_celsius", map[string]string{}); got != 16.5 {
+		t.Errorf("Expected 16.5, got %v", got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	reg := NewRegistry()
+	latency := reg.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 0.5, 1}, "route")
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.7, 2, 5} {
+		latency.Observe(v, "/users")
+	}
+
+	f := scrape(t, reg)["latency_seconds"]
+	if f.Type != "histogram" {
+		t.Fatalf("Expected histogram, got %s", f.Type)
+	}
+
+	// Buckets are cumulative and le is inclusive: 0.1 falls in le="0.1"
+	want := map[string]float64{"0.1": 2, "0.5": 3, "1": 4, "+Inf": 6}
+	for le, count := range want {
+		labels := map[string]string{"route": "/users", "le": le}
+		if got := find(t, f, "latency_seconds_bucket", labels); got != count {
+			t.Errorf("le=%s: expected %v, got %v", le, count, got)
+		}
+	}
+	if got := find(t, f, "latency_seconds_count", map[string]string{"route": "/users"}); got != 6 {
+		t.Errorf("Expected count 6, got %v", got)
+	}
+	if got := find(t, f, "latency_seconds_sum", map[string]string{"route": "/users"}); math.Abs(got-8.15) > 1e-9 {
+		t.Errorf("Expected sum 8.15, got %v", got)
+	}
+	if got := latency.Count("/users"); got != 6 {
+		t.Errorf("Count: expected 6, got %d", got)
+	}
+}
+
+func TestFuncMetrics(t *testing.T) {
+	reg := NewRegistry()
+	n := 0.0
+	reg.OnScrape(func() { n++ })
+	reg.NewGaugeFunc("scrapes", "Scrapes so far.", func() float64 { return n })
+	reg.NewCounterFunc("scrapes_total", "Scrapes so far.", func() float64 { return n })
+
+	scrape(t, reg)
+	families := scrape(t, reg)
+	if got := find(t, families["scrapes"], "scrapes", map[string]string{}); got != 2 {
+		t.Errorf("Expected hook to run before each scrape, got %v", got)
+	}
+	if families["scrapes_total"].Type != "counter" {
+		t.Errorf("Expected counter, got %s", families["scrapes_total"].Type)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("escaped_total", "Help with \\ and\nnewline.", "path").
+		Inc("a \"quoted\" \\ path\nwith newline")
+
+	var buf bytes.Buffer
+	reg.Write(&buf)
+	if !strings.Contains(buf.String(), `# HELP escaped_total Help with \\ and\nnewline.`) {
+		t.Errorf("HELP not escaped:\n%s", buf.String())
+	}
+
+	f := scrape(t, reg)["escaped_total"]
+	if f.Help != "Help with \\ and\nnewline." {
+		t.Errorf("HELP did not round trip: %q", f.Help)
+	}
+	if got := f.Samples[0].Labels["path"]; got != "a \"quoted\" \\ path\nwith newline" {
+		t.Errorf("Label did not round trip: %q", got)
+	}
+}
+
+func TestWriteIsSorted(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("b_total", "B.", "k")
+	c.Inc("z")
+	c.Inc("a")
+	reg.NewGauge("a_gauge", "A.").Set(1)
+
+	var buf bytes.Buffer
+	reg.Write(&buf)
+	want := `# HELP a_gauge A.
+# TYPE a_gauge gauge
+a_gauge 1
+# HELP b_total B.
+# TYPE b_total counter
+b_total{k="a"} 1
+b_total{k="z"} 1
+`
+	if buf.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func TestRegistrationPanics(t *testing.T) {
+	tests := map[string]func(r *Registry){
+		"bad name":        func(r *Registry) { r.NewCounter("bad-name", "") },
+		"bad label":       func(r *Registry) { r.NewCounter("ok_total", "", "bad-label") },
+		"reserved label":  func(r *Registry) { r.NewCounter("ok_total", "", "__name") },
+		"duplicate label": func(r *Registry) { r.NewCounter("ok_total", "", "a", "a") },
+		"le label":        func(r *Registry) { r.NewHistogram("ok", "", nil, "le") },
+		"bad buckets":     func(r *Registry) { r.NewHistogram("ok", "", []float64{1, 1}) },
+		"duplicate": func(r *Registry) {
+			r.NewCounter("dup_total", "")
+			r.NewGauge("dup_total", "")
+		},
+		"wrong label count": func(r *Registry) { r.NewCounter("ok_total", "", "a").Inc() },
+		"negative counter":  func(r *Registry) { r.NewCounter("ok_total", "").Add(-1) },
+	}
+
+	for name, register := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a panic")
+				}
+			}()
+			register(NewRegistry())
+		})
+	}
+}
+
+// TestConcurrentUpdates is meant to be run with -race.
+func TestConcurrentUpdates(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("hits_total", "", "worker")
+	h := reg.NewHistogram("work_seconds", "", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Inc(fmt.Sprint(i % 2))
+				h.Observe(0.01)
+			}
+			reg.Write(&bytes.Buffer{})
+		}(i)
+	}
+	wg.Wait()
+
+	if got := c.Value("0") + c.Value("1"); got != 8000 {
+		t.Errorf("Expected 8000, got %v", got)
+	}
+	if got := h.Count(); got != 8000 {
+		t.Errorf("Expected 8000 observations, got %d", got)
+	}
+}
+
+func TestRegisterRuntime(t *testing.T) {
+	reg := NewRegistry()
+	RegisterRuntime(reg)
+	families := scrape(t, reg)
+
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "go_memstats_sys_bytes", "go_gc_cycles_total"} {
+		f, ok := families[name]
+		if !ok {
+			t.Errorf("Missing %s", name)
+			continue
+		}
+		if len(f.Samples) != 1 {
+			t.Errorf("%s: expected one sample, got %d", name, len(f.Samples))
+		}
+	}
+	if got := families["go_goroutines"].Samples[0].Value; got < 1 {
+		t.Errorf("Expected at least one goroutine, got %v", got)
+	}
+	if got := families["go_memstats_sys_bytes"].Samples[0].Value; got <= 0 {
+		t.Errorf("Expected memstats to be read before the scrape, got %v", got)
+	}
+	if v := families["go_info"].Samples[0].Labels["version"]; !strings.HasPrefix(v, "go") && !strings.HasPrefix(v, "devel") {
+		t.Errorf("Unexpected go_info version %q", v)
+	}
+}
+
+func TestParseTextErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad value":        "x 1.2.3\n",
+		"no value":         "x\n",
+		"unquoted label":   "x{a=b} 1\n",
+		"unterminated":     "x{a=\"b} 1\n",
+		"duplicate label":  "x{a=\"1\",a=\"2\"} 1\n",
+		"type after value": "x 1\n# TYPE x counter\n",
+		"unknown type":     "# TYPE x widget\n",
+		"bad name":         "1x 1\n",
+	}
+	for name, text := range tests {
+		if _, err := ParseText(strings.NewReader(text)); err == nil {
+			t.Errorf("%s: expected an error for %q", name, text)
+		}
+	}
+
+	families, err := ParseText(strings.NewReader("# a comment\nx{a=\"1\",} 2 1700000000000\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s := families["x"].Samples[0]; s.Value != 2 || s.Labels["a"] != "1" {
+		t.Errorf("Unexpected sample %+v", s)
+	}
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Sample is one value line of the text exposition format.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Family is a metric name with its # HELP, # TYPE and samples. The
+// _bucket, _sum and _count samples of a histogram belong to its family.
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// ParseText parses the text exposition format into families keyed by
+// name. It is strict about syntax so tests can use it to check that
+// Write produces output a Prometheus server would accept.
+func ParseText(r io.Reader) (map[string]*Family, error) {
+	families := map[string]*Family{}
+	get := func(name string) *Family {
+		f, ok := families[name]
+		if !ok {
+			f = &Family{Name: name, Type: "untyped"}
+			families[name] = f
+		}
+		return f
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "#") {
+			fields := strings.SplitN(text, " ", 4)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue // plain comment
+			}
+			f := get(fields[2])
+			rest := ""
+			if len(fields) == 4 {
+				rest = fields[3]
+			}
+			if fields[1] == "HELP" {
+				f.Help = unescape(rest, false)
+				continue
+			}
+			if len(f.Samples) > 0 || f.Type != "untyped" {
+				return nil, fmt.Errorf("line %d: TYPE for %s must come once, before its samples", line, f.Name)
+			}
+			switch rest {
+			case "counter", "gauge", "histogram", "summary", "untyped":
+				f.Type = rest
+			default:
+				return nil, fmt.Errorf("line %d: unknown type %q", line, rest)
+			}
+			continue
+		}
+
+		s, err := parseSample(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		f := get(familyName(families, s.Name))
+		f.Samples = append(f.Samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// familyName maps a histogram or summary sample name to its family.
+func familyName(families map[string]*Family, name string) string {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if f, ok := families[base]; ok && base != name && (f.Type == "histogram" || f.Type == "summary") {
+			return base
+		}
+	}
+	return name
+}
+
+// parseSample parses `name{label="value",...} value [timestamp]`.
+func parseSample(text string) (Sample, error) {
+	s := Sample{Labels: map[string]string{}}
+
+	end := strings.IndexAny(text, "{ ")
+	if end <= 0 {
+		return s, fmt.Errorf("malformed sample %q", text)
+	}
+	s.Name = text[:end]
+	if !metricNameRE.MatchString(s.Name) {
+		return s, fmt.Errorf("invalid metric name %q", s.Name)
+	}
+	rest := text[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		rest, err = parseLabels(rest[1:], s.Labels)
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", s.Name, err)
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return s, fmt.Errorf("%s: expected a value and optional timestamp, got %q", s.Name, rest)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("%s: invalid value %q", s.Name, fields[0])
+	}
+	s.Value = v
+	return s, nil
+}
+
+// parseLabels reads label pairs up to the closing brace and returns the
+// text after it.
+func parseLabels(text string, labels map[string]string) (string, error) {
+	for {
+		text = strings.TrimLeft(text, " ")
+		if strings.HasPrefix(text, "}") {
+			return text[1:], nil
+		}
+
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 {
+			return "", errors.New("malformed labels")
+		}
+		name := strings.TrimSpace(text[:eq])
+		if !labelNameRE.MatchString(name) {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+		if _, dup := labels[name]; dup {
+			return "", fmt.Errorf("duplicate label %q", name)
+		}
+		text = strings.TrimLeft(text[eq+1:], " ")
+		if !strings.HasPrefix(text, `"`) {
+			return "", fmt.Errorf("label %s: value must be quoted", name)
+		}
+
+		// Find the closing quote, skipping escaped characters
+		i := 1
+		for ; i < len(text) && text[i] != '"'; i++ {
+			if text[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(text) {
+			return "", fmt.Errorf("label %s: unterminated value", name)
+		}
+		labels[name] = unescape(text[1:i], true)
+		text = strings.TrimLeft(text[i+1:], " ")
+
+		switch {
+		case strings.HasPrefix(text, ","):
+			text = text[1:]
+		case strings.HasPrefix(text, "}"):
+		default:
+			return "", errors.New("expected , or } after label value")
+		}
+	}
+}
+
+// unescape reverses escapeHelp, or escapeLabel when quotes is set.
+func unescape(s string, quotes bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch {
+		case s[i] == 'n':
+			b.WriteByte('\n')
+		case s[i] == '\\', s[i] == '"' && quotes:
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// RegisterRuntime adds Go runtime statistics to r, using the metric names
+// of the official Prometheus Go client so existing dashboards work.
+// Memory statistics come from one runtime.ReadMemStats call per scrape.
+func RegisterRuntime(r *Registry) {
+	var ms runtime.MemStats
+	r.OnScrape(func() { runtime.ReadMemStats(&ms) })
+
+	r.NewGauge("go_info", "Information about the Go environment.", "version").
+		Set(1, runtime.Version())
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+
+	r.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.",
+		func() float64 { return float64(ms.Alloc) })
+	r.NewCounterFunc("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.",
+		func() float64 { return float64(ms.TotalAlloc) })
+	r.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from system.",
+		func() float64 { return float64(ms.Sys) })
+	r.NewGaugeFunc("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.",
+		func() float64 { return float64(ms.HeapInuse) })
+	r.NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.",
+		func() float64 { return float64(ms.HeapObjects) })
+	r.NewCounterFunc("go_memstats_mallocs_total", "Total number of mallocs.",
+		func() float64 { return float64(ms.Mallocs) })
+	r.NewCounterFunc("go_memstats_frees_total", "Total number of frees.",
+		func() float64 { return float64(ms.Frees) })
+
+	r.NewCounterFunc("go_gc_cycles_total", "Number of completed GC cycles.",
+		func() float64 { return float64(ms.NumGC) })
+	r.NewCounterFunc("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.",
+		func() float64 { return time.Duration(ms.PauseTotalNs).Seconds() })
+
+}